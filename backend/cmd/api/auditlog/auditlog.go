@@ -0,0 +1,187 @@
+package auditlog
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReasonHeader carries an optional, URL-encoded reason for an action.
+const ReasonHeader = "X-Audit-Log-Reason"
+
+const maxReasonLength = 512
+
+type Action string
+
+const (
+	ServerCreate                  Action = "server_create"
+	ServerUpdate                  Action = "server_update"
+	ServerOwnerTransfer           Action = "server_owner_transfer"
+	ServerDelist                  Action = "server_delist"
+	ServerRelist                  Action = "server_relist"
+	ChannelCreate                 Action = "channel_create"
+	ChannelUpdate                 Action = "channel_update"
+	ChannelFollow                 Action = "channel_follow"
+	ChannelUnfollow               Action = "channel_unfollow"
+	BotAdd                        Action = "bot_add"
+	MemberTimeout                 Action = "member_timeout"
+	MemberTimeoutRemove           Action = "member_timeout_remove"
+	MemberUpdate                  Action = "member_update"
+	MessageDelete                 Action = "message_delete"
+	MessagesExport                Action = "messages_export"
+	TemplateCreate                Action = "template_create"
+	TemplateUpdate                Action = "template_update"
+	TemplateDelete                Action = "template_delete"
+	WebhookCreate                 Action = "webhook_create"
+	WebhookUpdate                 Action = "webhook_update"
+	WebhookDelete                 Action = "webhook_delete"
+	EventSubscriptionCreate       Action = "event_subscription_create"
+	EventSubscriptionUpdate       Action = "event_subscription_update"
+	EventSubscriptionDelete       Action = "event_subscription_delete"
+	EventSubscriptionSecretRotate Action = "event_subscription_secret_rotate"
+	AutoModRuleCreate             Action = "automod_rule_create"
+	AutoModRuleUpdate             Action = "automod_rule_update"
+	AutoModRuleDelete             Action = "automod_rule_delete"
+)
+
+// Actions lists every action that is recorded.
+var Actions = []Action{
+	ServerCreate, ServerUpdate, ServerOwnerTransfer, ServerDelist, ServerRelist,
+	ChannelCreate, ChannelUpdate, ChannelFollow, ChannelUnfollow,
+	BotAdd, MemberTimeout, MemberTimeoutRemove, MemberUpdate,
+	MessageDelete, MessagesExport,
+	TemplateCreate, TemplateUpdate, TemplateDelete,
+	WebhookCreate, WebhookUpdate, WebhookDelete,
+	EventSubscriptionCreate, EventSubscriptionUpdate, EventSubscriptionDelete, EventSubscriptionSecretRotate,
+	AutoModRuleCreate, AutoModRuleUpdate, AutoModRuleDelete,
+}
+
+// Change is one field an action changed. Old is unset for created objects
+// and New for deleted ones.
+type Change struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// Changes is stored as a JSONB column.
+type Changes []Change
+
+func (c Changes) Value() (driver.Value, error) {
+	if c == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(c)
+}
+
+func (c *Changes) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("changes: expected []byte")
+	}
+	return json.Unmarshal(b, c)
+}
+
+type Entry struct {
+	ID       int64  `db:"id" json:"id"`
+	ServerID int64  `db:"server_id" json:"server_id"`
+	UserID   *int64 `db:"user_id" json:"user_id"`
+	Action   Action `db:"action" json:"action"`
+	// TargetID is the ID of what was acted on, e.g. a channel or a member.
+	TargetID  *int64    `db:"target_id" json:"target_id"`
+	Changes   Changes   `db:"changes" json:"changes"`
+	Reason    *string   `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+const entryColumns = "id, server_id, user_id, action, target_id, changes, reason, created_at"
+
+// ignoredKeys are fields that identify an object rather than describe it.
+var ignoredKeys = map[string]bool{
+	"id":         true,
+	"server_id":  true,
+	"created_by": true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// fields returns the JSON fields of v.
+func fields(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// Diff compares the JSON form of an object before and after an action.
+// before is nil for created objects and after for deleted ones.
+func Diff(before, after interface{}) Changes {
+	old, updated := fields(before), fields(after)
+	keys := make(map[string]bool)
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range updated {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		if !ignoredKeys[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+
+	changes := Changes{}
+	for _, k := range sorted {
+		if !reflect.DeepEqual(old[k], updated[k]) {
+			changes = append(changes, Change{Key: k, Old: old[k], New: updated[k]})
+		}
+	}
+	return changes
+}
+
+// Reason returns the reason given with a request, if any.
+func Reason(r *http.Request) string {
+	raw := r.Header.Get(ReasonHeader)
+	reason, err := url.PathUnescape(raw)
+	if err != nil {
+		reason = raw
+	}
+	reason = strings.TrimSpace(reason)
+	if runes := []rune(reason); len(runes) > maxReasonLength {
+		reason = string(runes[:maxReasonLength])
+	}
+	return reason
+}
+
+// Record stores an action taken by userID in a server, with the reason given
+// in the request. Pass the transaction making the change so that the entry is
+// only kept with it. r is nil for actions taken in the background.
+func Record(db sqlx.Execer, r *http.Request, serverID, userID int64, action Action, targetID int64, changes Changes) error {
+	var reason *string
+	if r != nil {
+		if s := Reason(r); s != "" {
+			reason = &s
+		}
+	}
+	_, err := db.Exec(`
+		INSERT INTO audit_log_entries (server_id, user_id, action, target_id, changes, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, serverID, userID, action, targetID, changes, reason)
+	return err
+}
@@ -0,0 +1,111 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/permissions"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+type Handler struct {
+	DB *sqlx.DB
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/servers/{server_id}/audit-log", h.handleListEntries).Methods("GET")
+}
+
+// optionalID parses an ID query parameter, returning nil when it's absent.
+func optionalID(r *http.Request, name string) (*int64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// handleListEntries returns a server's audit log, newest first. It can be
+// filtered by user_id, action and target_id and paged with before.
+func (h *Handler) handleListEntries(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ViewAuditLog)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing view audit log permission", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	action := Action(query.Get("action"))
+	if action != "" && !slices.Contains(Actions, action) {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	actor, err := optionalID(r, "user_id")
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+	target, err := optionalID(r, "target_id")
+	if err != nil {
+		http.Error(w, "Invalid target_id", http.StatusBadRequest)
+		return
+	}
+	before, err := optionalID(r, "before")
+	if err != nil {
+		http.Error(w, "Invalid 'before' ID", http.StatusBadRequest)
+		return
+	}
+	limit := int64(defaultPageSize)
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 && l <= maxPageSize {
+		limit = l
+	}
+
+	entries := []Entry{}
+	err = h.DB.Select(&entries, `
+		SELECT `+entryColumns+` FROM audit_log_entries
+		WHERE server_id = $1
+			AND ($2::TEXT = '' OR action = $2::TEXT)
+			AND ($3::BIGINT IS NULL OR user_id = $3)
+			AND ($4::BIGINT IS NULL OR target_id = $4)
+			AND ($5::BIGINT IS NULL OR id < $5)
+		ORDER BY id DESC
+		LIMIT $6
+	`, serverID, action, actor, target, before, limit)
+	if err != nil {
+		log.Printf("Error fetching audit log: %v", err)
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -3,50 +3,44 @@ package auth
 import (
 	"database/sql"
 	"encoding/json"
-	"errors"
+	"log"
 	"net/http"
-	"os"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/mailer"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Gateway exposes the live websocket connections of a session.
+type Gateway interface {
+	IsSessionConnected(sessionID int) bool
+	DisconnectSession(sessionID int)
+}
+
 type Handler struct {
-	DB *sqlx.DB
+	DB      *sqlx.DB
+	Gateway Gateway
+	Mailer  mailer.Mailer
 }
 
 // ValidateToken validates the provided JWT token and extracts the user_id claim.
 func ValidateToken(tokenStr string) (float64, error) {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
-	})
-	if err != nil || !token.Valid {
-		return 0, errors.New("invalid token")
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return 0, errors.New("invalid token claims")
-	}
-
-	userID, ok := claims["user_id"].(float64)
-	if !ok {
-		return 0, errors.New("invalid user ID")
+	claims, err := Authenticate(tokenStr)
+	if err != nil {
+		return 0, err
 	}
-
-	return userID, nil
+	return float64(claims.UserID), nil
 }
 
 type User struct {
-	ID       int    `db:"id"`
-	Username string `db:"username"`
-	Email    string `db:"email"`
-	Password string `db:"password"`
+	ID            int    `db:"id"`
+	Username      string `db:"username"`
+	Email         string `db:"email"`
+	Password      string `db:"password"`
+	EmailVerified bool   `db:"email_verified"`
+	TOTPEnabled   bool   `db:"totp_enabled"`
+	IsBot         bool   `db:"is_bot"`
 }
 
 func (h *Handler) HandleSignup(w http.ResponseWriter, r *http.Request) {
@@ -56,42 +50,40 @@ func (h *Handler) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if fields := validateSignup(&user); fields != nil {
+		writeValidationError(w, fields)
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = h.DB.Exec(
-		"INSERT INTO users (username, email, password) VALUES ($1, $2, $3)",
+	var dbUser User
+	err = h.DB.Get(&dbUser.ID,
+		"INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id",
 		user.Username, user.Email, hashedPassword,
 	)
-	if err != nil {
-		http.Error(w, "Could not create user", http.StatusInternalServerError)
+	if field, ok := uniqueViolationField(err); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  field + " already taken",
+			"fields": ValidationError{field: "is already taken"},
+		})
 		return
-	}
-
-	var dbUser User
-	err = h.DB.Get(&dbUser, "SELECT id FROM users WHERE email=$1", user.Email)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Server error", http.StatusInternalServerError)
+	} else if err != nil {
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": dbUser.ID,
-	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+	if err := h.sendVerificationEmail(r.Context(), dbUser.ID, user.Email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	h.writeNewSession(w, r, dbUser.ID)
 }
 
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -101,31 +93,55 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email := normalizeEmail(user.Email)
+
 	var dbUser User
-	err := h.DB.Get(&dbUser, "SELECT id, username, email, password FROM users WHERE email=$1", user.Email)
-	if err == sql.ErrNoRows {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+	err := h.DB.Get(&dbUser, "SELECT id, username, email, password, totp_enabled FROM users WHERE email=$1 AND NOT is_bot", email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
-	} else if err != nil {
+	}
+	found := err == nil
+
+	wait, err := h.lockedFor(accountKey(email), ipKey(r))
+	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	if wait > 0 {
+		h.loginFailed(r, email, dbUser.ID, failureLocked)
+		writeTooManyAttempts(w, wait)
+		return
+	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(user.Password)); err != nil {
+	// Unknown emails are checked against a dummy hash so both failures look
+	// the same, in content and in timing.
+	hash := dummyHash
+	if found {
+		hash = []byte(dbUser.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(user.Password)); err != nil || !found {
+		h.loginFailed(r, email, dbUser.ID, failureInvalidPassword)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": dbUser.ID,
-	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+	if dbUser.TOTPEnabled {
+		ticket, err := signMFATicket(dbUser.ID)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"ticket":       ticket,
+		})
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	h.clearFailures(accountKey(email))
+	h.writeNewSession(w, r, dbUser.ID)
 }
 
 func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
@@ -138,7 +154,7 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user User
-	err = h.DB.Get(&user, "SELECT id, username, email FROM users WHERE id=$1", userID)
+	err = h.DB.Get(&user, "SELECT id, username, email, email_verified, totp_enabled, is_bot FROM users WHERE id=$1", userID)
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -155,4 +171,24 @@ func (h *Handler) RegisterRoutes(r *mux.Router) {
 	r.HandleFunc("/signup", h.HandleSignup).Methods("POST")
 	r.HandleFunc("/login", h.HandleLogin).Methods("POST")
 	r.HandleFunc("/user", h.GetUser).Methods("GET")
+	r.HandleFunc("/token/refresh", h.HandleRefresh).Methods("POST")
+	r.HandleFunc("/logout", h.HandleLogout).Methods("POST")
+	r.HandleFunc("/logout/all", h.HandleLogoutAll).Methods("POST")
+	r.HandleFunc("/sessions", h.HandleListSessions).Methods("GET")
+	r.HandleFunc("/sessions/{session_id}", h.HandleRevokeSession).Methods("DELETE")
+	r.HandleFunc("/verify-email", h.HandleVerifyEmail).Methods("POST")
+	r.HandleFunc("/verify-email/resend", h.HandleResendVerification).Methods("POST")
+	r.HandleFunc("/password/forgot", h.HandleForgotPassword).Methods("POST")
+	r.HandleFunc("/password/reset", h.HandleResetPassword).Methods("POST")
+	r.HandleFunc("/login/mfa", h.HandleLoginMFA).Methods("POST")
+	r.HandleFunc("/mfa/totp/enroll", h.HandleEnrollTOTP).Methods("POST")
+	r.HandleFunc("/mfa/totp/confirm", h.HandleConfirmTOTP).Methods("POST")
+	r.HandleFunc("/mfa/totp/disable", h.HandleDisableTOTP).Methods("POST")
+	r.HandleFunc("/mfa/backup-codes", h.HandleRegenerateBackupCodes).Methods("POST")
+	r.HandleFunc("/login-attempts", h.HandleFailedLogins).Methods("GET")
+	r.HandleFunc("/bots", h.HandleCreateBot).Methods("POST")
+	r.HandleFunc("/bots", h.HandleListBots).Methods("GET")
+	r.HandleFunc("/bots/{bot_id}", h.HandleUpdateBot).Methods("PATCH")
+	r.HandleFunc("/bots/{bot_id}/token", h.HandleRegenerateBotToken).Methods("POST")
+	r.HandleFunc("/bots/{bot_id}/interactions-secret", h.HandleRotateInteractionsSecret).Methods("POST")
 }
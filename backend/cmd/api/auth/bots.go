@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// botAuthScheme prefixes bot credentials in the Authorization header.
+	botAuthScheme = "Bot "
+	// botTokenPrefix makes bot tokens easy to tell apart, e.g. by secret scanners.
+	botTokenPrefix = "mdbot_"
+)
+
+// authenticateBot resolves a bot token to the bot's user ID.
+func authenticateBot(token string) (*Claims, error) {
+	if !strings.HasPrefix(token, botTokenPrefix) {
+		return nil, errors.New("invalid bot token")
+	}
+	if authDB == nil {
+		return nil, errors.New("session store not initialized")
+	}
+	var botID int
+	err := authDB.Get(&botID, `
+		SELECT bt.bot_id FROM bot_tokens bt
+		JOIN users u ON u.id = bt.bot_id
+		WHERE bt.token_hash = $1 AND u.is_bot
+	`, hashToken(token))
+	if err != nil {
+		return nil, errors.New("invalid bot token")
+	}
+	return &Claims{UserID: botID, IsBot: true}, nil
+}
+
+func newBotToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := botTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+// newInteractionsSecret returns a key for signing a bot's interaction callbacks.
+func newInteractionsSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// replaceBotToken stores a new token for the bot, invalidating the old one.
+func replaceBotToken(tx *sqlx.Tx, botID int) (string, error) {
+	token, tokenHash, err := newBotToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO bot_tokens (bot_id, token_hash) VALUES ($1, $2)
+		ON CONFLICT (bot_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = NOW()
+	`, botID, tokenHash)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// authenticateHuman rejects bot credentials on endpoints meant for people.
+func authenticateHuman(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	claims, err := Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	if claims.IsBot {
+		http.Error(w, "Bots cannot use this endpoint", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+type Bot struct {
+	ID        int       `db:"id" json:"id"`
+	Username  string    `db:"username" json:"username"`
+	OwnerID   int       `db:"bot_owner_id" json:"owner_id"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+// HandleCreateBot creates a bot account owned by the current user and returns
+// its first token and interactions secret. Neither is shown again.
+func (h *Handler) HandleCreateBot(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHuman(w, r)
+	if !ok {
+		return
+	}
+
+	var request CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if msg := validateUsername(request.Username); msg != "" {
+		writeValidationError(w, ValidationError{"username": msg})
+		return
+	}
+
+	// Bots can't log in with a password: the address is unroutable and the
+	// empty hash never matches.
+	placeholder := make([]byte, 12)
+	if _, err := rand.Read(placeholder); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	email := "bot-" + hex.EncodeToString(placeholder) + "@bots.invalid"
+	secret, err := newInteractionsSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var bot Bot
+	err = tx.Get(&bot, `
+		INSERT INTO users (username, email, password, email_verified, is_bot, bot_owner_id, interactions_secret)
+		VALUES ($1, $2, '', TRUE, TRUE, $3, $4)
+		RETURNING id, username, bot_owner_id, created_at
+	`, request.Username, email, claims.UserID, secret)
+	if field, ok := uniqueViolationField(err); ok && field == "username" {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Could not create bot", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := replaceBotToken(tx, bot.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bot":                 bot,
+		"token":               token,
+		"interactions_secret": secret,
+	})
+}
+
+// HandleListBots lists the bots owned by the current user.
+func (h *Handler) HandleListBots(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHuman(w, r)
+	if !ok {
+		return
+	}
+
+	bots := []Bot{}
+	err := h.DB.Select(&bots, `
+		SELECT id, username, bot_owner_id, created_at
+		FROM users
+		WHERE is_bot AND bot_owner_id = $1
+		ORDER BY created_at
+	`, claims.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bots)
+}
+
+// HandleRegenerateBotToken issues a new token for one of the user's bots and
+// revokes the previous one.
+func (h *Handler) HandleRegenerateBotToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHuman(w, r)
+	if !ok {
+		return
+	}
+
+	botID, err := strconv.Atoi(mux.Vars(r)["bot_id"])
+	if err != nil {
+		http.Error(w, "Invalid bot_id", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	err = tx.Get(&ownerID, "SELECT bot_owner_id FROM users WHERE id = $1 AND is_bot FOR UPDATE", botID)
+	if err == sql.ErrNoRows || (err == nil && ownerID != claims.UserID) {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := replaceBotToken(tx, botID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// HandleRotateInteractionsSecret gives one of the user's bots a new key for
+// signing interaction callbacks. The old one stops working at once.
+func (h *Handler) HandleRotateInteractionsSecret(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHuman(w, r)
+	if !ok {
+		return
+	}
+
+	botID, err := strconv.Atoi(mux.Vars(r)["bot_id"])
+	if err != nil {
+		http.Error(w, "Invalid bot_id", http.StatusBadRequest)
+		return
+	}
+	secret, err := newInteractionsSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := h.DB.Exec(`
+		UPDATE users SET interactions_secret = $3
+		WHERE id = $1 AND is_bot AND bot_owner_id = $2
+	`, botID, claims.UserID, secret)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"interactions_secret": secret})
+}
+
+type UpdateBotRequest struct {
+	InteractionsURL *string `json:"interactions_url"`
+}
+
+// HandleUpdateBot changes the settings of one of the user's bots. An empty
+// interactions_url makes the bot receive interactions over the gateway.
+func (h *Handler) HandleUpdateBot(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHuman(w, r)
+	if !ok {
+		return
+	}
+
+	botID, err := strconv.Atoi(mux.Vars(r)["bot_id"])
+	if err != nil {
+		http.Error(w, "Invalid bot_id", http.StatusBadRequest)
+		return
+	}
+	var request UpdateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if request.InteractionsURL == nil {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+	if *request.InteractionsURL != "" {
+		u, err := url.Parse(*request.InteractionsURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			writeValidationError(w, ValidationError{"interactions_url": "must be an http(s) URL"})
+			return
+		}
+	}
+
+	res, err := h.DB.Exec(`
+		UPDATE users SET interactions_url = NULLIF($3, '')
+		WHERE id = $1 AND is_bot AND bot_owner_id = $2
+	`, botID, claims.UserID, *request.InteractionsURL)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
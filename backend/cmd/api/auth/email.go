@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokenKindVerifyEmail   = "verify_email"
+	tokenKindPasswordReset = "password_reset"
+
+	verifyEmailTTL   = 48 * time.Hour
+	passwordResetTTL = time.Hour
+)
+
+// appURL is the base URL of the frontend used in links sent by email.
+func appURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:3000"
+}
+
+// createEmailToken stores a new single-use token of the given kind and returns it.
+func (h *Handler) createEmailToken(userID int, kind string, ttl time.Duration) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = h.DB.Exec(`
+		INSERT INTO email_tokens (user_id, kind, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, kind, tokenHash, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeEmailToken marks a valid token of the given kind as used and returns
+// its user. It runs in the caller's transaction so the token is only spent
+// if what it was used for is saved too.
+func consumeEmailToken(tx *sqlx.Tx, token, kind string) (int, error) {
+	var userID int
+	err := tx.Get(&userID, `
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND kind = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(token), kind)
+	return userID, err
+}
+
+func (h *Handler) sendVerificationEmail(ctx context.Context, userID int, email string) error {
+	if h.Mailer == nil {
+		return nil
+	}
+	token, err := h.createEmailToken(userID, tokenKindVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return h.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Welcome to mini-discord!\n\nConfirm your email address by opening:\n%s/verify-email?token=%s\n\nThis link expires in 48 hours.\n",
+			appURL(), token,
+		),
+	})
+}
+
+type EmailTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// HandleVerifyEmail confirms the email address a verification token was sent to.
+func (h *Handler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var request EmailTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeEmailToken(tx, request.Token, tokenKindVerifyEmail)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleResendVerification sends a fresh verification email to the current user.
+func (h *Handler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var user struct {
+		Email    string `db:"email"`
+		Verified bool   `db:"email_verified"`
+	}
+	if err := h.DB.Get(&user, "SELECT email, email_verified FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user.Verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if err := h.sendVerificationEmail(r.Context(), int(userID), user.Email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		http.Error(w, "Could not send email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// HandleForgotPassword emails a password reset link. It answers the same way
+// whether or not the email belongs to an account.
+func (h *Handler) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var request ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	request.Email = normalizeEmail(request.Email)
+
+	var userID int
+	err := h.DB.Get(&userID, "SELECT id FROM users WHERE email = $1 AND NOT is_bot", request.Email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && h.Mailer != nil {
+		token, err := h.createEmailToken(userID, tokenKindPasswordReset, passwordResetTTL)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		err = h.Mailer.Send(r.Context(), mailer.Message{
+			To:      request.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf(
+				"Someone asked to reset the password of your mini-discord account.\n\nOpen this link to choose a new one:\n%s/reset-password?token=%s\n\nThe link expires in 1 hour. If you didn't ask for this, ignore this email.\n",
+				appURL(), token,
+			),
+		})
+		if err != nil {
+			log.Printf("Error sending password reset email: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// HandleResetPassword sets a new password using a reset token and signs the
+// user out everywhere.
+func (h *Handler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var request ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validatePassword(request.Password); msg != "" {
+		writeValidationError(w, ValidationError{"password": msg})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeEmailToken(tx, request.Token, tokenKindPasswordReset)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Receiving the reset email proves ownership of the address too.
+	_, err = tx.Exec(`
+		UPDATE users SET password = $2, email_verified = TRUE WHERE id = $1
+	`, userID, hashedPassword)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND kind = $2 AND used_at IS NULL
+	`, userID, tokenKindPasswordReset)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := h.revokeSessions(userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
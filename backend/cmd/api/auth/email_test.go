@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHandler connects to the migrated database in TEST_DATABASE_URL and
+// creates a user to run the flows against.
+func testHandler(t *testing.T) (*Handler, *mailer.MemoryMailer, int, string) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	suffix := time.Now().UnixNano()
+	email := fmt.Sprintf("mailtest%d@example.com", suffix)
+	var userID int
+	err = db.Get(&userID, `
+		INSERT INTO users (username, email, password) VALUES ($1, $2, 'x') RETURNING id
+	`, fmt.Sprintf("mailtest%d", suffix%1e9), email)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", userID) })
+
+	mail := &mailer.MemoryMailer{}
+	return &Handler{DB: db, Mailer: mail}, mail, userID, email
+}
+
+var tokenParam = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// lastToken returns the token in the link of the last email sent to email.
+func lastToken(t *testing.T, mail *mailer.MemoryMailer, email string) string {
+	t.Helper()
+	sent := mail.Sent()
+	if len(sent) == 0 {
+		t.Fatal("no email sent")
+	}
+	msg := sent[len(sent)-1]
+	if msg.To != email {
+		t.Fatalf("email sent to %q, want %q", msg.To, email)
+	}
+	match := tokenParam.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("no token in email body %q", msg.Body)
+	}
+	return match[1]
+}
+
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return rec
+}
+
+func TestVerifyEmail(t *testing.T) {
+	h, mail, userID, email := testHandler(t)
+
+	if err := h.sendVerificationEmail(context.Background(), userID, email); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	token := lastToken(t, mail, email)
+
+	if rec := post(h.HandleVerifyEmail, `{"token":"`+token+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("verify: status %d: %s", rec.Code, rec.Body)
+	}
+	var verified bool
+	h.DB.Get(&verified, "SELECT email_verified FROM users WHERE id = $1", userID)
+	if !verified {
+		t.Error("email not marked as verified")
+	}
+
+	if rec := post(h.HandleVerifyEmail, `{"token":"`+token+`"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	h, mail, userID, email := testHandler(t)
+
+	if rec := post(h.HandleForgotPassword, `{"email":"`+strings.ToUpper(email)+`"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot: status %d: %s", rec.Code, rec.Body)
+	}
+	token := lastToken(t, mail, email)
+
+	// A rejected password must leave the token usable.
+	if rec := post(h.HandleResetPassword, `{"token":"`+token+`","password":"short"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("weak password: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	const password = "Correct-Horse-9"
+	if rec := post(h.HandleResetPassword, `{"token":"`+token+`","password":"`+password+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset: status %d: %s", rec.Code, rec.Body)
+	}
+	var user User
+	h.DB.Get(&user, "SELECT password, email_verified FROM users WHERE id = $1", userID)
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		t.Error("password was not changed")
+	}
+	if !user.EmailVerified {
+		t.Error("email not marked as verified")
+	}
+
+	if rec := post(h.HandleResetPassword, `{"token":"`+token+`","password":"`+password+`"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	h, mail, _, _ := testHandler(t)
+
+	if rec := post(h.HandleForgotPassword, `{"email":"nobody@example.invalid"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if sent := mail.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d emails for an unknown address", len(sent))
+	}
+}
@@ -0,0 +1,406 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mfaTicketTTL    = 5 * time.Minute
+	backupCodeCount = 10
+)
+
+var (
+	ErrMFARequired    = errors.New("two-factor code required")
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+)
+
+// RequireMFA checks the X-MFA-Code header for users that have two-factor
+// authentication enabled. Handlers call it before sensitive actions.
+func RequireMFA(r *http.Request, userID int) error {
+	var enabled bool
+	if err := authDB.Get(&enabled, "SELECT totp_enabled FROM users WHERE id = $1", userID); err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+
+	code := r.Header.Get("X-MFA-Code")
+	if code == "" {
+		return ErrMFARequired
+	}
+	ok, err := checkSecondFactor(authDB, userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// WriteMFAError maps the result of RequireMFA to an HTTP response and reports
+// whether the request was rejected.
+func WriteMFAError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrMFARequired), errors.Is(err, ErrInvalidMFACode):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+	return true
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused backup
+// code. Both are consumed on success.
+func checkSecondFactor(db *sqlx.DB, userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits && strings.Trim(code, "0123456789") == "" {
+		var user struct {
+			Secret   sql.NullString `db:"totp_secret"`
+			LastStep int64          `db:"totp_last_step"`
+		}
+		if err := db.Get(&user, "SELECT totp_secret, totp_last_step FROM users WHERE id = $1", userID); err != nil {
+			return false, err
+		}
+		if !user.Secret.Valid {
+			return false, nil
+		}
+		step, ok := verifyTOTP(user.Secret.String, code, user.LastStep, time.Now())
+		if !ok {
+			return false, nil
+		}
+		res, err := db.Exec(`
+			UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2
+		`, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+
+	var id int
+	err := db.Get(&id, `
+		UPDATE mfa_backup_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+		RETURNING id
+	`, userID, hashToken(normalizeBackupCode(code)))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func normalizeBackupCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// replaceBackupCodes discards the user's backup codes and returns a fresh set.
+func replaceBackupCodes(tx *sqlx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_backup_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, backupCodeCount)
+	for i := 0; i < backupCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(buf))
+		_, err := tx.Exec(`
+			INSERT INTO mfa_backup_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, hashToken(raw))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, raw[:4]+"-"+raw[4:])
+	}
+	return codes, nil
+}
+
+func signMFATicket(userID int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"mfa_user_id": userID,
+		"exp":         time.Now().Add(mfaTicketTTL).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+}
+
+func parseMFATicket(ticket string) (int, error) {
+	token, err := jwt.Parse(ticket, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
+	})
+	if err != nil || !token.Valid {
+		return 0, errors.New("invalid or expired ticket")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, errors.New("invalid ticket claims")
+	}
+	userID, ok := claims["mfa_user_id"].(float64)
+	if !ok {
+		return 0, errors.New("invalid ticket claims")
+	}
+	return int(userID), nil
+}
+
+type MFALoginRequest struct {
+	Ticket string `json:"ticket"`
+	Code   string `json:"code"`
+}
+
+// HandleLoginMFA completes a login started by HandleLogin for users with 2FA enabled.
+func (h *Handler) HandleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var request MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := parseMFATicket(request.Ticket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	if err := h.DB.Get(&email, "SELECT email FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	wait, err := h.lockedFor(accountKey(email), ipKey(r))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		h.loginFailed(r, email, userID, failureLocked)
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(h.DB, userID, request.Code)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.loginFailed(r, email, userID, failureInvalidMFACode)
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	h.clearFailures(accountKey(email))
+	h.writeNewSession(w, r, userID)
+}
+
+// HandleEnrollTOTP generates a new TOTP secret. It only takes effect once
+// confirmed with HandleConfirmTOTP.
+func (h *Handler) HandleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT email, totp_enabled FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	_, err = h.DB.Exec(`
+		UPDATE users SET totp_secret = $2, totp_last_step = 0 WHERE id = $1
+	`, userID, secret)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(secret, user.Email),
+	})
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// HandleConfirmTOTP enables 2FA once the user proves their authenticator
+// works, and returns the one-time backup codes.
+func (h *Handler) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var request TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var user struct {
+		Secret   sql.NullString `db:"totp_secret"`
+		Enabled  bool           `db:"totp_enabled"`
+		LastStep int64          `db:"totp_last_step"`
+	}
+	err = h.DB.Get(&user, "SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1", userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if !user.Secret.Valid {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+	step, ok := verifyTOTP(user.Secret.String, strings.TrimSpace(request.Code), user.LastStep, time.Now())
+	if !ok {
+		http.Error(w, ErrInvalidMFACode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_enabled = TRUE, totp_last_step = $2 WHERE id = $1
+	`, userID, step)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	codes, err := replaceBackupCodes(tx, int(userID))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"backup_codes": codes})
+}
+
+// HandleDisableTOTP turns 2FA off. It requires a current code in X-MFA-Code.
+func (h *Handler) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if WriteMFAError(w, RequireMFA(r, int(userID))) {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = 0 WHERE id = $1
+	`, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_backup_codes WHERE user_id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRegenerateBackupCodes replaces the backup codes. It requires a current
+// code in X-MFA-Code.
+func (h *Handler) HandleRegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var enabled bool
+	if err := h.DB.Get(&enabled, "SELECT totp_enabled FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if WriteMFAError(w, RequireMFA(r, int(userID))) {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceBackupCodes(tx, int(userID))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"backup_codes": codes})
+}
@@ -0,0 +1,549 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	// lastSeenResolution limits how often a session's last_seen_at is written.
+	lastSeenResolution = time.Minute
+)
+
+// authDB backs the package-level helpers such as Authenticate and RequireMFA.
+var authDB *sqlx.DB
+
+// Init sets the database used by the package-level helpers.
+func Init(db *sqlx.DB) {
+	authDB = db
+}
+
+// Claims holds the identity carried by an access token.
+type Claims struct {
+	UserID    int
+	SessionID int
+	// IsBot is set for bot tokens, which have no session.
+	IsBot bool
+}
+
+// TokenResponse is returned by every endpoint that issues tokens.
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// parseAccessToken checks the signature and expiry of an access token. It
+// doesn't check whether the session was revoked.
+func parseAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return mapClaims, nil
+}
+
+// Authenticate validates the access token and checks that its session is still
+// active. Bot credentials of the form "Bot <token>" are accepted as well.
+func Authenticate(tokenStr string) (*Claims, error) {
+	if strings.HasPrefix(tokenStr, botAuthScheme) {
+		return authenticateBot(strings.TrimPrefix(tokenStr, botAuthScheme))
+	}
+
+	mapClaims, err := parseAccessToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, ok := mapClaims["user_id"].(float64)
+	if !ok {
+		return nil, errors.New("invalid user ID")
+	}
+	sessionID, ok := mapClaims["sid"].(float64)
+	if !ok {
+		return nil, errors.New("invalid session ID")
+	}
+
+	if authDB == nil {
+		return nil, errors.New("session store not initialized")
+	}
+	var session struct {
+		Active   bool      `db:"active"`
+		LastSeen time.Time `db:"last_seen_at"`
+	}
+	err = authDB.Get(&session, `
+		SELECT revoked_at IS NULL AS active, last_seen_at FROM sessions WHERE id = $1 AND user_id = $2
+	`, int(sessionID), int(userID))
+	if err != nil || !session.Active {
+		return nil, errors.New("session revoked")
+	}
+	if time.Since(session.LastSeen) > lastSeenResolution {
+		authDB.Exec("UPDATE sessions SET last_seen_at = NOW() WHERE id = $1", int(sessionID))
+	}
+
+	return &Claims{UserID: int(userID), SessionID: int(sessionID)}, nil
+}
+
+func signAccessToken(userID, sessionID int) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"sid":     sessionID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(accessTokenTTL).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+}
+
+// newOpaqueToken returns a random URL-safe token and its SHA-256 hex digest.
+func newOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RateLimitKey identifies who a request comes from: the user of a validly
+// signed access token, a bot with a valid token, or otherwise the client's
+// IP. Bot tokens carry no signature, so they are looked up; made-up ones
+// fall back to the IP rather than getting a bucket of their own.
+func RateLimitKey(r *http.Request) string {
+	tokenStr := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(tokenStr, botAuthScheme); ok {
+		if claims, err := authenticateBot(token); err == nil {
+			return "bot:" + strconv.Itoa(claims.UserID)
+		}
+		return "ip:" + clientIP(r)
+	}
+	if tokenStr != "" {
+		if claims, err := parseAccessToken(tokenStr); err == nil {
+			if userID, ok := claims["user_id"].(float64); ok {
+				return "user:" + strconv.Itoa(int(userID))
+			}
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// trustedProxies are the networks allowed to report the client's address in
+// X-Forwarded-For, read once from TRUSTED_PROXIES as comma-separated IPs or
+// CIDRs. With none configured the header is ignored.
+var trustedProxies = sync.OnceValue(func() []*net.IPNet {
+	return parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+})
+
+func parseTrustedProxies(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the originating address of the request. X-Forwarded-For
+// is only honoured when the request comes from a trusted proxy, and then read
+// from the right, skipping the trusted proxies, so a client can't prepend
+// addresses of its choosing.
+func clientIP(r *http.Request) string {
+	return forwardedFor(r, trustedProxies())
+}
+
+func forwardedFor(r *http.Request, proxies []*net.IPNet) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !isTrustedProxy(proxies, addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(proxies, hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// createSession starts a new session for the user and returns its first token pair.
+func (h *Handler) createSession(r *http.Request, userID int) (*TokenResponse, error) {
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	err = tx.QueryRow(`
+		INSERT INTO sessions (user_id, user_agent, ip_address)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, r.UserAgent(), clientIP(r)).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := insertRefreshToken(tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := signAccessToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func insertRefreshToken(tx *sqlx.Tx, sessionID int) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, sessionID, tokenHash, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (h *Handler) writeNewSession(w http.ResponseWriter, r *http.Request, userID int) {
+	tokens, err := h.createSession(r, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// HandleRefresh rotates a refresh token. Presenting a token that was already
+// rotated is treated as theft and revokes the whole session.
+func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var stored struct {
+		ID        int          `db:"id"`
+		SessionID int          `db:"session_id"`
+		UserID    int          `db:"user_id"`
+		ExpiresAt time.Time    `db:"expires_at"`
+		UsedAt    sql.NullTime `db:"used_at"`
+		RevokedAt sql.NullTime `db:"revoked_at"`
+	}
+	err = tx.Get(&stored, `
+		SELECT rt.id, rt.session_id, s.user_id, rt.expires_at, rt.used_at, s.revoked_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`, hashToken(request.RefreshToken))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if stored.RevokedAt.Valid {
+		http.Error(w, "Session revoked", http.StatusUnauthorized)
+		return
+	}
+	if stored.UsedAt.Valid {
+		if _, err := tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1", stored.SessionID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database commit failed", http.StatusInternalServerError)
+			return
+		}
+		if h.Gateway != nil {
+			h.Gateway.DisconnectSession(stored.SessionID)
+		}
+		http.Error(w, "Refresh token reuse detected, session revoked", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", stored.ID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE sessions SET last_seen_at = NOW(), user_agent = $2, ip_address = $3 WHERE id = $1
+	`, stored.SessionID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := insertRefreshToken(tx, stored.SessionID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := signAccessToken(stored.UserID, stored.SessionID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	})
+}
+
+// HandleLogout revokes the session the access token belongs to.
+func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	claims, err := Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.revokeSessions(claims.UserID, claims.SessionID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLogoutAll revokes every session of the user, including the current one.
+func (h *Handler) HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims, err := Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.revokeSessions(claims.UserID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSessions revokes the given sessions of the user, or all of them when
+// none are given, and drops their gateway connections.
+func (h *Handler) revokeSessions(userID int, sessionIDs ...int) error {
+	var revoked []int
+	var err error
+	if len(sessionIDs) == 0 {
+		err = h.DB.Select(&revoked, `
+			UPDATE sessions SET revoked_at = NOW()
+			WHERE user_id = $1 AND revoked_at IS NULL
+			RETURNING id
+		`, userID)
+	} else {
+		err = h.DB.Select(&revoked, `
+			UPDATE sessions SET revoked_at = NOW()
+			WHERE user_id = $1 AND id = ANY($2) AND revoked_at IS NULL
+			RETURNING id
+		`, userID, pq.Array(sessionIDs))
+	}
+	if err != nil {
+		return err
+	}
+
+	if h.Gateway != nil {
+		for _, id := range revoked {
+			h.Gateway.DisconnectSession(id)
+		}
+	}
+	return nil
+}
+
+type Session struct {
+	ID         int       `db:"id" json:"id"`
+	UserAgent  string    `db:"user_agent" json:"user_agent"`
+	IPAddress  string    `db:"ip_address" json:"ip_address"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"last_seen_at"`
+	Current    bool      `db:"-" json:"current"`
+	Connected  bool      `db:"-" json:"connected"`
+}
+
+// HandleListSessions lists the active sessions of the user.
+func (h *Handler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, err := Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	sessions := []Session{}
+	err = h.DB.Select(&sessions, `
+		SELECT s.id, s.user_agent, s.ip_address, s.created_at, s.last_seen_at
+		FROM sessions s
+		WHERE s.user_id = $1 AND s.revoked_at IS NULL
+		  AND EXISTS (
+			SELECT 1 FROM refresh_tokens rt
+			WHERE rt.session_id = s.id AND rt.used_at IS NULL AND rt.expires_at > NOW()
+		  )
+		ORDER BY s.last_seen_at DESC
+	`, claims.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.SessionID
+		if h.Gateway != nil {
+			sessions[i].Connected = h.Gateway.IsSessionConnected(sessions[i].ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// HandleRevokeSession revokes one of the user's sessions and closes its gateway connections.
+func (h *Handler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, err := Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := strconv.Atoi(mux.Vars(r)["session_id"])
+	if err != nil {
+		http.Error(w, "Invalid session_id", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = h.DB.Get(&exists, `
+		SELECT EXISTS (
+			SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		)
+	`, sessionID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.revokeSessions(claims.UserID, sessionID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	proxies := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"untrusted sender ignored", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"spoofed prefix skipped", "10.1.2.3:5000", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", "10.1.2.3:5000", "198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		{"garbage hop", "10.1.2.3:5000", "not-an-ip", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := forwardedFor(r, proxies); got != tt.want {
+				t.Errorf("forwardedFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitKeyIgnoresUnverifiedBotTokens(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:5000"
+	for _, header := range []string{"", "Bot " + botTokenPrefix + "made-up", "Bot nonsense", "not-a-jwt"} {
+		r.Header.Set("Authorization", header)
+		if got := RateLimitKey(r); got != "ip:203.0.113.7" {
+			t.Errorf("RateLimitKey() with %q = %q, want the IP key", header, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// throttleRule describes when failures on a key start locking it out. Every
+// failure past threshold doubles the lockout, starting at baseDelay.
+type throttleRule struct {
+	threshold int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	// window is how long without failures before the counter starts over.
+	window time.Duration
+}
+
+var (
+	accountThrottle = throttleRule{threshold: 3, baseDelay: time.Second, maxDelay: 15 * time.Minute, window: time.Hour}
+	ipThrottle      = throttleRule{threshold: 20, baseDelay: time.Second, maxDelay: 15 * time.Minute, window: time.Hour}
+)
+
+const (
+	failureInvalidPassword = "invalid_password"
+	failureInvalidMFACode  = "invalid_mfa_code"
+	failureLocked          = "locked"
+)
+
+// dummyHash is compared against when the email is unknown, so a missing
+// account takes as long to reject as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password-for-timing"), bcrypt.DefaultCost)
+
+func accountKey(email string) string { return "email:" + email }
+
+// ipKey throttles by the client address behind any trusted proxies. IPv6
+// clients usually get a whole /64, so they are throttled per prefix.
+func ipKey(r *http.Request) string {
+	ip := clientIP(r)
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() && !addr.Is4In6() {
+		prefix, _ := addr.Prefix(64)
+		return "ip:" + prefix.String()
+	}
+	return "ip:" + ip
+}
+
+// lockedFor returns how long the most restrictive of keys is still locked out.
+func (h *Handler) lockedFor(keys ...string) (time.Duration, error) {
+	var until sql.NullTime
+	err := h.DB.Get(&until, `
+		SELECT MAX(locked_until) FROM login_throttle WHERE key = ANY($1)
+	`, pq.Array(keys))
+	if err != nil || !until.Valid {
+		return 0, err
+	}
+	return time.Until(until.Time), nil
+}
+
+// recordFailure bumps the failure counter of key and locks it when rule says so.
+func (h *Handler) recordFailure(key string, rule throttleRule) error {
+	var failures int
+	err := h.DB.Get(&failures, `
+		INSERT INTO login_throttle (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttle.last_failure_at < NOW() - $2::interval THEN 1
+				ELSE login_throttle.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures
+	`, key, fmt.Sprintf("%d seconds", int(rule.window.Seconds())))
+	if err != nil || failures < rule.threshold {
+		return err
+	}
+
+	delay := time.Duration(float64(rule.baseDelay) * math.Pow(2, float64(failures-rule.threshold)))
+	if delay <= 0 || delay > rule.maxDelay {
+		delay = rule.maxDelay
+	}
+	_, err = h.DB.Exec(`
+		UPDATE login_throttle SET locked_until = $2 WHERE key = $1
+	`, key, time.Now().Add(delay))
+	return err
+}
+
+func (h *Handler) clearFailures(key string) error {
+	_, err := h.DB.Exec("DELETE FROM login_throttle WHERE key = $1", key)
+	return err
+}
+
+// loginFailed records a failed attempt against the account and the client IP.
+// userID is 0 when the email does not belong to anyone.
+func (h *Handler) loginFailed(r *http.Request, email string, userID int, reason string) {
+	if reason != failureLocked {
+		if err := h.recordFailure(accountKey(email), accountThrottle); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+		}
+		if err := h.recordFailure(ipKey(r), ipThrottle); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+		}
+	}
+	if userID == 0 {
+		return
+	}
+	_, err := h.DB.Exec(`
+		INSERT INTO failed_logins (user_id, ip_address, user_agent, reason)
+		VALUES ($1, $2, $3, $4)
+	`, userID, clientIP(r), r.UserAgent(), reason)
+	if err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+}
+
+type FailedLogin struct {
+	ID        int       `db:"id" json:"id"`
+	IPAddress string    `db:"ip_address" json:"ip_address"`
+	UserAgent string    `db:"user_agent" json:"user_agent"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// HandleFailedLogins lists the most recent failed logins on the user's account.
+func (h *Handler) HandleFailedLogins(w http.ResponseWriter, r *http.Request) {
+	userID, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	attempts := []FailedLogin{}
+	err = h.DB.Select(&attempts, `
+		SELECT id, ip_address, user_agent, reason, created_at
+		FROM failed_logins
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
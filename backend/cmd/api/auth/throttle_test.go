@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"203.0.113.7:5000", "ip:203.0.113.7"},
+		{"[2001:db8:1:2:aaaa::1]:5000", "ip:2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:bbbb::9]:5000", "ip:2001:db8:1:2::/64"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = tt.remoteAddr
+		// Without trusted proxies the header must not change the key.
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		if got := ipKey(r); got != tt.want {
+			t.Errorf("ipKey(%s) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
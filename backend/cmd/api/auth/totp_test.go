@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA-1 key of the RFC 6238 test vectors.
+var rfcKey = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to the last six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfcKey, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", secret, totpCode(rfcKey, current), 0, current, true},
+		{"previous step", secret, totpCode(rfcKey, current-1), 0, current - 1, true},
+		{"next step", secret, totpCode(rfcKey, current+1), 0, current + 1, true},
+		{"two steps behind", secret, totpCode(rfcKey, current-2), 0, 0, false},
+		{"two steps ahead", secret, totpCode(rfcKey, current+2), 0, 0, false},
+		{"replayed step", secret, totpCode(rfcKey, current), current, 0, false},
+		{"earlier step after a later one", secret, totpCode(rfcKey, current-1), current, 0, false},
+		{"later step after an earlier one", secret, totpCode(rfcKey, current+1), current, current + 1, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", totpCode(rfcKey, current), 0, current, true},
+		{"wrong code", secret, "000000", 0, 0, false},
+		{"short code", secret, totpCode(rfcKey, current)[:5], 0, 0, false},
+		{"invalid secret", "not base32!", totpCode(rfcKey, current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(tt.secret, tt.code, tt.lastStep, now)
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: verifyTOTP() = %d, %v, want %d, %v", tt.name, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	maxEmailLength    = 100
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordBytes = 72
+)
+
+//go:embed breached_passwords.txt
+var breachedPasswordList string
+
+var breachedPasswords = func() map[string]bool {
+	set := make(map[string]bool)
+	for _, line := range strings.Split(breachedPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return set
+}()
+
+// ValidationError maps request fields to what is wrong with them.
+type ValidationError map[string]string
+
+func (v ValidationError) Error() string {
+	return "validation failed"
+}
+
+func writeValidationError(w http.ResponseWriter, fields ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  fields.Error(),
+		"fields": fields,
+	})
+}
+
+// normalizeEmail trims and lowercases an address so lookups are case-insensitive.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validateUsername(username string) string {
+	length := len([]rune(username))
+	if length < minUsernameLength || length > maxUsernameLength {
+		return fmt.Sprintf("must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	for _, r := range username {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.') {
+			return "may only contain letters, digits, '_' and '.'"
+		}
+	}
+	if strings.Contains(username, "..") {
+		return "may not contain consecutive periods"
+	}
+	return ""
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "is required"
+	}
+	if len(email) > maxEmailLength {
+		return "is too long"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "is not a valid email address"
+	}
+	return ""
+}
+
+// validatePassword enforces the password policy. identifiers are values the
+// password must not contain, such as the username.
+func validatePassword(password string, identifiers ...string) string {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Sprintf("must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Sprintf("must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var classes [4]bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			classes[0] = true
+		case unicode.IsUpper(r):
+			classes[1] = true
+		case unicode.IsDigit(r):
+			classes[2] = true
+		default:
+			classes[3] = true
+		}
+	}
+	count := 0
+	for _, present := range classes {
+		if present {
+			count++
+		}
+	}
+	if count < 2 {
+		return "must mix at least two of lowercase, uppercase, digits and symbols"
+	}
+
+	lower := strings.ToLower(password)
+	if breachedPasswords[lower] {
+		return "is too common, it appears in known data breaches"
+	}
+	for _, id := range identifiers {
+		if len(id) >= minUsernameLength && strings.Contains(lower, strings.ToLower(id)) {
+			return "must not contain your username or email"
+		}
+	}
+	return ""
+}
+
+// validateSignup normalizes the user's email in place and checks every field.
+// It returns nil when the request is valid.
+func validateSignup(user *User) ValidationError {
+	user.Username = strings.TrimSpace(user.Username)
+	user.Email = normalizeEmail(user.Email)
+
+	fields := ValidationError{}
+	if msg := validateUsername(user.Username); msg != "" {
+		fields["username"] = msg
+	}
+	if msg := validateEmail(user.Email); msg != "" {
+		fields["email"] = msg
+	}
+	localPart, _, _ := strings.Cut(user.Email, "@")
+	if msg := validatePassword(user.Password, user.Username, localPart); msg != "" {
+		fields["password"] = msg
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+	return nil
+}
+
+// uniqueViolationField reports which users column a unique violation is about.
+func uniqueViolationField(err error) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return "", false
+	}
+	switch pqErr.Constraint {
+	case "users_username_key", "users_username_lower_key":
+		return "username", true
+	case "users_email_key", "users_email_lower_key":
+		return "email", true
+	}
+	return "", false
+}
@@ -0,0 +1,231 @@
+package automod
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// cacheTTL bounds how long compiled rules are used without reloading.
+	// Changes made through the API invalidate the cache right away.
+	cacheTTL = 5 * time.Minute
+	// historySize is how many recent messages are kept per author.
+	historySize = 20
+	// historySweepThreshold is the number of tracked authors above which
+	// stale histories are dropped.
+	historySweepThreshold = 10000
+	// maxSnippet bounds the matched text reported in a Match.
+	maxSnippet = 100
+)
+
+// Message is what rules are evaluated against.
+type Message struct {
+	ServerID  int
+	ChannelID int
+	UserID    int
+	// Role is the author's role in the server.
+	Role string
+	// Content is the sanitized content; PlainText has the markdown removed.
+	Content   string
+	PlainText string
+}
+
+// Match is a rule that a message broke.
+type Match struct {
+	RuleID   int64   `json:"rule_id"`
+	RuleName string  `json:"rule_name"`
+	Trigger  Trigger `json:"trigger"`
+	// Matched is the offending part of the message, if there is one.
+	Matched string  `json:"matched,omitempty"`
+	Actions Actions `json:"-"`
+}
+
+type serverRules struct {
+	rules    []*compiledRule
+	loadedAt time.Time
+}
+
+type sentMessage struct {
+	content string
+	at      time.Time
+}
+
+// Engine evaluates the rules of a server. Rules are compiled once and cached
+// per server, so evaluating a message doesn't touch the database.
+type Engine struct {
+	DB *sqlx.DB
+
+	mu      sync.RWMutex
+	servers map[int]*serverRules
+
+	historyMu sync.Mutex
+	history   map[[2]int][]sentMessage
+}
+
+func NewEngine(db *sqlx.DB) *Engine {
+	return &Engine{
+		DB:      db,
+		servers: make(map[int]*serverRules),
+		history: make(map[[2]int][]sentMessage),
+	}
+}
+
+// Invalidate drops the cached rules of a server.
+func (e *Engine) Invalidate(serverID int) {
+	e.mu.Lock()
+	delete(e.servers, serverID)
+	e.mu.Unlock()
+}
+
+func (e *Engine) rules(serverID int) ([]*compiledRule, error) {
+	e.mu.RLock()
+	cached, ok := e.servers[serverID]
+	e.mu.RUnlock()
+	if ok && time.Since(cached.loadedAt) < cacheTTL {
+		return cached.rules, nil
+	}
+
+	var rows []Rule
+	err := e.DB.Select(&rows, `
+		SELECT `+ruleColumns+` FROM automod_rules
+		WHERE server_id = $1 AND enabled
+		ORDER BY id
+	`, serverID)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*compiledRule, 0, len(rows))
+	for _, row := range rows {
+		compiled, err := compile(row)
+		if err != nil {
+			// Rules are validated when saved, so this only happens if the
+			// matcher rules changed since.
+			log.Printf("Skipping automod rule %d: %v", row.ID, err)
+			continue
+		}
+		rules = append(rules, compiled)
+	}
+
+	e.mu.Lock()
+	e.servers[serverID] = &serverRules{rules: rules, loadedAt: time.Now()}
+	e.mu.Unlock()
+	return rules, nil
+}
+
+// Evaluate returns the rules the message breaks. Every message evaluated is
+// remembered for repeated-message detection.
+func (e *Engine) Evaluate(msg Message) ([]Match, error) {
+	rules, err := e.rules(msg.ServerID)
+	if err != nil {
+		return nil, err
+	}
+	repeats := e.remember(msg)
+
+	var matches []Match
+	for _, rule := range rules {
+		if rule.exemptRoles[msg.Role] || rule.exemptChannels[int64(msg.ChannelID)] {
+			continue
+		}
+		matched, ok := rule.check(msg, repeats)
+		if !ok {
+			continue
+		}
+		if len(matched) > maxSnippet {
+			matched = matched[:maxSnippet]
+		}
+		matches = append(matches, Match{
+			RuleID:   rule.ID,
+			RuleName: rule.Name,
+			Trigger:  rule.Trigger,
+			Matched:  matched,
+			Actions:  rule.Actions,
+		})
+	}
+	return matches, nil
+}
+
+// check reports whether the message breaks the rule and what matched.
+// repeats returns how often the author sent the message within a window.
+func (r *compiledRule) check(msg Message, repeats func(window time.Duration) int) (string, bool) {
+	c := r.Config
+	switch r.Trigger {
+	case TriggerKeyword:
+		for _, m := range r.matcher.FindAllString(msg.PlainText, -1) {
+			if !r.allow[strings.ToLower(m)] {
+				return m, true
+			}
+		}
+	case TriggerInvite:
+		for _, m := range invitePattern.FindAllStringSubmatch(msg.Content, -1) {
+			if !r.allow[strings.ToLower(m[1])] {
+				return m[0], true
+			}
+		}
+	case TriggerMentionSpam:
+		distinct := map[string]bool{}
+		for _, m := range mentionPattern.FindAllString(msg.Content, -1) {
+			distinct[m] = true
+		}
+		if len(distinct) > c.MaxMentions {
+			return "", true
+		}
+	case TriggerRepeatedMessage:
+		if repeats(time.Duration(c.WindowSeconds)*time.Second) > c.MaxRepeats {
+			return "", true
+		}
+	case TriggerCaps:
+		letters, upper := 0, 0
+		for _, ch := range msg.PlainText {
+			if unicode.IsLetter(ch) {
+				letters++
+				if unicode.IsUpper(ch) {
+					upper++
+				}
+			}
+		}
+		if letters >= c.MinLength && float64(upper)/float64(letters) > c.MaxCapsRatio {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// remember records the message in its author's history and returns a
+// function counting how often the same content was sent within a window,
+// this message included.
+func (e *Engine) remember(msg Message) func(window time.Duration) int {
+	key := [2]int{msg.ServerID, msg.UserID}
+	content := strings.ToLower(strings.Join(strings.Fields(msg.PlainText), " "))
+	now := time.Now()
+
+	e.historyMu.Lock()
+	if len(e.history) > historySweepThreshold {
+		for k, sent := range e.history {
+			if now.Sub(sent[len(sent)-1].at) > maxWindow*time.Second {
+				delete(e.history, k)
+			}
+		}
+	}
+	sent := append(e.history[key], sentMessage{content: content, at: now})
+	if len(sent) > historySize {
+		sent = sent[len(sent)-historySize:]
+	}
+	e.history[key] = sent
+	snapshot := append([]sentMessage(nil), sent...)
+	e.historyMu.Unlock()
+
+	return func(window time.Duration) int {
+		n := 0
+		for _, s := range snapshot {
+			if s.content == content && now.Sub(s.at) <= window {
+				n++
+			}
+		}
+		return n
+	}
+}
@@ -0,0 +1,289 @@
+package automod
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/permissions"
+)
+
+type RuleHandler struct {
+	DB     *sqlx.DB
+	Engine *Engine
+}
+
+func (h *RuleHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/servers/{server_id}/automod/rules", h.handleCreateRule).Methods("POST")
+	router.HandleFunc("/servers/{server_id}/automod/rules", h.handleListRules).Methods("GET")
+	router.HandleFunc("/automod/rules/{rule_id}", h.handleUpdateRule).Methods("PATCH")
+	router.HandleFunc("/automod/rules/{rule_id}", h.handleDeleteRule).Methods("DELETE")
+}
+
+// requireManageServer checks that the user may configure the server.
+func (h *RuleHandler) requireManageServer(w http.ResponseWriter, userID float64, serverID int64) bool {
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageServer)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage server permission", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkFlagChannels makes sure alerts can only go to the rule's own server.
+func (h *RuleHandler) checkFlagChannels(w http.ResponseWriter, rule *Rule) bool {
+	ids := rule.FlagChannels()
+	if len(ids) == 0 {
+		return true
+	}
+	var count int
+	err := h.DB.Get(&count, `
+		SELECT COUNT(*) FROM channels WHERE id = ANY($1) AND server_id = $2 AND type = 'text'
+	`, pq.Int64Array(ids), rule.ServerID)
+	if err != nil {
+		http.Error(w, "Failed to verify channels", http.StatusInternalServerError)
+		return false
+	}
+	if count != len(ids) {
+		http.Error(w, "Flag channels must be text channels of this server", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// loadManagedRule loads the rule named in the route if the user may manage
+// it. The user's ID is returned with it.
+func (h *RuleHandler) loadManagedRule(w http.ResponseWriter, r *http.Request) (*Rule, int64, bool) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, 0, false
+	}
+	ruleID, err := strconv.ParseInt(mux.Vars(r)["rule_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rule_id", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	var rule Rule
+	err = h.DB.Get(&rule, "SELECT "+ruleColumns+" FROM automod_rules WHERE id = $1", ruleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return nil, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch rule", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if !h.requireManageServer(w, userID, rule.ServerID) {
+		return nil, 0, false
+	}
+	return &rule, int64(userID), true
+}
+
+func (h *RuleHandler) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	if !h.requireManageServer(w, userID, serverID) {
+		return
+	}
+
+	rule := Rule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	rule.ServerID = serverID
+	if err := rule.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.checkFlagChannels(w, &rule) {
+		return
+	}
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM automod_rules WHERE server_id = $1", serverID); err != nil {
+		http.Error(w, "Failed to count rules", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxRulesPerServer {
+		http.Error(w, "Too many automod rules for this server", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var created Rule
+	err = tx.Get(&created, `
+		INSERT INTO automod_rules (server_id, name, trigger, config, actions, exempt_roles, exempt_channels, enabled, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+ruleColumns,
+		serverID, rule.Name, rule.Trigger, rule.Config, rule.Actions, rule.ExemptRoles, rule.ExemptChannels, rule.Enabled, int64(userID))
+	if err != nil {
+		log.Printf("Error creating automod rule: %v", err)
+		http.Error(w, "Failed to create rule", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.AutoModRuleCreate, created.ID, auditlog.Diff(nil, created))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Engine.Invalidate(int(serverID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *RuleHandler) handleListRules(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	if !h.requireManageServer(w, userID, serverID) {
+		return
+	}
+
+	rules := []Rule{}
+	err = h.DB.Select(&rules, "SELECT "+ruleColumns+" FROM automod_rules WHERE server_id = $1 ORDER BY id", serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleUpdateRule replaces the fields present in the body; the rest of the
+// rule is kept as is.
+func (h *RuleHandler) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	rule, userID, ok := h.loadManagedRule(w, r)
+	if !ok {
+		return
+	}
+
+	// Decoding over the stored rule keeps the fields left out. The trigger
+	// can't change, since the config wouldn't fit.
+	trigger := rule.Trigger
+	if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if rule.Trigger != trigger {
+		http.Error(w, "trigger can't be changed", http.StatusBadRequest)
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.checkFlagChannels(w, rule) {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, updated Rule
+	err = tx.Get(&before, "SELECT "+ruleColumns+" FROM automod_rules WHERE id = $1 FOR UPDATE", rule.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rule", http.StatusInternalServerError)
+		return
+	}
+	err = tx.Get(&updated, `
+		UPDATE automod_rules SET
+			name = $2, config = $3, actions = $4, exempt_roles = $5, exempt_channels = $6,
+			enabled = $7, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+ruleColumns,
+		rule.ID, rule.Name, rule.Config, rule.Actions, rule.ExemptRoles, rule.ExemptChannels, rule.Enabled)
+	if err != nil {
+		log.Printf("Error updating automod rule: %v", err)
+		http.Error(w, "Failed to update rule", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, updated.ServerID, userID, auditlog.AutoModRuleUpdate, updated.ID, auditlog.Diff(before, updated))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Engine.Invalidate(int(updated.ServerID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *RuleHandler) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	rule, userID, ok := h.loadManagedRule(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM automod_rules WHERE id = $1", rule.ID); err != nil {
+		http.Error(w, "Failed to delete rule", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, rule.ServerID, userID, auditlog.AutoModRuleDelete, rule.ID, auditlog.Diff(*rule, nil))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Engine.Invalidate(int(rule.ServerID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
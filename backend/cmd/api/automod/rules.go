@@ -0,0 +1,314 @@
+package automod
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Trigger string
+
+const (
+	TriggerKeyword         Trigger = "keyword"
+	TriggerInvite          Trigger = "invite"
+	TriggerMentionSpam     Trigger = "mention_spam"
+	TriggerRepeatedMessage Trigger = "repeated_message"
+	TriggerCaps            Trigger = "caps"
+)
+
+type ActionType string
+
+const (
+	// ActionBlock keeps the message from being sent.
+	ActionBlock ActionType = "block"
+	// ActionFlag posts an alert to a moderators' channel.
+	ActionFlag ActionType = "flag"
+	// ActionTimeout times the author out.
+	ActionTimeout ActionType = "timeout"
+)
+
+const (
+	maxRulesPerServer  = 20
+	maxNameLength      = 100
+	maxKeywords        = 1000
+	maxKeywordLength   = 60
+	maxPatterns        = 10
+	maxPatternLength   = 260
+	maxAllowed         = 100
+	maxTimeoutSeconds  = 28 * 24 * 60 * 60
+	maxBlockMessage    = 150
+	defaultMaxMentions = 5
+	defaultMaxRepeats  = 3
+	defaultWindow      = 30
+	maxWindow          = 600
+	defaultCapsRatio   = 0.7
+	defaultCapsMinimum = 10
+)
+
+// Config holds the settings of a rule; which fields apply depends on its trigger.
+type Config struct {
+	// Keywords match whole words, case-insensitively. A leading or trailing
+	// "*" also matches inside words.
+	Keywords []string `json:"keywords,omitempty"`
+	// Patterns are regular expressions (RE2 syntax).
+	Patterns []string `json:"patterns,omitempty"`
+	// Allow lists matches that are fine: words for keyword rules, invite
+	// codes for invite rules.
+	Allow []string `json:"allow,omitempty"`
+	// MaxMentions is the most distinct mentions a message may have.
+	MaxMentions int `json:"max_mentions,omitempty"`
+	// MaxRepeats is how often the same message may be sent within WindowSeconds.
+	MaxRepeats    int `json:"max_repeats,omitempty"`
+	WindowSeconds int `json:"window_seconds,omitempty"`
+	// MaxCapsRatio is the highest share of capital letters in messages of at
+	// least MinLength letters.
+	MaxCapsRatio float64 `json:"max_caps_ratio,omitempty"`
+	MinLength    int     `json:"min_length,omitempty"`
+}
+
+func (c Config) Value() (driver.Value, error) {
+	return json.Marshal(c)
+}
+
+func (c *Config) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("config: expected []byte")
+	}
+	return json.Unmarshal(b, c)
+}
+
+type Action struct {
+	Type ActionType `json:"type"`
+	// ChannelID is where flag alerts are posted.
+	ChannelID int64 `json:"channel_id,omitempty"`
+	// DurationSeconds is how long a timeout lasts.
+	DurationSeconds int `json:"duration_seconds,omitempty"`
+	// Message is shown to the author of a blocked message.
+	Message string `json:"message,omitempty"`
+}
+
+// Actions is stored as a JSONB column.
+type Actions []Action
+
+func (a Actions) Value() (driver.Value, error) {
+	if a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(a)
+}
+
+func (a *Actions) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("actions: expected []byte")
+	}
+	return json.Unmarshal(b, a)
+}
+
+type Rule struct {
+	ID             int64          `db:"id" json:"id"`
+	ServerID       int64          `db:"server_id" json:"server_id"`
+	Name           string         `db:"name" json:"name"`
+	Trigger        Trigger        `db:"trigger" json:"trigger"`
+	Config         Config         `db:"config" json:"config"`
+	Actions        Actions        `db:"actions" json:"actions"`
+	ExemptRoles    pq.StringArray `db:"exempt_roles" json:"exempt_roles"`
+	ExemptChannels pq.Int64Array  `db:"exempt_channels" json:"exempt_channels"`
+	Enabled        bool           `db:"enabled" json:"enabled"`
+	CreatedBy      *int64         `db:"created_by" json:"created_by"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+const ruleColumns = "id, server_id, name, trigger, config, actions, exempt_roles, exempt_channels, enabled, created_by, created_at, updated_at"
+
+// Validate checks a rule and fills in defaults. It compiles the rule, so
+// invalid patterns are reported here rather than when messages are sent.
+func (r *Rule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" || len([]rune(r.Name)) > maxNameLength {
+		return errors.New("name must be between 1 and 100 characters")
+	}
+
+	c := &r.Config
+	switch r.Trigger {
+	case TriggerKeyword:
+		if len(c.Keywords) == 0 && len(c.Patterns) == 0 {
+			return errors.New("keyword rules need keywords or patterns")
+		}
+		if len(c.Keywords) > maxKeywords {
+			return fmt.Errorf("at most %d keywords are allowed", maxKeywords)
+		}
+		for _, k := range c.Keywords {
+			if strings.Trim(k, "* ") == "" || len([]rune(k)) > maxKeywordLength {
+				return fmt.Errorf("keywords must be between 1 and %d characters", maxKeywordLength)
+			}
+		}
+		if len(c.Patterns) > maxPatterns {
+			return fmt.Errorf("at most %d patterns are allowed", maxPatterns)
+		}
+		for _, p := range c.Patterns {
+			if len(p) > maxPatternLength {
+				return fmt.Errorf("patterns must be at most %d characters", maxPatternLength)
+			}
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", p, err)
+			}
+		}
+	case TriggerInvite:
+	case TriggerMentionSpam:
+		if c.MaxMentions == 0 {
+			c.MaxMentions = defaultMaxMentions
+		}
+		if c.MaxMentions < 1 || c.MaxMentions > 50 {
+			return errors.New("max_mentions must be between 1 and 50")
+		}
+	case TriggerRepeatedMessage:
+		if c.MaxRepeats == 0 {
+			c.MaxRepeats = defaultMaxRepeats
+		}
+		if c.WindowSeconds == 0 {
+			c.WindowSeconds = defaultWindow
+		}
+		if c.MaxRepeats < 2 || c.MaxRepeats > 20 {
+			return errors.New("max_repeats must be between 2 and 20")
+		}
+		if c.WindowSeconds < 1 || c.WindowSeconds > maxWindow {
+			return fmt.Errorf("window_seconds must be between 1 and %d", maxWindow)
+		}
+	case TriggerCaps:
+		if c.MaxCapsRatio == 0 {
+			c.MaxCapsRatio = defaultCapsRatio
+		}
+		if c.MinLength == 0 {
+			c.MinLength = defaultCapsMinimum
+		}
+		if c.MaxCapsRatio <= 0 || c.MaxCapsRatio >= 1 {
+			return errors.New("max_caps_ratio must be between 0 and 1")
+		}
+		if c.MinLength < 1 {
+			return errors.New("min_length must be positive")
+		}
+	default:
+		return errors.New("unknown trigger")
+	}
+	if len(c.Allow) > maxAllowed {
+		return fmt.Errorf("at most %d allowed entries are allowed", maxAllowed)
+	}
+
+	if len(r.Actions) == 0 {
+		return errors.New("at least one action is required")
+	}
+	seen := map[ActionType]bool{}
+	for i, a := range r.Actions {
+		if seen[a.Type] {
+			return fmt.Errorf("actions[%d]: duplicate action", i)
+		}
+		seen[a.Type] = true
+		switch a.Type {
+		case ActionBlock:
+			if len([]rune(a.Message)) > maxBlockMessage {
+				return fmt.Errorf("actions[%d].message must be at most %d characters", i, maxBlockMessage)
+			}
+		case ActionFlag:
+			if a.ChannelID == 0 {
+				return fmt.Errorf("actions[%d].channel_id is required", i)
+			}
+		case ActionTimeout:
+			if a.DurationSeconds < 1 || a.DurationSeconds > maxTimeoutSeconds {
+				return fmt.Errorf("actions[%d].duration_seconds must be between 1 and %d", i, maxTimeoutSeconds)
+			}
+		default:
+			return fmt.Errorf("actions[%d]: unknown action type", i)
+		}
+	}
+
+	if r.ExemptRoles == nil {
+		r.ExemptRoles = pq.StringArray{"owner", "admin"}
+	}
+	if r.ExemptChannels == nil {
+		r.ExemptChannels = pq.Int64Array{}
+	}
+
+	_, err := compile(*r)
+	return err
+}
+
+// FlagChannels returns the channels the rule posts alerts to.
+func (r *Rule) FlagChannels() []int64 {
+	var ids []int64
+	for _, a := range r.Actions {
+		if a.Type == ActionFlag {
+			ids = append(ids, a.ChannelID)
+		}
+	}
+	return ids
+}
+
+// compiledRule is a rule with its matchers built once.
+type compiledRule struct {
+	Rule
+	matcher        *regexp.Regexp
+	allow          map[string]bool
+	exemptRoles    map[string]bool
+	exemptChannels map[int64]bool
+}
+
+var (
+	invitePattern  = regexp.MustCompile(`(?i)(?:https?://)?(?:www\.)?(?:discord(?:app)?\.com/invite|discord\.gg|[\w.-]+/invite)/([a-z0-9-]+)`)
+	mentionPattern = regexp.MustCompile(`<@[!&]?\d+>|@everyone|@here`)
+)
+
+// keywordPattern turns a keyword into a regular expression matching whole
+// words, or word parts where it starts or ends with "*".
+func keywordPattern(keyword string) string {
+	prefix, suffix := `\b`, `\b`
+	if strings.HasPrefix(keyword, "*") {
+		prefix = `\w*`
+	}
+	if strings.HasSuffix(keyword, "*") {
+		suffix = `\w*`
+	}
+	return prefix + regexp.QuoteMeta(strings.Trim(keyword, "*")) + suffix
+}
+
+func compile(r Rule) (*compiledRule, error) {
+	c := &compiledRule{
+		Rule:           r,
+		allow:          make(map[string]bool),
+		exemptRoles:    make(map[string]bool),
+		exemptChannels: make(map[int64]bool),
+	}
+	for _, a := range r.Config.Allow {
+		c.allow[strings.ToLower(a)] = true
+	}
+	for _, role := range r.ExemptRoles {
+		c.exemptRoles[role] = true
+	}
+	for _, id := range r.ExemptChannels {
+		c.exemptChannels[id] = true
+	}
+
+	if r.Trigger == TriggerKeyword {
+		var parts []string
+		for _, k := range r.Config.Keywords {
+			parts = append(parts, keywordPattern(k))
+		}
+		for _, p := range r.Config.Patterns {
+			parts = append(parts, "(?:"+p+")")
+		}
+		matcher, err := regexp.Compile(`(?i)` + strings.Join(parts, "|"))
+		if err != nil {
+			return nil, err
+		}
+		c.matcher = matcher
+	}
+	return c, nil
+}
@@ -0,0 +1,243 @@
+package commands
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type OptionType string
+
+const (
+	OptionString  OptionType = "string"
+	OptionInteger OptionType = "integer"
+	OptionNumber  OptionType = "number"
+	OptionBoolean OptionType = "boolean"
+	OptionUser    OptionType = "user"
+	OptionChannel OptionType = "channel"
+)
+
+const (
+	maxOptions           = 25
+	maxDescriptionLength = 100
+	maxStringValueLength = 6000
+)
+
+// Command and option names follow the same rules: lowercase, no spaces.
+var namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+type Option struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Type        OptionType    `json:"type"`
+	Required    bool          `json:"required"`
+	Choices     []interface{} `json:"choices,omitempty"`
+}
+
+// Options is stored as a JSONB column.
+type Options []Option
+
+func (o Options) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(o)
+}
+
+func (o *Options) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("options: expected []byte")
+	}
+	return json.Unmarshal(b, o)
+}
+
+type Command struct {
+	ID          int64     `db:"id" json:"id"`
+	BotID       int64     `db:"bot_id" json:"bot_id"`
+	ServerID    *int64    `db:"server_id" json:"server_id"`
+	Name        string    `db:"name" json:"name"`
+	Description string    `db:"description" json:"description"`
+	Options     Options   `db:"options" json:"options"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Validate checks a command definition submitted by a bot.
+func (c *Command) Validate() error {
+	if !namePattern.MatchString(c.Name) {
+		return errors.New("name must be 1-32 lowercase letters, digits, '-' or '_'")
+	}
+	if len([]rune(c.Description)) > maxDescriptionLength {
+		return errors.New("description must be at most 100 characters")
+	}
+	if len(c.Options) > maxOptions {
+		return errors.New("a command can have at most 25 options")
+	}
+
+	seen := make(map[string]bool)
+	optionalSeen := false
+	for _, opt := range c.Options {
+		if !namePattern.MatchString(opt.Name) {
+			return fmt.Errorf("option %q: invalid name", opt.Name)
+		}
+		if seen[opt.Name] {
+			return fmt.Errorf("option %q: duplicate name", opt.Name)
+		}
+		seen[opt.Name] = true
+
+		switch opt.Type {
+		case OptionString, OptionInteger, OptionNumber, OptionBoolean, OptionUser, OptionChannel:
+		default:
+			return fmt.Errorf("option %q: unknown type %q", opt.Name, opt.Type)
+		}
+		if opt.Required && optionalSeen {
+			return fmt.Errorf("option %q: required options must come before optional ones", opt.Name)
+		}
+		if !opt.Required {
+			optionalSeen = true
+		}
+		for _, choice := range opt.Choices {
+			if _, err := coerce(opt.Type, choice); err != nil {
+				return fmt.Errorf("option %q: invalid choice: %w", opt.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveOptions checks the values a user supplied against the command's
+// options and converts them to their declared types.
+func (c *Command) ResolveOptions(values map[string]interface{}) (map[string]interface{}, error) {
+	declared := make(map[string]Option, len(c.Options))
+	for _, opt := range c.Options {
+		declared[opt.Name] = opt
+	}
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	resolved := make(map[string]interface{}, len(values))
+	for _, opt := range c.Options {
+		raw, ok := values[opt.Name]
+		if !ok || raw == nil {
+			if opt.Required {
+				return nil, fmt.Errorf("missing required option %q", opt.Name)
+			}
+			continue
+		}
+		value, err := coerce(opt.Type, raw)
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %w", opt.Name, err)
+		}
+		if len(opt.Choices) > 0 && !isChoice(opt, value) {
+			return nil, fmt.Errorf("option %q: value is not one of the allowed choices", opt.Name)
+		}
+		resolved[opt.Name] = value
+	}
+	return resolved, nil
+}
+
+// ErrUnknownReference is returned by CheckReferences when a user or channel
+// option points outside the server the command was invoked in.
+var ErrUnknownReference = errors.New("unknown reference")
+
+// CheckReferences makes sure resolved user options are members of the server
+// and channel options are channels of it, so bots are never handed IDs from
+// elsewhere.
+func (c *Command) CheckReferences(db sqlx.Queryer, resolved map[string]interface{}, serverID int) error {
+	for _, opt := range c.Options {
+		value, ok := resolved[opt.Name]
+		if !ok {
+			continue
+		}
+		var query, what string
+		switch opt.Type {
+		case OptionUser:
+			query = "SELECT EXISTS (SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = $2)"
+			what = "user is not a member of this server"
+		case OptionChannel:
+			query = "SELECT EXISTS (SELECT 1 FROM channels WHERE id = $1 AND server_id = $2)"
+			what = "channel is not in this server"
+		default:
+			continue
+		}
+		var exists bool
+		if err := sqlx.Get(db, &exists, query, value, serverID); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("option %q: %s: %w", opt.Name, what, ErrUnknownReference)
+		}
+	}
+	return nil
+}
+
+// coerce converts a JSON-decoded value to the Go type of the option.
+func coerce(t OptionType, raw interface{}) (interface{}, error) {
+	switch t {
+	case OptionString:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, errors.New("expected a string")
+		}
+		if len(s) > maxStringValueLength {
+			return nil, errors.New("string is too long")
+		}
+		return s, nil
+	case OptionBoolean:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, errors.New("expected a boolean")
+		}
+		return b, nil
+	case OptionNumber:
+		f, ok := raw.(float64)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New("expected a number")
+		}
+		return f, nil
+	case OptionInteger, OptionUser, OptionChannel:
+		f, ok := raw.(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return nil, errors.New("expected an integer")
+		}
+		return int64(f), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", t)
+}
+
+func isChoice(opt Option, value interface{}) bool {
+	for _, choice := range opt.Choices {
+		c, err := coerce(opt.Type, choice)
+		if err == nil && c == value {
+			return true
+		}
+	}
+	return false
+}
+
+// FindForServer loads a command that can be invoked in the server: either a
+// command registered for that server or a global one, from a bot that is a
+// member of the server.
+func FindForServer(db *sqlx.DB, commandID int64, serverID int) (*Command, error) {
+	var cmd Command
+	err := db.Get(&cmd, `
+		SELECT ac.id, ac.bot_id, ac.server_id, ac.name, ac.description, ac.options, ac.created_at, ac.updated_at
+		FROM application_commands ac
+		JOIN user_servers us ON us.user_id = ac.bot_id AND us.server_id = $2
+		WHERE ac.id = $1 AND (ac.server_id IS NULL OR ac.server_id = $2)
+	`, commandID, serverID)
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+)
+
+type CommandHandler struct {
+	DB *sqlx.DB
+}
+
+func (h *CommandHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/commands", h.handleUpsertCommand).Methods("POST")
+	router.HandleFunc("/commands", h.handleListBotCommands).Methods("GET")
+	router.HandleFunc("/commands/{command_id}", h.handleDeleteCommand).Methods("DELETE")
+	router.HandleFunc("/servers/{server_id}/commands", h.handleListServerCommands).Methods("GET")
+}
+
+// authenticateBot only lets bot tokens through.
+func authenticateBot(w http.ResponseWriter, r *http.Request) (int, bool) {
+	claims, err := auth.Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+	if !claims.IsBot {
+		http.Error(w, "Forbidden: only bots can manage commands", http.StatusForbidden)
+		return 0, false
+	}
+	return claims.UserID, true
+}
+
+// handleUpsertCommand registers a command, replacing any command of the same
+// name and scope. Commands without a server_id are global.
+func (h *CommandHandler) handleUpsertCommand(w http.ResponseWriter, r *http.Request) {
+	botID, ok := authenticateBot(w, r)
+	if !ok {
+		return
+	}
+
+	var request Command
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.ServerID != nil {
+		var member bool
+		err := h.DB.Get(&member, `
+			SELECT EXISTS (
+				SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = $2
+			)
+		`, botID, *request.ServerID)
+		if err != nil {
+			http.Error(w, "Failed to verify server membership", http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, "Forbidden: bot is not a member of this server", http.StatusForbidden)
+			return
+		}
+	}
+
+	var cmd Command
+	err := h.DB.Get(&cmd, `
+		INSERT INTO application_commands (bot_id, server_id, name, description, options)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (bot_id, (COALESCE(server_id, 0)), name) DO UPDATE SET
+			description = EXCLUDED.description,
+			options = EXCLUDED.options,
+			updated_at = NOW()
+		RETURNING id, bot_id, server_id, name, description, options, created_at, updated_at
+	`, botID, request.ServerID, request.Name, request.Description, request.Options)
+	if err != nil {
+		log.Printf("Error saving command: %v", err)
+		http.Error(w, "Failed to save command", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmd)
+}
+
+func (h *CommandHandler) handleListBotCommands(w http.ResponseWriter, r *http.Request) {
+	botID, ok := authenticateBot(w, r)
+	if !ok {
+		return
+	}
+
+	cmds := []Command{}
+	err := h.DB.Select(&cmds, `
+		SELECT id, bot_id, server_id, name, description, options, created_at, updated_at
+		FROM application_commands
+		WHERE bot_id = $1
+		ORDER BY name
+	`, botID)
+	if err != nil {
+		http.Error(w, "Failed to fetch commands", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmds)
+}
+
+func (h *CommandHandler) handleDeleteCommand(w http.ResponseWriter, r *http.Request) {
+	botID, ok := authenticateBot(w, r)
+	if !ok {
+		return
+	}
+
+	commandID, err := strconv.ParseInt(mux.Vars(r)["command_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid command_id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.DB.Exec("DELETE FROM application_commands WHERE id = $1 AND bot_id = $2", commandID, botID)
+	if err != nil {
+		http.Error(w, "Failed to delete command", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListServerCommands lists the commands members can invoke in a server.
+func (h *CommandHandler) handleListServerCommands(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	var member bool
+	err = h.DB.Get(&member, `
+		SELECT EXISTS (
+			SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = $2
+		)
+	`, userID, serverID)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !member {
+		http.Error(w, "Forbidden: You are not a member of this server", http.StatusForbidden)
+		return
+	}
+
+	cmds := []Command{}
+	err = h.DB.Select(&cmds, `
+		SELECT ac.id, ac.bot_id, ac.server_id, ac.name, ac.description, ac.options, ac.created_at, ac.updated_at
+		FROM application_commands ac
+		JOIN user_servers us ON us.user_id = ac.bot_id AND us.server_id = $1
+		WHERE ac.server_id IS NULL OR ac.server_id = $1
+		ORDER BY ac.name, ac.server_id NULLS LAST
+	`, serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch commands", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmds)
+}
@@ -0,0 +1,335 @@
+package eventhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/unfurl"
+	"github.com/mograby3500/mini-discord/websocket"
+)
+
+const (
+	// pollInterval is how often the dispatcher looks for due deliveries.
+	pollInterval = time.Second
+	// batchSize bounds the deliveries claimed per poll.
+	batchSize = 20
+	// deliveryWorkers bounds the attempts in flight, so a slow endpoint only
+	// holds up one worker.
+	deliveryWorkers = 10
+	// deliveryTimeout bounds a single attempt.
+	deliveryTimeout = 10 * time.Second
+	// claimLease keeps a claimed delivery from being picked up again while it
+	// is in flight. If the process dies, the delivery becomes due once it ends.
+	claimLease = time.Minute
+	// maxAttempts is how often a delivery is tried before it is marked failed.
+	maxAttempts = 10
+	// retryBaseDelay doubles after every failed attempt, up to retryMaxDelay.
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+	// disableAfter is the number of consecutive failed attempts after which a
+	// subscription is disabled.
+	disableAfter = 25
+	// maxErrorLength bounds the error text kept in the delivery log.
+	maxErrorLength = 500
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Events lists the server events a subscription can receive.
+var Events = []string{
+	websocket.EventMessageCreate,
+	websocket.EventMessageUpdate,
+	websocket.EventMessageDelete,
+	websocket.EventMemberJoin,
+	websocket.EventMemberLeave,
+	websocket.EventMemberUpdate,
+	websocket.EventChannelCreate,
+	websocket.EventChannelUpdate,
+	websocket.EventChannelDelete,
+}
+
+// Payload is the body POSTed to subscribers.
+type Payload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	ServerID  int         `json:"server_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher queues server events for subscribed endpoints and delivers them.
+// Deliveries are stored in event_deliveries as the event happens, so they
+// survive restarts.
+type Dispatcher struct {
+	DB *sqlx.DB
+	// Client sends the deliveries.
+	Client *http.Client
+
+	workers chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher whose client only connects to public
+// addresses and doesn't follow redirects, since subscription URLs come from
+// users.
+func NewDispatcher(db *sqlx.DB) *Dispatcher {
+	client := unfurl.NewClient(deliveryTimeout)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Dispatcher{
+		DB:      db,
+		Client:  client,
+		workers: make(chan struct{}, deliveryWorkers),
+	}
+}
+
+func newEventID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Enqueue queues a delivery of the event to every enabled subscription of the
+// server that wants it. It has the signature of a websocket.Listener, so the
+// deliveries are stored before the event is broadcast.
+func (d *Dispatcher) Enqueue(serverID int, eventType string, data interface{}) {
+	id, err := newEventID()
+	if err != nil {
+		log.Println("Event ID error:", err)
+		return
+	}
+	payload, err := json.Marshal(Payload{
+		ID:        id,
+		Type:      eventType,
+		ServerID:  serverID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		log.Println("Event encoding error:", err)
+		return
+	}
+
+	_, err = d.DB.Exec(`
+		INSERT INTO event_deliveries (subscription_id, event_type, payload)
+		SELECT id, $2::TEXT, $3::JSONB FROM event_subscriptions
+		WHERE server_id = $1 AND enabled AND $2::TEXT = ANY(events)
+	`, serverID, eventType, payload)
+	if err != nil {
+		log.Println("Failed to queue event deliveries:", err)
+	}
+}
+
+type dueDelivery struct {
+	ID             int64           `db:"id"`
+	SubscriptionID int64           `db:"subscription_id"`
+	EventType      string          `db:"event_type"`
+	Payload        json.RawMessage `db:"payload"`
+	Attempts       int             `db:"attempts"`
+	URL            string          `db:"url"`
+	Secret         string          `db:"secret"`
+}
+
+// Run delivers due events until the process exits.
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			more, err := d.deliverDue()
+			if err != nil {
+				log.Println("Event delivery error:", err)
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// deliverDue claims as many due deliveries as there are idle workers, up to
+// batchSize, and attempts them in the background. It reports whether it
+// claimed a full batch, in which case more may be due.
+func (d *Dispatcher) deliverDue() (bool, error) {
+	limit := min(cap(d.workers)-len(d.workers), batchSize)
+	if limit == 0 {
+		return false, nil
+	}
+	var due []dueDelivery
+	err := d.DB.Select(&due, `
+		UPDATE event_deliveries d
+		SET next_attempt_at = NOW() + $1::INT * INTERVAL '1 second'
+		FROM event_subscriptions s
+		WHERE s.id = d.subscription_id AND d.id IN (
+			SELECT dd.id FROM event_deliveries dd
+			JOIN event_subscriptions ss ON ss.id = dd.subscription_id
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= NOW() AND ss.enabled
+			ORDER BY dd.next_attempt_at
+			LIMIT $2
+			FOR UPDATE OF dd SKIP LOCKED
+		)
+		RETURNING d.id, d.subscription_id, d.event_type, d.payload, d.attempts, s.url, s.secret
+	`, int(claimLease.Seconds()), limit)
+	if err != nil {
+		return false, err
+	}
+
+	for _, delivery := range due {
+		d.workers <- struct{}{}
+		go func() {
+			defer func() { <-d.workers }()
+			status, err := d.post(delivery)
+			if err := d.record(delivery, status, err); err != nil {
+				log.Println("Failed to record event delivery:", err)
+			}
+		}()
+	}
+	return len(due) == limit, nil
+}
+
+// Sign returns the signature of a delivery: the hex HMAC-SHA256 of the
+// timestamp followed by the body, keyed by the subscription secret.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends one attempt and returns the response status, if any.
+func (d *Dispatcher) post(delivery dueDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mini-discord-webhooks/1.0")
+	req.Header.Set("X-Event-Type", delivery.EventType)
+	req.Header.Set("X-Delivery-ID", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature-SHA256", Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryDelay is the backoff after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// record stores the outcome of an attempt, schedules a retry if one is left
+// and disables the subscription once it has failed too often in a row.
+func (d *Dispatcher) record(delivery dueDelivery, responseStatus int, deliveryErr error) error {
+	attempts := delivery.Attempts + 1
+	var status *int
+	if responseStatus != 0 {
+		status = &responseStatus
+	}
+
+	tx, err := d.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if deliveryErr == nil {
+		_, err = tx.Exec(`
+			UPDATE event_deliveries
+			SET status = 'succeeded', attempts = $2, response_status = $3, last_error = '',
+				last_attempt_at = NOW(), delivered_at = NOW()
+			WHERE id = $1
+		`, delivery.ID, attempts, status)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE event_subscriptions SET consecutive_failures = 0 WHERE id = $1
+		`, delivery.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	message := deliveryErr.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength]
+	}
+	nextStatus := StatusPending
+	if attempts >= maxAttempts {
+		nextStatus = StatusFailed
+	}
+	_, err = tx.Exec(`
+		UPDATE event_deliveries
+		SET status = $2, attempts = $3, response_status = $4, last_error = $5,
+			last_attempt_at = NOW(), next_attempt_at = NOW() + $6::INT * INTERVAL '1 second'
+		WHERE id = $1
+	`, delivery.ID, nextStatus, attempts, status, message, int(retryDelay(attempts).Seconds()))
+	if err != nil {
+		return err
+	}
+
+	var enabled bool
+	err = tx.Get(&enabled, `
+		UPDATE event_subscriptions
+		SET consecutive_failures = consecutive_failures + 1,
+			enabled = enabled AND consecutive_failures + 1 < $2,
+			disabled_reason = CASE
+				WHEN enabled AND consecutive_failures + 1 >= $2 THEN $3
+				ELSE disabled_reason
+			END
+		WHERE id = $1
+		RETURNING enabled
+	`, delivery.SubscriptionID, disableAfter,
+		fmt.Sprintf("disabled after %d consecutive failed deliveries", disableAfter))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !enabled {
+		log.Printf("Event subscription %d is disabled: %v", delivery.SubscriptionID, deliveryErr)
+	}
+	return nil
+}
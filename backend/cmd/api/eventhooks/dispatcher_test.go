@@ -0,0 +1,189 @@
+package eventhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/unfurl"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000" + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := Sign("secret", "1700000000", body); got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+	if Sign("other", "1700000000", body) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if Sign("secret", "1700000001", body) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+// receiver is an endpoint that checks signatures like a subscriber would.
+func receiver(t *testing.T, secret string, status int) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	received := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := Sign(secret, r.Header.Get("X-Signature-Timestamp"), body)
+		if !hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Signature-SHA256"))) {
+			t.Error("receiver got a bad signature")
+		}
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("receiver got an invalid body: %v", err)
+		}
+		received <- r
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func testDelivery(url string) dueDelivery {
+	return dueDelivery{
+		ID:             42,
+		SubscriptionID: 7,
+		EventType:      "MESSAGE_CREATE",
+		Payload:        json.RawMessage(`{"id":"abc","type":"MESSAGE_CREATE","server_id":1,"data":{}}`),
+		URL:            url,
+		Secret:         "s3cret",
+	}
+}
+
+func TestPostDelivers(t *testing.T) {
+	srv, received := receiver(t, "s3cret", http.StatusNoContent)
+	d := &Dispatcher{Client: srv.Client()}
+
+	status, err := d.post(testDelivery(srv.URL))
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("post() = %d, %v", status, err)
+	}
+	r := <-received
+	if got := r.Header.Get("X-Event-Type"); got != "MESSAGE_CREATE" {
+		t.Errorf("X-Event-Type = %q", got)
+	}
+	if got := r.Header.Get("X-Delivery-ID"); got != "42" {
+		t.Errorf("X-Delivery-ID = %q", got)
+	}
+}
+
+func TestPostFailsOnErrorStatus(t *testing.T) {
+	srv, _ := receiver(t, "s3cret", http.StatusInternalServerError)
+	d := &Dispatcher{Client: srv.Client()}
+
+	status, err := d.post(testDelivery(srv.URL))
+	if err == nil || status != http.StatusInternalServerError {
+		t.Errorf("post() = %d, %v; want a failed attempt with status 500", status, err)
+	}
+}
+
+func TestPostBlocksPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback address")
+	}))
+	defer srv.Close()
+	d := NewDispatcher(nil)
+
+	_, err := d.post(testDelivery(srv.URL))
+	if !errors.Is(err, unfurl.ErrBlockedAddress) {
+		t.Errorf("post() error = %v, want %v", err, unfurl.ErrBlockedAddress)
+	}
+}
+
+func TestPostDoesNotFollowRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/", http.StatusFound))
+	defer srv.Close()
+	d := NewDispatcher(nil)
+	d.Client.Transport = srv.Client().Transport
+
+	status, err := d.post(testDelivery(srv.URL))
+	if err == nil || status != http.StatusFound {
+		t.Errorf("post() = %d, %v; want a failed attempt with status 302", status, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{maxAttempts, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestEnqueueStoresDeliveries(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var serverID int
+	if err := db.Get(&serverID, "INSERT INTO servers (name) VALUES ('eventhooks test') RETURNING id"); err != nil {
+		t.Fatalf("create server: %v", err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM servers WHERE id = $1", serverID) })
+	var wanted, other int
+	err = db.Get(&wanted, `
+		INSERT INTO event_subscriptions (server_id, url, secret, events)
+		VALUES ($1, 'https://example.com/a', 's', '{MESSAGE_CREATE}') RETURNING id
+	`, serverID)
+	if err != nil {
+		t.Fatalf("create subscription: %v", err)
+	}
+	err = db.Get(&other, `
+		INSERT INTO event_subscriptions (server_id, url, secret, events)
+		VALUES ($1, 'https://example.com/b', 's', '{MEMBER_JOIN}') RETURNING id
+	`, serverID)
+	if err != nil {
+		t.Fatalf("create subscription: %v", err)
+	}
+
+	// Enqueue returns once the deliveries are stored; there is nothing to
+	// wait for.
+	NewDispatcher(db).Enqueue(serverID, "MESSAGE_CREATE", map[string]int{"n": 1})
+
+	var subscriptions []int
+	err = db.Select(&subscriptions, `
+		SELECT d.subscription_id FROM event_deliveries d
+		JOIN event_subscriptions s ON s.id = d.subscription_id
+		WHERE s.server_id = $1 AND d.status = 'pending'
+	`, serverID)
+	if err != nil {
+		t.Fatalf("select deliveries: %v", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0] != wanted {
+		t.Errorf("deliveries for subscriptions %v, want [%d]", subscriptions, wanted)
+	}
+}
@@ -0,0 +1,463 @@
+package eventhooks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/permissions"
+)
+
+const (
+	maxSubscriptionsPerServer = 10
+	defaultDeliveryPageSize   = 50
+	maxDeliveryPageSize       = 100
+)
+
+type SubscriptionHandler struct {
+	DB *sqlx.DB
+}
+
+type Subscription struct {
+	ID                  int64          `db:"id" json:"id"`
+	ServerID            int64          `db:"server_id" json:"server_id"`
+	URL                 string         `db:"url" json:"url"`
+	Events              pq.StringArray `db:"events" json:"events"`
+	Enabled             bool           `db:"enabled" json:"enabled"`
+	ConsecutiveFailures int            `db:"consecutive_failures" json:"consecutive_failures"`
+	DisabledReason      string         `db:"disabled_reason" json:"disabled_reason,omitempty"`
+	CreatedBy           *int64         `db:"created_by" json:"created_by"`
+	CreatedAt           time.Time      `db:"created_at" json:"created_at"`
+}
+
+const subscriptionColumns = "id, server_id, url, events, enabled, consecutive_failures, disabled_reason, created_by, created_at"
+
+type Delivery struct {
+	ID             int64           `db:"id" json:"id"`
+	EventType      string          `db:"event_type" json:"event_type"`
+	Payload        json.RawMessage `db:"payload" json:"payload"`
+	Status         string          `db:"status" json:"status"`
+	Attempts       int             `db:"attempts" json:"attempts"`
+	NextAttemptAt  *time.Time      `db:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time      `db:"last_attempt_at" json:"last_attempt_at"`
+	ResponseStatus *int            `db:"response_status" json:"response_status"`
+	LastError      string          `db:"last_error" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `db:"delivered_at" json:"delivered_at"`
+	CreatedAt      time.Time       `db:"created_at" json:"created_at"`
+}
+
+func (h *SubscriptionHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/servers/{server_id}/event-subscriptions", h.handleCreateSubscription).Methods("POST")
+	router.HandleFunc("/servers/{server_id}/event-subscriptions", h.handleListSubscriptions).Methods("GET")
+	router.HandleFunc("/event-subscriptions/{subscription_id}", h.handleUpdateSubscription).Methods("PATCH")
+	router.HandleFunc("/event-subscriptions/{subscription_id}", h.handleDeleteSubscription).Methods("DELETE")
+	router.HandleFunc("/event-subscriptions/{subscription_id}/secret", h.handleRotateSecret).Methods("POST")
+	router.HandleFunc("/event-subscriptions/{subscription_id}/deliveries", h.handleListDeliveries).Methods("GET")
+	router.HandleFunc("/event-subscriptions/{subscription_id}/deliveries/{delivery_id}/retry", h.handleRetryDelivery).Methods("POST")
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// requireManageWebhooks checks that the user may manage the server's webhooks.
+func (h *SubscriptionHandler) requireManageWebhooks(w http.ResponseWriter, userID float64, serverID int64) bool {
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageWebhooks)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage webhooks permission", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// loadManagedSubscription loads the subscription named in the route if the
+// user may manage it.
+func (h *SubscriptionHandler) loadManagedSubscription(w http.ResponseWriter, r *http.Request) (*Subscription, int64, bool) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, 0, false
+	}
+	subscriptionID, err := strconv.ParseInt(mux.Vars(r)["subscription_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription_id", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	var sub Subscription
+	err = h.DB.Get(&sub, "SELECT "+subscriptionColumns+" FROM event_subscriptions WHERE id = $1", subscriptionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return nil, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch subscription", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if !h.requireManageWebhooks(w, userID, sub.ServerID) {
+		return nil, 0, false
+	}
+	return &sub, int64(userID), true
+}
+
+type SubscriptionRequest struct {
+	URL     *string        `json:"url"`
+	Events  pq.StringArray `json:"events"`
+	Enabled *bool          `json:"enabled"`
+}
+
+func (r *SubscriptionRequest) validate() error {
+	if r.URL != nil {
+		u, err := url.Parse(*r.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("url must be an https URL")
+		}
+	}
+	if r.Events != nil {
+		if len(r.Events) == 0 {
+			return errors.New("events must not be empty")
+		}
+		for _, event := range r.Events {
+			if !slices.Contains(Events, event) {
+				return errors.New("unknown event: " + event)
+			}
+		}
+	}
+	return nil
+}
+
+// handleCreateSubscription subscribes an HTTPS endpoint to server events. The
+// signing secret is returned once; it can be rotated later.
+func (h *SubscriptionHandler) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	var request SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.URL == nil || request.Events == nil {
+		http.Error(w, "url and events are required", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.requireManageWebhooks(w, userID, serverID) {
+		return
+	}
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM event_subscriptions WHERE server_id = $1", serverID); err != nil {
+		http.Error(w, "Failed to count subscriptions", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxSubscriptionsPerServer {
+		http.Error(w, "Too many event subscriptions for this server", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sub Subscription
+	err = tx.Get(&sub, `
+		INSERT INTO event_subscriptions (server_id, url, secret, events, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+subscriptionColumns,
+		serverID, *request.URL, secret, request.Events, int64(userID))
+	if err != nil {
+		log.Printf("Error creating event subscription: %v", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.EventSubscriptionCreate, sub.ID, auditlog.Diff(nil, sub))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subscription": sub,
+		"secret":       secret,
+	})
+}
+
+func (h *SubscriptionHandler) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	if !h.requireManageWebhooks(w, userID, serverID) {
+		return
+	}
+
+	subs := []Subscription{}
+	err = h.DB.Select(&subs, `
+		SELECT `+subscriptionColumns+` FROM event_subscriptions
+		WHERE server_id = $1
+		ORDER BY id
+	`, serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+// handleUpdateSubscription changes the URL or events of a subscription, or
+// enables and disables it. Re-enabling resumes its pending deliveries.
+func (h *SubscriptionHandler) handleUpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, userID, ok := h.loadManagedSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	var request SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var updated Subscription
+	err = tx.Get(&updated, `
+		UPDATE event_subscriptions SET
+			url = COALESCE($2, url),
+			events = COALESCE($3, events),
+			enabled = COALESCE($4, enabled),
+			consecutive_failures = CASE WHEN $4 THEN 0 ELSE consecutive_failures END,
+			disabled_reason = CASE WHEN $4 IS NULL THEN disabled_reason ELSE '' END
+		WHERE id = $1
+		RETURNING `+subscriptionColumns,
+		sub.ID, request.URL, request.Events, request.Enabled)
+	if err != nil {
+		log.Printf("Error updating event subscription: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, sub.ServerID, userID, auditlog.EventSubscriptionUpdate, sub.ID, auditlog.Diff(*sub, updated))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *SubscriptionHandler) handleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, userID, ok := h.loadManagedSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM event_subscriptions WHERE id = $1", sub.ID); err != nil {
+		http.Error(w, "Failed to delete subscription", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, sub.ServerID, userID, auditlog.EventSubscriptionDelete, sub.ID, auditlog.Diff(*sub, nil))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRotateSecret replaces the signing secret. Deliveries still queued are
+// signed with the new one. The rotation is audited without the secret.
+func (h *SubscriptionHandler) handleRotateSecret(w http.ResponseWriter, r *http.Request) {
+	sub, userID, ok := h.loadManagedSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE event_subscriptions SET secret = $2 WHERE id = $1", sub.ID, secret); err != nil {
+		http.Error(w, "Failed to rotate secret", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, sub.ServerID, userID, auditlog.EventSubscriptionSecretRotate, sub.ID, nil)
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
+
+// handleListDeliveries returns the delivery log of a subscription, newest
+// first. It can be filtered by status and paged with before.
+func (h *SubscriptionHandler) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	sub, _, ok := h.loadManagedSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != StatusPending && status != StatusSucceeded && status != StatusFailed {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	limit := int64(defaultDeliveryPageSize)
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 && l <= maxDeliveryPageSize {
+		limit = l
+	}
+	var before *int64
+	if raw := query.Get("before"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'before' ID", http.StatusBadRequest)
+			return
+		}
+		before = &id
+	}
+
+	deliveries := []Delivery{}
+	err := h.DB.Select(&deliveries, `
+		SELECT id, event_type, payload, status, attempts,
+			CASE WHEN status = 'pending' THEN next_attempt_at END AS next_attempt_at,
+			last_attempt_at, response_status, last_error, delivered_at, created_at
+		FROM event_deliveries
+		WHERE subscription_id = $1
+			AND ($2::TEXT = '' OR status = $2::TEXT)
+			AND ($3::BIGINT IS NULL OR id < $3)
+		ORDER BY id DESC
+		LIMIT $4
+	`, sub.ID, status, before, limit)
+	if err != nil {
+		log.Printf("Error fetching event deliveries: %v", err)
+		http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// handleRetryDelivery queues a failed delivery again with a fresh set of attempts.
+func (h *SubscriptionHandler) handleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	sub, _, ok := h.loadManagedSubscription(w, r)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery_id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.DB.Exec(`
+		UPDATE event_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND subscription_id = $2 AND status = 'failed'
+	`, deliveryID, sub.ID)
+	if err != nil {
+		http.Error(w, "Failed to retry delivery", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Failed delivery not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -9,9 +9,19 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
 	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/cmd/api/automod"
+	"github.com/mograby3500/mini-discord/cmd/api/commands"
+	"github.com/mograby3500/mini-discord/cmd/api/eventhooks"
+	"github.com/mograby3500/mini-discord/cmd/api/media"
 	"github.com/mograby3500/mini-discord/cmd/api/servers"
+	"github.com/mograby3500/mini-discord/cmd/api/users"
+	"github.com/mograby3500/mini-discord/cmd/api/webhooks"
 	"github.com/mograby3500/mini-discord/db"
+	"github.com/mograby3500/mini-discord/mailer"
+	"github.com/mograby3500/mini-discord/storage"
+	"github.com/mograby3500/mini-discord/unfurl"
 	"github.com/mograby3500/mini-discord/websocket"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -38,21 +48,65 @@ func (a *App) Initialize() error {
 
 	a.Hub = websocket.NewHub()
 	a.Router = mux.NewRouter()
+	a.Router.Use(newRateLimiter().Middleware)
 
-	authHandler := &auth.Handler{DB: pgDB}
+	mail, err := mailer.New()
+	if err != nil {
+		return fmt.Errorf("mailer setup failed: %w", err)
+	}
+
+	auth.Init(pgDB)
+	authHandler := &auth.Handler{DB: pgDB, Gateway: a.Hub, Mailer: mail}
 	authHandler.RegisterRoutes(a.Router)
 
-	serverHandler := &servers.ServerHandler{DB: pgDB, MongoDB: mongoClient}
+	fileStorage := storage.New()
+	mediaHandler := &media.Handler{Storage: fileStorage}
+	mediaHandler.RegisterRoutes(a.Router)
+
+	serverHandler := &servers.ServerHandler{DB: pgDB, MongoDB: mongoClient, Hub: a.Hub, Storage: fileStorage}
 	serverHandler.RegisterRoutes(a.Router)
 
-	websocketHandler := &websocket.WebsocketHandler{MongoDB: mongoClient, Hub: a.Hub}
+	userHandler := &users.UserHandler{DB: pgDB, MongoDB: mongoClient, Hub: a.Hub, Storage: fileStorage}
+	userHandler.RegisterRoutes(a.Router)
+
+	auditLogHandler := &auditlog.Handler{DB: pgDB}
+	auditLogHandler.RegisterRoutes(a.Router)
+
+	commandHandler := &commands.CommandHandler{DB: pgDB}
+	commandHandler.RegisterRoutes(a.Router)
+
+	automodEngine := automod.NewEngine(pgDB)
+	ruleHandler := &automod.RuleHandler{DB: pgDB, Engine: automodEngine}
+	ruleHandler.RegisterRoutes(a.Router)
+
+	websocketHandler := &websocket.WebsocketHandler{MongoDB: mongoClient, DB: pgDB, Hub: a.Hub, AutoMod: automodEngine}
 	websocketHandler.RegisterRoutes(a.Router)
+	serverHandler.Moderator = websocketHandler
+
+	webhookHandler := &webhooks.WebhookHandler{DB: pgDB, MongoDB: mongoClient, Hub: a.Hub}
+	webhookHandler.RegisterRoutes(a.Router)
+
+	subscriptionHandler := &eventhooks.SubscriptionHandler{DB: pgDB}
+	subscriptionHandler.RegisterRoutes(a.Router)
+
+	dispatcher := eventhooks.NewDispatcher(pgDB)
+	a.Hub.Listen(dispatcher.Enqueue)
+
+	linkPreviewer := &websocket.LinkPreviewer{DB: pgDB, MongoDB: mongoClient, Hub: a.Hub, Fetcher: unfurl.New()}
+	a.Hub.Listen(linkPreviewer.Listen)
 
 	a.Router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}).Methods("GET")
 
 	go a.Hub.Run(pgDB)
+	go dispatcher.Run()
+	go serverHandler.ExpireTimeouts()
+	go serverHandler.PurgeDeletedServers()
+	go serverHandler.RefreshDiscoveryActivity()
+	go serverHandler.ProcessCrossposts()
+	go userHandler.ProcessExports()
+	go userHandler.DeleteScheduledAccounts()
 	return nil
 }
 
@@ -61,9 +115,10 @@ func corsMiddleware(next http.Handler) http.Handler {
 		origin := r.Header.Get("Origin")
 		if origin == "http://localhost:3000" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-MFA-Code, X-Audit-Log-Reason")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-RateLimit-Reset-After, X-RateLimit-Bucket, Content-Disposition")
 		}
 
 		if r.Method == http.MethodOptions {
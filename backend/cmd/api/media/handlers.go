@@ -0,0 +1,49 @@
+package media
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/images"
+	"github.com/mograby3500/mini-discord/storage"
+)
+
+// Handler serves uploaded images. They are public, like the URLs they are
+// linked from, and never change, so clients and proxies may cache them for
+// good.
+type Handler struct {
+	Storage storage.Storage
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/media/{key}/{name}", h.handleGetImage).Methods("GET", "HEAD")
+}
+
+func (h *Handler) handleGetImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key, name := vars["key"], vars["name"]
+	// Storage also holds private files, such as data exports.
+	if !images.ValidName(name) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	object, err := h.Storage.Open(key, name)
+	if err == storage.ErrNotFound {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error opening image %s/%s: %v", key, name, err)
+		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	// The key is a hash of the content, so it makes a strong ETag that
+	// ServeContent checks If-None-Match against.
+	w.Header().Set("ETag", `"`+key+"-"+name+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", images.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, object.ModTime(), object)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/ratelimit"
+)
+
+var (
+	// globalRateLimit applies to each client across all routes.
+	globalRateLimit = ratelimit.Rule{Limit: 100, Period: 10 * time.Second}
+	// defaultRateLimit applies per client to each route without its own rule.
+	defaultRateLimit = ratelimit.Rule{Limit: 30, Period: 10 * time.Second}
+)
+
+// routeRateLimits are per client and route. Unauthenticated routes are keyed
+// by IP, so they are strict.
+var routeRateLimits = map[string]ratelimit.Rule{
+	"POST /signup":               {Limit: 3, Period: time.Hour},
+	"POST /login":                {Limit: 10, Period: time.Minute},
+	"POST /login/mfa":            {Limit: 10, Period: time.Minute},
+	"POST /token/refresh":        {Limit: 10, Period: time.Minute},
+	"POST /verify-email/resend":  {Limit: 3, Period: 10 * time.Minute},
+	"POST /password/forgot":      {Limit: 3, Period: 10 * time.Minute},
+	"POST /password/reset":       {Limit: 5, Period: 10 * time.Minute},
+	"POST /servers":              {Limit: 10, Period: time.Hour},
+	"POST /bots":                 {Limit: 5, Period: time.Hour},
+	"GET /ws":                    {Limit: 10, Period: time.Minute},
+	"GET /messages/{channel_id}": {Limit: 20, Period: 5 * time.Second},
+	// Executions are limited per webhook as well.
+	"POST /webhooks/{webhook_id}/{token}": {Limit: 30, Period: 10 * time.Second},
+	// Every upload is decoded and re-encoded in several sizes.
+	"PUT /users/@me/avatar":         {Limit: 5, Period: 10 * time.Minute},
+	"PUT /servers/{server_id}/icon": {Limit: 5, Period: 10 * time.Minute},
+}
+
+func newRateLimiter() *ratelimit.HTTP {
+	return ratelimit.NewHTTP(auth.RateLimitKey, globalRateLimit, defaultRateLimit, routeRateLimits)
+}
@@ -0,0 +1,287 @@
+package servers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Crosspost job actions, applied to the copies of an announcement.
+const (
+	crosspostCreate = "create"
+	crosspostUpdate = "update"
+	crosspostDelete = "delete"
+)
+
+const (
+	// crosspostInterval is how often due crosspost jobs are looked for.
+	crosspostInterval = 2 * time.Second
+	// maxCrosspostAttempts is how often a failing job is tried before it is
+	// dropped.
+	maxCrosspostAttempts = 5
+)
+
+type crosspostJob struct {
+	ID        int64  `db:"id"`
+	MessageID string `db:"message_id"`
+	ChannelID int64  `db:"channel_id"`
+	Action    string `db:"action"`
+	Attempts  int    `db:"attempts"`
+}
+
+// enqueueCrosspost queues an action on the copies of an announcement.
+func enqueueCrosspost(db sqlx.Execer, messageID string, channelID int64, action string) error {
+	_, err := db.Exec(`
+		INSERT INTO crosspost_jobs (message_id, channel_id, action) VALUES ($1, $2, $3)
+	`, messageID, channelID, action)
+	return err
+}
+
+// ProcessCrossposts copies published announcements into the channels
+// following them, and passes edits and deletions on to the copies. Jobs are
+// run in the order they were queued; each job reads the announcement as it is
+// when it runs, so a retried job can't bring back stale content.
+func (h *ServerHandler) ProcessCrossposts() {
+	ticker := time.NewTicker(crosspostInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			ran, err := h.runCrosspostJob()
+			if err != nil {
+				log.Println("Crosspost error:", err)
+				break
+			}
+			if !ran {
+				break
+			}
+		}
+	}
+}
+
+// runCrosspostJob claims the next due job and runs it. It reports false when
+// no job was due.
+func (h *ServerHandler) runCrosspostJob() (bool, error) {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var job crosspostJob
+	err = tx.Get(&job, `
+		SELECT id, message_id, channel_id, action, attempts FROM crosspost_jobs
+		WHERE run_after <= NOW()
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := h.crosspost(job); err != nil {
+		log.Printf("Error running %s crosspost of message %s (attempt %d): %v", job.Action, job.MessageID, job.Attempts+1, err)
+		if job.Attempts+1 < maxCrosspostAttempts {
+			_, err = tx.Exec(`
+				UPDATE crosspost_jobs
+				SET attempts = attempts + 1, run_after = NOW() + $2::INT * INTERVAL '1 second'
+				WHERE id = $1
+			`, job.ID, 10<<job.Attempts)
+			if err != nil {
+				return false, err
+			}
+			return true, tx.Commit()
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM crosspost_jobs WHERE id = $1", job.ID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (h *ServerHandler) crosspost(job crosspostJob) error {
+	switch job.Action {
+	case crosspostCreate:
+		return h.createCopies(job)
+	case crosspostUpdate:
+		return h.updateCopies(job)
+	case crosspostDelete:
+		return h.deleteCopies(job)
+	}
+	return fmt.Errorf("unknown action %q", job.Action)
+}
+
+// announcement reads the message a job is about. It returns nil once the
+// message is gone.
+func (h *ServerHandler) announcement(messageID string) (*websocket.Message, error) {
+	oid, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, err
+	}
+	var message websocket.Message
+	err = h.messages().FindOne(context.Background(), bson.M{"_id": oid}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return &message, err
+}
+
+// createCopies posts a copy of the announcement in every channel following
+// its channel, attributed to the source server and channel. Channels that
+// already have a copy, e.g. from an earlier attempt, are skipped.
+func (h *ServerHandler) createCopies(job crosspostJob) error {
+	source, err := h.announcement(job.MessageID)
+	if err != nil || source == nil || source.PublishedAt == nil {
+		return err
+	}
+	var origin struct {
+		ChannelName string `db:"channel_name"`
+		ServerID    int    `db:"server_id"`
+		ServerName  string `db:"server_name"`
+		IconURL     string `db:"icon_url"`
+	}
+	err = h.DB.Get(&origin, `
+		SELECT c.name AS channel_name, s.id AS server_id, s.name AS server_name, s.icon_url
+		FROM channels c
+		JOIN servers s ON s.id = c.server_id
+		WHERE c.id = $1
+	`, job.ChannelID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var followers []struct {
+		ChannelID int `db:"channel_id"`
+		ServerID  int `db:"server_id"`
+	}
+	err = h.DB.Select(&followers, `
+		SELECT f.target_channel_id AS channel_id, c.server_id
+		FROM channel_follows f
+		JOIN channels c ON c.id = f.target_channel_id
+		WHERE f.source_channel_id = $1
+		ORDER BY f.id
+	`, job.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	for _, follower := range followers {
+		n, err := h.messages().CountDocuments(context.Background(), bson.M{
+			"channel_id":           follower.ChannelID,
+			"crosspost.message_id": job.MessageID,
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		copied := websocket.Message{
+			ChannelID: follower.ChannelID,
+			ServerId:  follower.ServerID,
+			Content:   source.Content,
+			Type:      "crosspost",
+			CreatedAt: time.Now(),
+			UserName:  fmt.Sprintf("%s #%s", origin.ServerName, origin.ChannelName),
+			AvatarURL: origin.IconURL,
+			Embeds:    source.Embeds,
+			Crosspost: &websocket.Crosspost{
+				MessageID:   job.MessageID,
+				ChannelID:   int(job.ChannelID),
+				ServerID:    origin.ServerID,
+				ChannelName: origin.ChannelName,
+				ServerName:  origin.ServerName,
+			},
+		}
+		if err := websocket.Publish(h.MongoDB, h.Hub, &copied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRef is where a copy of an announcement is.
+type copyRef struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	ChannelID int                `bson:"channel_id"`
+	ServerID  int                `bson:"server_id"`
+}
+
+func (h *ServerHandler) findCopies(messageID string) ([]copyRef, error) {
+	cursor, err := h.messages().Find(context.Background(),
+		bson.M{"crosspost.message_id": messageID},
+		options.Find().SetProjection(bson.M{"_id": 1, "channel_id": 1, "server_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var copies []copyRef
+	err = cursor.All(context.Background(), &copies)
+	return copies, err
+}
+
+// updateCopies gives the copies of an announcement its current content.
+func (h *ServerHandler) updateCopies(job crosspostJob) error {
+	source, err := h.announcement(job.MessageID)
+	if err != nil || source == nil {
+		// A deleted announcement has a delete job queued after this one.
+		return err
+	}
+	copies, err := h.findCopies(job.MessageID)
+	if err != nil || len(copies) == 0 {
+		return err
+	}
+	editedAt := time.Now()
+	if source.EditedAt != nil {
+		editedAt = *source.EditedAt
+	}
+	_, err = h.messages().UpdateMany(context.Background(),
+		bson.M{"crosspost.message_id": job.MessageID},
+		bson.M{"$set": bson.M{"content": source.Content, "plain_text": source.PlainText, "edited_at": editedAt}},
+	)
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		h.Hub.Broadcast(c.ServerID, websocket.EventMessageUpdate, map[string]interface{}{
+			"id":         c.ID.Hex(),
+			"channel_id": c.ChannelID,
+			"server_id":  c.ServerID,
+			"content":    source.Content,
+			"edited_at":  editedAt,
+		})
+	}
+	return nil
+}
+
+// deleteCopies deletes the copies of a deleted announcement.
+func (h *ServerHandler) deleteCopies(job crosspostJob) error {
+	copies, err := h.findCopies(job.MessageID)
+	if err != nil || len(copies) == 0 {
+		return err
+	}
+	_, err = h.messages().DeleteMany(context.Background(), bson.M{"crosspost.message_id": job.MessageID})
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		h.Hub.Broadcast(c.ServerID, websocket.EventMessageDelete, map[string]interface{}{
+			"id":         c.ID.Hex(),
+			"channel_id": c.ChannelID,
+			"server_id":  c.ServerID,
+		})
+	}
+	return nil
+}
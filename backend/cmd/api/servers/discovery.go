@@ -0,0 +1,324 @@
+package servers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/discovery"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// defaultDiscoveryPageSize is how many servers a page has unless asked
+	// otherwise.
+	defaultDiscoveryPageSize = 24
+	// activityInterval is how often the weekly message counts of public
+	// servers are refreshed.
+	activityInterval = 10 * time.Minute
+	// maxDelistReasonLength bounds the reason shown to the owner.
+	maxDelistReasonLength = 512
+)
+
+// handleDiscoverServers lists public servers, most members or most active
+// first. Servers can be searched by name or tag and filtered by tag and
+// language; pages are selected with offset and limit.
+func (h *ServerHandler) handleDiscoverServers(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	query := discovery.Query{
+		Search:   params.Get("query"),
+		Tag:      params.Get("tag"),
+		Language: params.Get("language"),
+		Sort:     params.Get("sort"),
+		Limit:    defaultDiscoveryPageSize,
+	}
+	if raw := params.Get("offset"); raw != "" {
+		if query.Offset, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := params.Get("limit"); raw != "" {
+		if query.Limit, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := query.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := discovery.List(h.DB, int64(userID), query)
+	if err != nil {
+		log.Printf("Error listing public servers: %v", err)
+		http.Error(w, "Failed to fetch servers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleJoinServer makes the user a member of a public server. Private and
+// delisted servers are reported as not found. Bots are added by their owners
+// instead.
+func (h *ServerHandler) handleJoinServer(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	var isBot bool
+	if err := h.DB.Get(&isBot, "SELECT is_bot FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if isBot {
+		http.Error(w, "Forbidden: bots are added to servers by their owner", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var server Server
+	err = tx.Get(&server, "SELECT "+serverColumns+" FROM servers WHERE id = $1 FOR SHARE", serverID)
+	if err == sql.ErrNoRows || (err == nil && (!server.Public || server.DelistedAt != nil)) {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO user_servers (user_id, server_id, role) VALUES ($1, $2, 'member')
+		ON CONFLICT (user_id, server_id) DO NOTHING
+	`, userID, serverID)
+	if err != nil {
+		http.Error(w, "Failed to join server", http.StatusInternalServerError)
+		return
+	}
+	joined, _ := res.RowsAffected()
+
+	channels := []Channel{}
+	err = tx.Select(&channels, "SELECT "+channelColumns+" FROM channels WHERE server_id = $1 ORDER BY id", serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch channels", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if joined > 0 {
+		channelIDs := make([]int, len(channels))
+		for i, channel := range channels {
+			channelIDs[i] = int(channel.ID)
+		}
+		h.Hub.AddMember(int(userID), int(serverID), channelIDs)
+		h.Hub.Broadcast(int(serverID), websocket.EventMemberJoin, map[string]interface{}{
+			"server_id": serverID,
+			"user_id":   int64(userID),
+			"role":      "member",
+			"bot":       false,
+		})
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ServerWithChannels{ID: server.ID, Name: server.Name, Channels: channels})
+}
+
+// requireStaff checks that the user moderates discovery.
+func (h *ServerHandler) requireStaff(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+	var isStaff bool
+	if err := h.DB.Get(&isStaff, "SELECT is_staff FROM users WHERE id = $1", userID); err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !isStaff {
+		http.Error(w, "Forbidden: only staff can do this", http.StatusForbidden)
+		return 0, false
+	}
+	if auth.WriteMFAError(w, auth.RequireMFA(r, int(userID))) {
+		return 0, false
+	}
+	return int64(userID), true
+}
+
+type DelistRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handleDelistServer takes a server out of discovery. The reason is shown to
+// the server's members in its settings and audit log.
+func (h *ServerHandler) handleDelistServer(w http.ResponseWriter, r *http.Request) {
+	var request DelistRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(request.Reason)
+	if reason == "" || len([]rune(reason)) > maxDelistReasonLength {
+		http.Error(w, "reason must be between 1 and 512 characters", http.StatusBadRequest)
+		return
+	}
+	h.setDelisting(w, r, &reason)
+}
+
+// handleRelistServer puts a delisted server back into discovery.
+func (h *ServerHandler) handleRelistServer(w http.ResponseWriter, r *http.Request) {
+	h.setDelisting(w, r, nil)
+}
+
+// setDelisting delists the server with the reason, or relists it when the
+// reason is nil.
+func (h *ServerHandler) setDelisting(w http.ResponseWriter, r *http.Request, reason *string) {
+	staffID, ok := h.requireStaff(w, r)
+	if !ok {
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, server Server
+	err = tx.Get(&before, "SELECT "+serverColumns+" FROM servers WHERE id = $1 FOR UPDATE", serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return
+	}
+	err = tx.Get(&server, `
+		UPDATE servers SET
+			delisted_at = CASE WHEN $2::TEXT IS NULL THEN NULL ELSE COALESCE(delisted_at, NOW()) END,
+			delisted_reason = $2::TEXT
+		WHERE id = $1
+		RETURNING `+serverColumns,
+		serverID, reason)
+	if err != nil {
+		log.Printf("Error delisting server: %v", err)
+		http.Error(w, "Failed to update server", http.StatusInternalServerError)
+		return
+	}
+	action := auditlog.ServerDelist
+	if reason == nil {
+		action = auditlog.ServerRelist
+	}
+	err = auditlog.Record(tx, r, serverID, staffID, action, serverID, auditlog.Diff(before, server))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(serverID), websocket.EventServerUpdate, server)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
+
+// RefreshDiscoveryActivity periodically counts the messages sent in each
+// public server over the last week, for discovery to sort by.
+func (h *ServerHandler) RefreshDiscoveryActivity() {
+	ticker := time.NewTicker(activityInterval)
+	defer ticker.Stop()
+	for {
+		if err := h.refreshActivity(); err != nil {
+			log.Println("Discovery activity error:", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (h *ServerHandler) refreshActivity() error {
+	var serverIDs []int64
+	err := h.DB.Select(&serverIDs, "SELECT id FROM servers WHERE public AND delisted_at IS NULL")
+	if err != nil || len(serverIDs) == 0 {
+		return err
+	}
+
+	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+	cursor, err := collection.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": bson.M{
+			"server_id":  bson.M{"$in": serverIDs},
+			"created_at": bson.M{"$gte": time.Now().Add(-7 * 24 * time.Hour)},
+		}},
+		bson.M{"$group": bson.M{"_id": "$server_id", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		ServerID int64 `bson:"_id"`
+		Count    int64 `bson:"count"`
+	}
+	if err := cursor.All(context.Background(), &results); err != nil {
+		return err
+	}
+
+	counts := make(map[int64]int64, len(results))
+	for _, result := range results {
+		counts[result.ServerID] = result.Count
+	}
+	weekly := make([]int64, len(serverIDs))
+	for i, id := range serverIDs {
+		weekly[i] = counts[id]
+	}
+	_, err = h.DB.Exec(`
+		UPDATE servers s SET weekly_messages = v.count
+		FROM UNNEST($1::INT[], $2::INT[]) AS v(id, count)
+		WHERE s.id = v.id
+	`, pq.Int64Array(serverIDs), pq.Int64Array(weekly))
+	return err
+}
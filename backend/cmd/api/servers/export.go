@@ -0,0 +1,319 @@
+package servers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/permissions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportBatchSize is how many messages are read, resolved and written out at
+// a time.
+const exportBatchSize = 500
+
+// exportRange is the date range of an export; either end may be open.
+type exportRange struct {
+	After  *time.Time
+	Before *time.Time
+}
+
+// parseExportTime accepts RFC 3339 timestamps or plain dates, which mean
+// midnight UTC.
+func parseExportTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// exportRequest reads the format and date range shared by the export routes.
+func exportRequest(w http.ResponseWriter, r *http.Request) (format string, dates exportRange, ok bool) {
+	params := r.URL.Query()
+	format = params.Get("format")
+	if format == "" {
+		format = FormatJSONL
+	}
+	if _, known := transcriptContentTypes[format]; !known {
+		http.Error(w, "format must be 'jsonl', 'html' or 'csv'", http.StatusBadRequest)
+		return "", dates, false
+	}
+	var err error
+	if dates.After, err = parseExportTime(params.Get("after")); err != nil {
+		http.Error(w, "Invalid 'after' date", http.StatusBadRequest)
+		return "", dates, false
+	}
+	if dates.Before, err = parseExportTime(params.Get("before")); err != nil {
+		http.Error(w, "Invalid 'before' date", http.StatusBadRequest)
+		return "", dates, false
+	}
+	if dates.After != nil && dates.Before != nil && !dates.After.Before(*dates.Before) {
+		http.Error(w, "'after' must be earlier than 'before'", http.StatusBadRequest)
+		return "", dates, false
+	}
+	return format, dates, true
+}
+
+// checkExport checks that the user may export the server's messages.
+func (h *ServerHandler) checkExport(w http.ResponseWriter, userID, serverID int64) bool {
+	allowed, err := permissions.Check(h.DB, userID, serverID, permissions.ExportMessages)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing export messages permission", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleExportChannel streams the history of a channel as a transcript.
+func (h *ServerHandler) handleExportChannel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	channelID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	format, dates, ok := exportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var channel Channel
+	err = h.DB.Get(&channel, "SELECT "+channelColumns+" FROM channels WHERE id = $1", channelID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return
+	}
+	if !h.checkExport(w, int64(userID), channel.ServerID) {
+		return
+	}
+
+	h.streamTranscript(w, r, int64(userID), channel.ServerID, channel.ID, []Channel{channel}, format, dates,
+		fmt.Sprintf("channel-%d", channel.ID), channel.Name)
+}
+
+// handleExportServer streams the history of every text and announcement
+// channel in a server as one transcript, channel by channel.
+func (h *ServerHandler) handleExportServer(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	format, dates, ok := exportRequest(w, r)
+	if !ok {
+		return
+	}
+	if !h.checkExport(w, int64(userID), serverID) {
+		return
+	}
+
+	var channels []Channel
+	err = h.DB.Select(&channels, `
+		SELECT `+channelColumns+` FROM channels WHERE server_id = $1 AND type IN ('text', 'announcement') ORDER BY id
+	`, serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch channels", http.StatusInternalServerError)
+		return
+	}
+
+	h.streamTranscript(w, r, int64(userID), serverID, serverID, channels, format, dates,
+		fmt.Sprintf("server-%d", serverID), "")
+}
+
+// apiURL is the public base URL of this API, for links to it in files that
+// are opened elsewhere.
+func apiURL() string {
+	if url := os.Getenv("API_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// absoluteURL resolves a path served by this API, such as an avatar, so a
+// downloaded transcript can still load it. Other URLs are returned as they
+// are.
+func absoluteURL(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return path
+	}
+	return apiURL() + path
+}
+
+// streamTranscript writes the messages of the channels, oldest first, in
+// batches: each batch resolves its authors with one query and is flushed to
+// the client before the next is read. targetID is the exported channel or
+// server, and channelName is empty for servers. Once the response has
+// started, errors can only end it early.
+func (h *ServerHandler) streamTranscript(w http.ResponseWriter, r *http.Request, userID, serverID, targetID int64, channels []Channel, format string, dates exportRange, name, channelName string) {
+	var serverName string
+	if err := h.DB.Get(&serverName, "SELECT name FROM servers WHERE id = $1", serverID); err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return
+	}
+	channelIDs := make([]int, len(channels))
+	channelNames := make(map[int]string, len(channels))
+	for i, channel := range channels {
+		channelIDs[i] = int(channel.ID)
+		channelNames[int(channel.ID)] = channel.Name
+	}
+
+	changes := auditlog.Changes{{Key: "format", New: format}}
+	if dates.After != nil {
+		changes = append(changes, auditlog.Change{Key: "after", New: dates.After})
+	}
+	if dates.Before != nil {
+		changes = append(changes, auditlog.Change{Key: "before", New: dates.Before})
+	}
+	if err := auditlog.Record(h.DB, r, serverID, userID, auditlog.MessagesExport, targetID, changes); err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+
+	filter := bson.M{"channel_id": bson.M{"$in": channelIDs}}
+	createdAt := bson.M{}
+	if dates.After != nil {
+		createdAt["$gte"] = *dates.After
+	}
+	if dates.Before != nil {
+		createdAt["$lt"] = *dates.Before
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "channel_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(exportBatchSize)
+	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+	cursor, err := collection.Find(r.Context(), filter, opts)
+	if err != nil {
+		log.Printf("Error exporting messages: %v", err)
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	w.Header().Set("Content-Type", transcriptContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, name, time.Now().UTC().Format("20060102"), format))
+	w.Header().Set("Cache-Control", "private, no-store")
+	flusher, _ := w.(http.Flusher)
+
+	transcript := newTranscriptWriter(format, w)
+	err = transcript.begin(TranscriptHeader{
+		ServerName:  serverName,
+		ChannelName: channelName,
+		After:       dates.After,
+		Before:      dates.Before,
+		GeneratedAt: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	// Authors are looked up once per export, however often they wrote.
+	authors := make(map[int64]author)
+	batch := make([]TranscriptMessage, 0, exportBatchSize)
+	writeBatch := func() error {
+		var missing []int64
+		for _, message := range batch {
+			id := int64(message.UserID)
+			if _, known := authors[id]; !known && message.UserName == "" && id != 0 {
+				authors[id] = author{}
+				missing = append(missing, id)
+			}
+		}
+		found, err := h.lookupAuthors(serverID, missing)
+		if err != nil {
+			return err
+		}
+		for id, a := range found {
+			authors[id] = a
+		}
+		for i := range batch {
+			message := &batch[i]
+			message.ChannelName = channelNames[message.ChannelID]
+			message.Author = TranscriptAuthor{
+				ID:        int64(message.UserID),
+				Name:      message.UserName,
+				AvatarURL: message.AvatarURL,
+				Bot:       message.Bot,
+				WebhookID: message.WebhookID,
+			}
+			if message.UserName == "" {
+				a := authors[int64(message.UserID)]
+				message.Author.Name, message.Author.AvatarURL = a.Name, a.AvatarURL
+			}
+			message.Author.AvatarURL = absoluteURL(message.Author.AvatarURL)
+			if err := transcript.write(message); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		if err := transcript.flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	for cursor.Next(r.Context()) {
+		var message TranscriptMessage
+		if err := cursor.Decode(&message); err != nil {
+			log.Printf("Error decoding exported message: %v", err)
+			return
+		}
+		batch = append(batch, message)
+		if len(batch) == exportBatchSize {
+			if err := writeBatch(); err != nil {
+				log.Printf("Error exporting messages: %v", err)
+				return
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		log.Printf("Error exporting messages: %v", err)
+		return
+	}
+	if err := writeBatch(); err != nil {
+		log.Printf("Error exporting messages: %v", err)
+		return
+	}
+	if err := transcript.end(); err != nil {
+		log.Printf("Error exporting messages: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package servers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/websocket"
+)
+
+// ChannelFollow makes a text channel get copies of the messages published in
+// an announcement channel, possibly of another server.
+type ChannelFollow struct {
+	ID              int64     `db:"id" json:"id"`
+	SourceChannelID int64     `db:"source_channel_id" json:"source_channel_id"`
+	TargetChannelID int64     `db:"target_channel_id" json:"target_channel_id"`
+	CreatedBy       *int64    `db:"created_by" json:"created_by"`
+	CreatedAt       time.Time `db:"created_at" json:"created_at"`
+}
+
+const followColumns = "id, source_channel_id, target_channel_id, created_by, created_at"
+
+// Follower is a channel following an announcement channel.
+type Follower struct {
+	ChannelFollow
+	ChannelName string `db:"channel_name" json:"channel_name"`
+	ServerID    int64  `db:"server_id" json:"server_id"`
+	ServerName  string `db:"server_name" json:"server_name"`
+}
+
+type FollowChannelRequest struct {
+	// ChannelID is the text channel the copies are posted in.
+	ChannelID int64 `json:"channel_id"`
+}
+
+// handleFollowChannel makes a text channel follow an announcement channel.
+// The user must be able to read the announcement channel and manage webhooks
+// where the copies go, as the copies are posted much like webhook messages.
+func (h *ServerHandler) handleFollowChannel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	sourceID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	var request FollowChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var source, target Channel
+	err = h.DB.Get(&source, "SELECT "+channelColumns+" FROM channels WHERE id = $1", sourceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return
+	}
+	var isMember bool
+	err = h.DB.Get(&isMember, `
+		SELECT EXISTS (SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = $2)
+	`, userID, source.ServerID)
+	if err != nil {
+		http.Error(w, "Failed to verify membership", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	if source.Type != websocket.ChannelTypeAnnouncement {
+		http.Error(w, "Only announcement channels can be followed", http.StatusBadRequest)
+		return
+	}
+
+	err = h.DB.Get(&target, "SELECT "+channelColumns+" FROM channels WHERE id = $1", request.ChannelID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Target channel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return
+	}
+	if target.Type != "text" {
+		http.Error(w, "Copies can only be posted in text channels", http.StatusBadRequest)
+		return
+	}
+	allowed, err := permissions.Check(h.DB, int64(userID), target.ServerID, permissions.ManageWebhooks)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage webhooks permission", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var follow ChannelFollow
+	err = tx.Get(&follow, `
+		INSERT INTO channel_follows (source_channel_id, target_channel_id, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (source_channel_id, target_channel_id) DO NOTHING
+		RETURNING `+followColumns,
+		source.ID, target.ID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "The channel already follows this channel", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error following channel: %v", err)
+		http.Error(w, "Failed to follow channel", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, target.ServerID, int64(userID), auditlog.ChannelFollow, target.ID, auditlog.Diff(nil, follow))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(follow)
+}
+
+// handleListFollowers returns the channels following an announcement
+// channel, for those who manage it.
+func (h *ServerHandler) handleListFollowers(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	channelID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	var serverID int64
+	err = h.DB.Get(&serverID, "SELECT server_id FROM channels WHERE id = $1", channelID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageChannels)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage channels permission", http.StatusForbidden)
+		return
+	}
+
+	followers := []Follower{}
+	err = h.DB.Select(&followers, `
+		SELECT f.id, f.source_channel_id, f.target_channel_id, f.created_by, f.created_at,
+			c.name AS channel_name, s.id AS server_id, s.name AS server_name
+		FROM channel_follows f
+		JOIN channels c ON c.id = f.target_channel_id
+		JOIN servers s ON s.id = c.server_id
+		WHERE f.source_channel_id = $1
+		ORDER BY f.id
+	`, channelID)
+	if err != nil {
+		http.Error(w, "Failed to fetch followers", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(followers)
+}
+
+// handleUnfollowChannel stops a channel from following an announcement
+// channel. Either side can end it: those who manage webhooks where the copies
+// go, or those who manage channels where they come from. Copies already made
+// are kept.
+func (h *ServerHandler) handleUnfollowChannel(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	sourceID, err := strconv.ParseInt(vars["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	targetID, err := strconv.ParseInt(vars["target_channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid target_channel_id", http.StatusBadRequest)
+		return
+	}
+
+	var servers struct {
+		Source int64 `db:"source_server_id"`
+		Target int64 `db:"target_server_id"`
+	}
+	err = h.DB.Get(&servers, `
+		SELECT sc.server_id AS source_server_id, tc.server_id AS target_server_id
+		FROM channel_follows f
+		JOIN channels sc ON sc.id = f.source_channel_id
+		JOIN channels tc ON tc.id = f.target_channel_id
+		WHERE f.source_channel_id = $1 AND f.target_channel_id = $2
+	`, sourceID, targetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Follow not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch follow", http.StatusInternalServerError)
+		return
+	}
+	// The entry goes to the audit log of the side that allowed it.
+	auditServerID := servers.Target
+	allowed, err := permissions.Check(h.DB, int64(userID), servers.Target, permissions.ManageWebhooks)
+	if err == nil && !allowed {
+		auditServerID = servers.Source
+		allowed, err = permissions.Check(h.DB, int64(userID), servers.Source, permissions.ManageChannels)
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage webhooks permission", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var follow ChannelFollow
+	err = tx.Get(&follow, `
+		DELETE FROM channel_follows WHERE source_channel_id = $1 AND target_channel_id = $2
+		RETURNING `+followColumns,
+		sourceID, targetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Follow not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to unfollow channel", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, auditServerID, int64(userID), auditlog.ChannelUnfollow, targetID, auditlog.Diff(follow, nil))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
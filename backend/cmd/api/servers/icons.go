@@ -0,0 +1,109 @@
+package servers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/images"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/websocket"
+)
+
+// iconTarget resolves the server in the route and checks that the user may
+// manage it.
+func (h *ServerHandler) iconTarget(w http.ResponseWriter, r *http.Request) (userID, serverID int64, ok bool) {
+	claimedID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	serverID, err = strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	allowed, err := permissions.Check(h.DB, int64(claimedID), serverID, permissions.ManageServer)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage server permission", http.StatusForbidden)
+		return 0, 0, false
+	}
+	return int64(claimedID), serverID, true
+}
+
+// handleUploadIcon sets the server icon to an uploaded image.
+func (h *ServerHandler) handleUploadIcon(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.iconTarget(w, r)
+	if !ok {
+		return
+	}
+	data, err := images.Read(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := images.Store(h.Storage, data)
+	if images.IsInvalid(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error storing icon: %v", err)
+		http.Error(w, "Failed to store icon", http.StatusInternalServerError)
+		return
+	}
+
+	h.setIcon(w, r, userID, serverID, images.URL(key, images.DefaultSize))
+}
+
+// handleDeleteIcon removes the server icon.
+func (h *ServerHandler) handleDeleteIcon(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.iconTarget(w, r)
+	if !ok {
+		return
+	}
+
+	h.setIcon(w, r, userID, serverID, "")
+}
+
+func (h *ServerHandler) setIcon(w http.ResponseWriter, r *http.Request, userID, serverID int64, iconURL string) {
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, server Server
+	err = tx.Get(&before, "SELECT "+serverColumns+" FROM servers WHERE id = $1 FOR UPDATE", serverID)
+	if err != nil {
+		http.Error(w, "Failed to update server", http.StatusInternalServerError)
+		return
+	}
+	err = tx.Get(&server, "UPDATE servers SET icon_url = $2 WHERE id = $1 RETURNING "+serverColumns, serverID, iconURL)
+	if err != nil {
+		log.Printf("Error updating server icon: %v", err)
+		http.Error(w, "Failed to update server", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, userID, auditlog.ServerUpdate, serverID, auditlog.Diff(before, server))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(serverID), websocket.EventServerUpdate, server)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
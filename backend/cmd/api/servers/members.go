@@ -0,0 +1,385 @@
+package servers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/members"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/websocket"
+)
+
+const (
+	// maxTimeout is the longest a member can be timed out for.
+	maxTimeout = 28 * 24 * time.Hour
+	// timeoutExpiryInterval is how often expired timeouts are cleared.
+	timeoutExpiryInterval = 10 * time.Second
+)
+
+type Member struct {
+	UserID       int64      `db:"user_id" json:"user_id"`
+	ServerID     int64      `db:"server_id" json:"server_id"`
+	Nickname     *string    `db:"nickname" json:"nickname"`
+	Role         string     `db:"role" json:"role"`
+	TimeoutUntil *time.Time `db:"timeout_until" json:"timeout_until"`
+}
+
+const memberColumns = "user_id, server_id, nickname, role, timeout_until"
+
+// defaultMemberPageSize is how many members a page has unless asked otherwise.
+const defaultMemberPageSize = 100
+
+// handleListMembers returns a page of the server's members ordered by user
+// ID, with their presence. Members can be searched by username or nickname
+// prefix with query and filtered by role; after continues from a user ID.
+func (h *ServerHandler) handleListMembers(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+
+	params := r.URL.Query()
+	query := members.Query{
+		Search: params.Get("query"),
+		Role:   params.Get("role"),
+		Limit:  defaultMemberPageSize,
+	}
+	if raw := params.Get("after"); raw != "" {
+		if query.After, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid 'after' ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := params.Get("limit"); raw != "" {
+		if query.Limit, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := query.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var isMember bool
+	err = h.DB.Get(&isMember, `
+		SELECT EXISTS (SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = $2)
+	`, userID, serverID)
+	if err != nil {
+		http.Error(w, "Failed to verify membership", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "Forbidden: You are not a member of this server", http.StatusForbidden)
+		return
+	}
+
+	list, err := members.List(h.DB, serverID, query)
+	if err != nil {
+		log.Printf("Error fetching members: %v", err)
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	members.SetPresence(list, h.Hub.IsUserConnected)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// maxNicknameLength matches user_servers.nickname.
+const maxNicknameLength = 32
+
+type UpdateMemberRequest struct {
+	// An empty nickname removes it.
+	Nickname *string `json:"nickname"`
+}
+
+// handleUpdateMember changes a member's nickname. Members can change their
+// own; changing someone else's needs the manage nicknames permission, and
+// only the owner can rename the owner.
+func (h *ServerHandler) handleUpdateMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	serverID, err := strconv.ParseInt(vars["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	var targetID int64
+	if vars["user_id"] == "@me" {
+		targetID = int64(userID)
+	} else if targetID, err = strconv.ParseInt(vars["user_id"], 10, 64); err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	var request UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Nickname == nil {
+		http.Error(w, "nickname is required", http.StatusBadRequest)
+		return
+	}
+	nickname := strings.TrimSpace(*request.Nickname)
+	if len([]rune(nickname)) > maxNicknameLength {
+		http.Error(w, "nickname must be at most 32 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var actorRole string
+	err = tx.Get(&actorRole, `
+		SELECT role FROM user_servers WHERE user_id = $1 AND server_id = $2
+	`, int64(userID), serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Forbidden: You are not a member of this server", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+
+	var before, member Member
+	err = tx.Get(&before, `
+		SELECT `+memberColumns+` FROM user_servers
+		WHERE user_id = $1 AND server_id = $2
+		FOR UPDATE
+	`, targetID, serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch member", http.StatusInternalServerError)
+		return
+	}
+	if targetID != int64(userID) {
+		if !permissions.ForRole(actorRole).Has(permissions.ManageNicknames) {
+			http.Error(w, "Forbidden: missing manage nicknames permission", http.StatusForbidden)
+			return
+		}
+		if before.Role == "owner" {
+			http.Error(w, "Forbidden: only the owner can change their nickname", http.StatusForbidden)
+			return
+		}
+	}
+
+	err = tx.Get(&member, `
+		UPDATE user_servers SET nickname = NULLIF($3, '')
+		WHERE user_id = $1 AND server_id = $2
+		RETURNING `+memberColumns,
+		targetID, serverID, nickname)
+	if err != nil {
+		log.Printf("Error updating member: %v", err)
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return
+	}
+	// Members changing their own nickname is not moderation, so only changes
+	// made to others are audited.
+	if targetID != int64(userID) {
+		err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.MemberUpdate, targetID, auditlog.Diff(before, member))
+		if err != nil {
+			http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(serverID), websocket.EventMemberUpdate, member)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+type TimeoutRequest struct {
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+// memberTarget resolves the server and member in the route and checks that
+// the user may moderate them. Members who can moderate others can only be
+// timed out by the owner, and the owner not at all.
+func (h *ServerHandler) memberTarget(w http.ResponseWriter, r *http.Request) (actorID, serverID, targetID int64, ok bool) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, 0, 0, false
+	}
+	vars := mux.Vars(r)
+	serverID, err = strconv.ParseInt(vars["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	targetID, err = strconv.ParseInt(vars["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+
+	var roles []struct {
+		UserID int64  `db:"user_id"`
+		Role   string `db:"role"`
+	}
+	err = h.DB.Select(&roles, `
+		SELECT user_id, role FROM user_servers WHERE server_id = $1 AND user_id IN ($2, $3)
+	`, serverID, int64(userID), targetID)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return 0, 0, 0, false
+	}
+	actorRole, targetRole := "", ""
+	for _, row := range roles {
+		if row.UserID == int64(userID) {
+			actorRole = row.Role
+		}
+		if row.UserID == targetID {
+			targetRole = row.Role
+		}
+	}
+
+	if !permissions.ForRole(actorRole).Has(permissions.ModerateMembers) {
+		http.Error(w, "Forbidden: missing moderate members permission", http.StatusForbidden)
+		return 0, 0, 0, false
+	}
+	if targetRole == "" {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return 0, 0, 0, false
+	}
+	if targetID == int64(userID) {
+		http.Error(w, "You can't time yourself out", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	if targetRole == "owner" || (permissions.ForRole(targetRole).Has(permissions.ModerateMembers) && actorRole != "owner") {
+		http.Error(w, "Forbidden: member can't be timed out", http.StatusForbidden)
+		return 0, 0, 0, false
+	}
+	return int64(userID), serverID, targetID, true
+}
+
+// handleTimeoutMember times a member out for a duration, replacing any
+// timeout they already have.
+func (h *ServerHandler) handleTimeoutMember(w http.ResponseWriter, r *http.Request) {
+	actorID, serverID, targetID, ok := h.memberTarget(w, r)
+	if !ok {
+		return
+	}
+	var request TimeoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.DurationSeconds < 1 || request.DurationSeconds > int(maxTimeout.Seconds()) {
+		http.Error(w, "duration_seconds must be between 1 and 2419200", http.StatusBadRequest)
+		return
+	}
+
+	h.setTimeout(w, r, actorID, serverID, targetID, auditlog.MemberTimeout,
+		"NOW() + $3::INT * INTERVAL '1 second'", request.DurationSeconds)
+}
+
+// handleRemoveTimeout ends a member's timeout early.
+func (h *ServerHandler) handleRemoveTimeout(w http.ResponseWriter, r *http.Request) {
+	actorID, serverID, targetID, ok := h.memberTarget(w, r)
+	if !ok {
+		return
+	}
+
+	h.setTimeout(w, r, actorID, serverID, targetID, auditlog.MemberTimeoutRemove, "NULL")
+}
+
+// setTimeout sets a member's timeout_until to the SQL expression until,
+// which may use args from $3 on, records it and tells the server.
+func (h *ServerHandler) setTimeout(w http.ResponseWriter, r *http.Request, actorID, serverID, targetID int64, action auditlog.Action, until string, args ...interface{}) {
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, member Member
+	err = tx.Get(&before, `
+		SELECT `+memberColumns+` FROM user_servers
+		WHERE user_id = $1 AND server_id = $2
+		FOR UPDATE
+	`, targetID, serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch member", http.StatusInternalServerError)
+		return
+	}
+	err = tx.Get(&member, `
+		UPDATE user_servers SET timeout_until = `+until+`
+		WHERE user_id = $1 AND server_id = $2
+		RETURNING `+memberColumns,
+		append([]interface{}{targetID, serverID}, args...)...)
+	if err != nil {
+		log.Printf("Error updating member timeout: %v", err)
+		http.Error(w, "Failed to update timeout", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, actorID, action, targetID, auditlog.Diff(before, member))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(serverID), websocket.EventMemberUpdate, member)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+// ExpireTimeouts periodically clears timeouts that have run out and tells
+// the servers. Timeouts are enforced by comparing against the current time,
+// so this only keeps stored state and clients up to date.
+func (h *ServerHandler) ExpireTimeouts() {
+	ticker := time.NewTicker(timeoutExpiryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []Member
+		err := h.DB.Select(&expired, `
+			UPDATE user_servers SET timeout_until = NULL
+			WHERE timeout_until <= NOW()
+			RETURNING `+memberColumns)
+		if err != nil {
+			log.Println("Timeout expiry error:", err)
+			continue
+		}
+		for _, member := range expired {
+			h.Hub.Broadcast(int(member.ServerID), websocket.EventMemberUpdate, member)
+		}
+	}
+}
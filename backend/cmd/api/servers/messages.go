@@ -0,0 +1,318 @@
+package servers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/markdown"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// messageTarget is a message acted on through the API, with the channel it
+// is in and the role of the member acting on it.
+type messageTarget struct {
+	UserID  int64
+	Role    string
+	Channel Channel
+	Message ChatMessage
+}
+
+// loadMessage reads the channel and message in the request and checks that
+// the user is a member of the channel's server.
+func (h *ServerHandler) loadMessage(w http.ResponseWriter, r *http.Request) (*messageTarget, bool) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	vars := mux.Vars(r)
+	channelID, err := strconv.ParseInt(vars["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return nil, false
+	}
+	messageID, err := primitive.ObjectIDFromHex(vars["message_id"])
+	if err != nil {
+		http.Error(w, "Invalid message_id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	target := &messageTarget{UserID: int64(userID)}
+	err = h.DB.Get(&target.Channel, "SELECT "+channelColumns+" FROM channels WHERE id = $1", channelID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return nil, false
+	}
+	err = h.DB.Get(&target.Role, `
+		SELECT role FROM user_servers WHERE user_id = $1 AND server_id = $2
+	`, userID, target.Channel.ServerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Forbidden: You are not a member of this server", http.StatusForbidden)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Failed to verify membership", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	err = h.messages().FindOne(r.Context(), bson.M{"_id": messageID, "channel_id": channelID}).Decode(&target.Message)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch message", http.StatusInternalServerError)
+		return nil, false
+	}
+	return target, true
+}
+
+func (h *ServerHandler) messages() *mongo.Collection {
+	return h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// handleEditMessage changes the content of the user's own message. The new
+// content is moderated like a new message. Edits of published announcements
+// are passed on to their copies.
+func (h *ServerHandler) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.loadMessage(w, r)
+	if !ok {
+		return
+	}
+	message := target.Message
+	if int64(message.UserID) != target.UserID || message.WebhookID != 0 || message.Crosspost != nil {
+		http.Error(w, "Forbidden: you can only edit your own messages", http.StatusForbidden)
+		return
+	}
+	until, err := permissions.TimeoutUntil(h.DB, target.UserID, target.Channel.ServerID)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if until != nil {
+		http.Error(w, "Forbidden: you are timed out", http.StatusForbidden)
+		return
+	}
+
+	var request EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	parsed, err := markdown.Parse(request.Content)
+	var invalid *markdown.ValidationError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid content", http.StatusBadRequest)
+		return
+	}
+	if parsed.Text == "" && len(message.Embeds) == 0 {
+		http.Error(w, "message is empty", http.StatusBadRequest)
+		return
+	}
+	// Edits go through the same checks as new messages, so they can't be
+	// used to get around them.
+	var interval time.Duration
+	if h.Moderator != nil {
+		var wait time.Duration
+		interval, wait, err = h.Moderator.SlowModeWait(int(target.UserID), int(target.Channel.ID), int(target.Channel.ServerID))
+		if err != nil {
+			http.Error(w, "Failed to check slow mode", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Slow mode is on, try again later", http.StatusTooManyRequests)
+			return
+		}
+		blocked, err := h.Moderator.Moderate(&websocket.Message{
+			ChannelID: int(target.Channel.ID),
+			ServerId:  int(target.Channel.ServerID),
+			UserID:    int(target.UserID),
+			Content:   request.Content,
+		})
+		if err != nil {
+			log.Printf("Error moderating message edit: %v", err)
+			http.Error(w, "Failed to check message", http.StatusInternalServerError)
+			return
+		}
+		if blocked != nil {
+			http.Error(w, blocked.Reason, http.StatusForbidden)
+			return
+		}
+	}
+
+	now := time.Now()
+	var edited ChatMessage
+	err = h.messages().FindOneAndUpdate(r.Context(),
+		bson.M{"_id": message.ID},
+		bson.M{"$set": bson.M{"content": parsed.Text, "plain_text": parsed.PlainText, "edited_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&edited)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error editing message: %v", err)
+		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+	if interval > 0 {
+		h.Moderator.RecordSlowMode(int(target.UserID), int(target.Channel.ID))
+	}
+	if edited.PublishedAt != nil {
+		if err := enqueueCrosspost(h.DB, edited.ID.Hex(), target.Channel.ID, crosspostUpdate); err != nil {
+			log.Printf("Error queueing update of copies of message %s: %v", edited.ID.Hex(), err)
+		}
+	}
+	h.Hub.Broadcast(int(target.Channel.ServerID), websocket.EventMessageUpdate, map[string]interface{}{
+		"id":         edited.ID.Hex(),
+		"channel_id": edited.ChannelID,
+		"server_id":  target.Channel.ServerID,
+		"content":    edited.Content,
+		"edited_at":  edited.EditedAt,
+	})
+
+	h.writeMessage(w, edited, target.Channel.ServerID)
+}
+
+// handleDeleteMessage deletes a message. Members can delete their own;
+// deleting anyone else's needs the manage messages permission. Deleting a
+// published announcement deletes its copies too.
+func (h *ServerHandler) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.loadMessage(w, r)
+	if !ok {
+		return
+	}
+	message := target.Message
+	own := int64(message.UserID) == target.UserID && message.WebhookID == 0 && message.Crosspost == nil
+	if !own && !permissions.ForRole(target.Role).Has(permissions.ManageMessages) {
+		http.Error(w, "Forbidden: missing manage messages permission", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// Deleting someone else's message is a moderator action, so it is
+	// audited; the entry is only kept if the message is gone.
+	if !own {
+		err = auditlog.Record(tx, r, target.Channel.ServerID, target.UserID, auditlog.MessageDelete, int64(message.UserID), auditlog.Changes{
+			{Key: "channel_id", Old: target.Channel.ID},
+			{Key: "message_id", Old: message.ID.Hex()},
+		})
+		if err != nil {
+			http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	res, err := h.messages().DeleteOne(r.Context(), bson.M{"_id": message.ID})
+	if err != nil {
+		log.Printf("Error deleting message: %v", err)
+		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+		return
+	}
+	if res.DeletedCount == 0 {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error recording deletion of message %s: %v", message.ID.Hex(), err)
+	}
+	if message.PublishedAt != nil {
+		if err := enqueueCrosspost(h.DB, message.ID.Hex(), target.Channel.ID, crosspostDelete); err != nil {
+			log.Printf("Error queueing deletion of copies of message %s: %v", message.ID.Hex(), err)
+		}
+	}
+	h.Hub.Broadcast(int(target.Channel.ServerID), websocket.EventMessageDelete, map[string]interface{}{
+		"id":         message.ID.Hex(),
+		"channel_id": message.ChannelID,
+		"server_id":  target.Channel.ServerID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePublishMessage sends a message in an announcement channel to every
+// channel following it. The copies are made in the background.
+func (h *ServerHandler) handlePublishMessage(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.loadMessage(w, r)
+	if !ok {
+		return
+	}
+	if target.Channel.Type != websocket.ChannelTypeAnnouncement {
+		http.Error(w, "Only messages in announcement channels can be published", http.StatusBadRequest)
+		return
+	}
+	if !permissions.ForRole(target.Role).Has(permissions.SendAnnouncements) {
+		http.Error(w, "Forbidden: missing send announcements permission", http.StatusForbidden)
+		return
+	}
+
+	var published ChatMessage
+	err := h.messages().FindOneAndUpdate(r.Context(),
+		bson.M{"_id": target.Message.ID, "published_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"published_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&published)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Message was already published", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error publishing message: %v", err)
+		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueCrosspost(h.DB, published.ID.Hex(), target.Channel.ID, crosspostCreate); err != nil {
+		// Without a job the copies would never be made, so let it be
+		// published again.
+		h.messages().UpdateOne(context.Background(), bson.M{"_id": published.ID}, bson.M{"$unset": bson.M{"published_at": ""}})
+		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(target.Channel.ServerID), websocket.EventMessageUpdate, map[string]interface{}{
+		"id":           published.ID.Hex(),
+		"channel_id":   published.ChannelID,
+		"server_id":    target.Channel.ServerID,
+		"published_at": published.PublishedAt,
+	})
+
+	h.writeMessage(w, published, target.Channel.ServerID)
+}
+
+// writeMessage responds with the message, its author filled in.
+func (h *ServerHandler) writeMessage(w http.ResponseWriter, message ChatMessage, serverID int64) {
+	messages := []ChatMessage{message}
+	if err := h.resolveAuthors(messages, serverID); err != nil {
+		log.Printf("Error resolving message author: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages[0])
+}
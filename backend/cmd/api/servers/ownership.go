@@ -0,0 +1,220 @@
+package servers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// purgeInterval is how often the messages of deleted servers are purged.
+const purgeInterval = 30 * time.Second
+
+// requireOwner checks that the user owns the server and, if they have
+// two-factor authentication enabled, confirmed the action with a code.
+func (h *ServerHandler) requireOwner(w http.ResponseWriter, r *http.Request) (userID, serverID int64, ok bool) {
+	claimedID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	serverID, err = strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	var ownerID int64
+	err = h.DB.Get(&ownerID, "SELECT owner_id FROM servers WHERE id = $1", serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return 0, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if ownerID != int64(claimedID) {
+		http.Error(w, "Forbidden: only the owner can do this", http.StatusForbidden)
+		return 0, 0, false
+	}
+	if auth.WriteMFAError(w, auth.RequireMFA(r, int(claimedID))) {
+		return 0, 0, false
+	}
+	return int64(claimedID), serverID, true
+}
+
+type TransferOwnershipRequest struct {
+	OwnerID int64 `json:"owner_id"`
+}
+
+// handleTransferOwnership makes another member the owner. The previous owner
+// stays on as an admin.
+func (h *ServerHandler) handleTransferOwnership(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+	var request TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.OwnerID == userID {
+		http.Error(w, "You already own this server", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before Server
+	err = tx.Get(&before, "SELECT "+serverColumns+" FROM servers WHERE id = $1 FOR UPDATE", serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return
+	}
+	if before.OwnerID != userID {
+		http.Error(w, "Forbidden: only the owner can do this", http.StatusForbidden)
+		return
+	}
+
+	var isBot bool
+	err = tx.Get(&isBot, `
+		SELECT u.is_bot FROM user_servers us
+		JOIN users u ON u.id = us.user_id
+		WHERE us.user_id = $1 AND us.server_id = $2
+	`, request.OwnerID, serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "The new owner must be a member of the server", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch member", http.StatusInternalServerError)
+		return
+	}
+	if isBot {
+		http.Error(w, "Bots can't own servers", http.StatusBadRequest)
+		return
+	}
+
+	var server Server
+	err = tx.Get(&server, "UPDATE servers SET owner_id = $2 WHERE id = $1 RETURNING "+serverColumns, serverID, request.OwnerID)
+	if err != nil {
+		log.Printf("Error transferring server: %v", err)
+		http.Error(w, "Failed to transfer server", http.StatusInternalServerError)
+		return
+	}
+	var members []Member
+	err = tx.Select(&members, `
+		UPDATE user_servers
+		SET role = CASE WHEN user_id = $2 THEN 'owner' ELSE 'admin' END
+		WHERE server_id = $1 AND user_id IN ($2, $3)
+		RETURNING `+memberColumns,
+		serverID, request.OwnerID, userID)
+	if err != nil {
+		log.Printf("Error transferring server: %v", err)
+		http.Error(w, "Failed to transfer server", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, userID, auditlog.ServerOwnerTransfer, serverID, auditlog.Diff(before, server))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.Hub.Broadcast(int(serverID), websocket.EventServerUpdate, server)
+	for _, member := range members {
+		h.Hub.Broadcast(int(serverID), websocket.EventMemberUpdate, member)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
+
+// handleDeleteServer deletes a server with its channels and memberships. The
+// messages, which live in Mongo, are purged in the background.
+func (h *ServerHandler) handleDeleteServer(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var channelIDs []int
+	if err := tx.Select(&channelIDs, "SELECT id FROM channels WHERE server_id = $1", serverID); err != nil {
+		http.Error(w, "Failed to fetch channels", http.StatusInternalServerError)
+		return
+	}
+	res, err := tx.Exec("DELETE FROM servers WHERE id = $1 AND owner_id = $2", serverID, userID)
+	if err != nil {
+		log.Printf("Error deleting server: %v", err)
+		http.Error(w, "Failed to delete server", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Forbidden: only the owner can do this", http.StatusForbidden)
+		return
+	}
+	if _, err := tx.Exec("INSERT INTO server_purges (server_id) VALUES ($1)", serverID); err != nil {
+		http.Error(w, "Failed to schedule message purge", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.Hub.DeleteServer(int(serverID), channelIDs)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeDeletedServers periodically removes the messages of deleted servers.
+// Purges are queued in Postgres, so they survive restarts.
+func (h *ServerHandler) PurgeDeletedServers() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+	for range ticker.C {
+		var serverIDs []int
+		if err := h.DB.Select(&serverIDs, "SELECT server_id FROM server_purges ORDER BY created_at"); err != nil {
+			log.Println("Server purge error:", err)
+			continue
+		}
+		for _, serverID := range serverIDs {
+			res, err := collection.DeleteMany(context.Background(), bson.M{"server_id": serverID})
+			if err != nil {
+				log.Printf("Error purging messages of server %d: %v", serverID, err)
+				continue
+			}
+			if _, err := h.DB.Exec("DELETE FROM server_purges WHERE server_id = $1", serverID); err != nil {
+				log.Printf("Error finishing purge of server %d: %v", serverID, err)
+				continue
+			}
+			log.Printf("Purged %d messages of deleted server %d", res.DeletedCount, serverID)
+		}
+	}
+}
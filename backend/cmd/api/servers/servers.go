@@ -2,40 +2,67 @@ package servers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
 	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/discovery"
+	"github.com/mograby3500/mini-discord/images"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/storage"
+	"github.com/mograby3500/mini-discord/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Moderator applies the gateway's slow mode and AutoMod rules to messages
+// that change through the API.
+type Moderator interface {
+	Moderate(message *websocket.Message) (*websocket.Blocked, error)
+	SlowModeWait(userID, channelID, serverID int) (interval, wait time.Duration, err error)
+	RecordSlowMode(userID, channelID int)
+}
+
 type ServerHandler struct {
 	DB      *sqlx.DB
 	MongoDB *mongo.Client
+	Hub     *websocket.Hub
+	Storage storage.Storage
+	// Moderator checks edited messages; nil skips the checks.
+	Moderator Moderator
 }
 
 type CreateServerRequest struct {
 	Name string `json:"name"`
+	// TemplateCode optionally names a template to copy the structure of.
+	TemplateCode string `json:"template_code"`
 }
 
 type Channel struct {
-	ID        int64     `db:"id" json:"id"`
-	ServerID  int64     `db:"server_id" json:"server_id"`
-	Name      string    `db:"name" json:"name"`
-	Type      string    `db:"type" json:"type"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID              int64     `db:"id" json:"id"`
+	ServerID        int64     `db:"server_id" json:"server_id"`
+	Name            string    `db:"name" json:"name"`
+	Type            string    `db:"type" json:"type"`
+	SlowmodeSeconds int       `db:"slowmode_seconds" json:"slowmode_seconds"`
+	CreatedAt       time.Time `db:"created_at" json:"created_at"`
 }
 
+const channelColumns = "id, server_id, name, type, slowmode_seconds, created_at"
+
 type ChatMessage struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	ChannelID int                `bson:"channel_id" json:"channel_id"`
@@ -43,8 +70,40 @@ type ChatMessage struct {
 	Content   string             `bson:"content" json:"content"`
 	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
 	UserName  string             `bson:"user_name,omitempty" json:"user_name,omitempty"`
+	Bot       bool               `bson:"bot,omitempty" json:"bot"`
+	WebhookID int                `bson:"webhook_id,omitempty" json:"webhook_id,omitempty"`
+	AvatarURL string             `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	Embeds    []bson.M           `bson:"embeds,omitempty" json:"embeds,omitempty"`
+	// Interaction is set on bot replies to slash commands.
+	Interaction *struct {
+		ID     string `bson:"id" json:"id"`
+		Name   string `bson:"name" json:"name"`
+		UserID int    `bson:"user_id" json:"user_id"`
+	} `bson:"interaction,omitempty" json:"interaction,omitempty"`
+	EditedAt    *time.Time           `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	PublishedAt *time.Time           `bson:"published_at,omitempty" json:"published_at,omitempty"`
+	Crosspost   *websocket.Crosspost `bson:"crosspost,omitempty" json:"crosspost,omitempty"`
+}
+
+type Server struct {
+	ID                   int64          `db:"id" json:"id"`
+	Name                 string         `db:"name" json:"name"`
+	Description          string         `db:"description" json:"description"`
+	IconURL              string         `db:"icon_url" json:"icon_url"`
+	OwnerID              int64          `db:"owner_id" json:"owner_id"`
+	DefaultNotifications string         `db:"default_notifications" json:"default_notifications"`
+	SystemChannelID      *int64         `db:"system_channel_id" json:"system_channel_id"`
+	LinkPreviews         bool           `db:"link_previews" json:"link_previews"`
+	Public               bool           `db:"public" json:"public"`
+	Tags                 pq.StringArray `db:"tags" json:"tags"`
+	Language             string         `db:"language" json:"language"`
+	DelistedAt           *time.Time     `db:"delisted_at" json:"delisted_at"`
+	DelistedReason       *string        `db:"delisted_reason" json:"delisted_reason"`
+	CreatedAt            time.Time      `db:"created_at" json:"created_at"`
 }
 
+const serverColumns = "id, name, description, icon_url, owner_id, default_notifications, system_channel_id, link_previews, public, tags, language, delisted_at, delisted_reason, created_at"
+
 type ServerWithChannels struct {
 	ID       int64     `json:"id"`
 	Name     string    `json:"name"`
@@ -54,10 +113,41 @@ type ServerWithChannels struct {
 func (h *ServerHandler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/servers", h.handleCreateServer).Methods("POST")
 	router.HandleFunc("/servers", h.handleGetUserServers).Methods("GET")
+	router.HandleFunc("/servers/{server_id}", h.handleUpdateServer).Methods("PATCH")
+	router.HandleFunc("/servers/{server_id}", h.handleDeleteServer).Methods("DELETE")
+	router.HandleFunc("/servers/{server_id}/export", h.handleExportServer).Methods("GET")
+	router.HandleFunc("/servers/{server_id}/join", h.handleJoinServer).Methods("POST")
+	router.HandleFunc("/servers/{server_id}/icon", h.handleUploadIcon).Methods("PUT")
+	router.HandleFunc("/servers/{server_id}/icon", h.handleDeleteIcon).Methods("DELETE")
+	router.HandleFunc("/servers/{server_id}/owner", h.handleTransferOwnership).Methods("PUT")
+	router.HandleFunc("/servers/{server_id}/templates", h.handleCreateTemplate).Methods("POST")
+	router.HandleFunc("/servers/{server_id}/templates", h.handleListTemplates).Methods("GET")
+	router.HandleFunc("/servers/{server_id}/templates/{code}", h.handleSyncTemplate).Methods("PUT")
+	router.HandleFunc("/servers/{server_id}/templates/{code}", h.handleUpdateTemplate).Methods("PATCH")
+	router.HandleFunc("/servers/{server_id}/templates/{code}", h.handleDeleteTemplate).Methods("DELETE")
+	router.HandleFunc("/templates/{code}", h.handleGetTemplate).Methods("GET")
+	router.HandleFunc("/discovery/servers", h.handleDiscoverServers).Methods("GET")
+	router.HandleFunc("/discovery/servers/{server_id}/delisting", h.handleDelistServer).Methods("PUT")
+	router.HandleFunc("/discovery/servers/{server_id}/delisting", h.handleRelistServer).Methods("DELETE")
 	router.HandleFunc("/channels", h.handleCreateChannel).Methods("POST")
+	router.HandleFunc("/channels/{channel_id}", h.handleUpdateChannel).Methods("PATCH")
+	router.HandleFunc("/channels/{channel_id}/export", h.handleExportChannel).Methods("GET")
+	router.HandleFunc("/channels/{channel_id}/followers", h.handleFollowChannel).Methods("POST")
+	router.HandleFunc("/channels/{channel_id}/followers", h.handleListFollowers).Methods("GET")
+	router.HandleFunc("/channels/{channel_id}/followers/{target_channel_id}", h.handleUnfollowChannel).Methods("DELETE")
+	router.HandleFunc("/channels/{channel_id}/messages/{message_id}", h.handleEditMessage).Methods("PATCH")
+	router.HandleFunc("/channels/{channel_id}/messages/{message_id}", h.handleDeleteMessage).Methods("DELETE")
+	router.HandleFunc("/channels/{channel_id}/messages/{message_id}/publish", h.handlePublishMessage).Methods("POST")
 	router.HandleFunc("/messages/{channel_id}", h.handleReadMessages).Methods("GET")
+	router.HandleFunc("/servers/{server_id}/bots", h.handleAddBot).Methods("POST")
+	router.HandleFunc("/servers/{server_id}/members", h.handleListMembers).Methods("GET")
+	router.HandleFunc("/servers/{server_id}/members/{user_id}", h.handleUpdateMember).Methods("PATCH")
+	router.HandleFunc("/servers/{server_id}/members/{user_id}/timeout", h.handleTimeoutMember).Methods("PUT")
+	router.HandleFunc("/servers/{server_id}/members/{user_id}/timeout", h.handleRemoveTimeout).Methods("DELETE")
 }
 
+// handleCreateServer creates a server owned by the user, either with a single
+// text channel or with the structure of the template given by its code.
 func (h *ServerHandler) handleCreateServer(w http.ResponseWriter, r *http.Request) {
 	tokenStr := r.Header.Get("Authorization")
 	userID, err := auth.ValidateToken(tokenStr)
@@ -71,37 +161,38 @@ func (h *ServerHandler) handleCreateServer(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > maxServerNameLength {
+		http.Error(w, "name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
 
 	tx, err := h.DB.BeginTxx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
 		return
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	defer tx.Rollback()
+
+	snapshot, message := defaultSnapshot, "server created with default channel"
+	if request.TemplateCode != "" {
+		err = tx.Get(&snapshot, `
+			UPDATE server_templates SET usage_count = usage_count + 1 WHERE code = $1 RETURNING snapshot
+		`, request.TemplateCode)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch template", http.StatusInternalServerError)
+			return
 		}
-	}()
-
-	var serverID int64
-	err = tx.QueryRow(
-		"INSERT INTO servers (name, owner_id) VALUES ($1, $2) RETURNING id",
-		request.Name, userID,
-	).Scan(&serverID)
-	if err != nil {
-		http.Error(w, "Failed to create server", http.StatusInternalServerError)
-		return
+		message = "server created from template"
 	}
 
-	_, err = tx.Exec("INSERT INTO channels (server_id, name, type) VALUES ($1, $2, $3)", serverID, "text", "text")
+	server, err := createServer(tx, r, int64(userID), request.Name, snapshot)
 	if err != nil {
-		http.Error(w, "Failed to create default channel", http.StatusInternalServerError)
-		return
-	}
-
-	_, err = tx.Exec("INSERT INTO user_servers (user_id, server_id, role) VALUES ($1, $2, $3)", userID, serverID, "owner")
-	if err != nil {
-		http.Error(w, "Failed to link user to server", http.StatusInternalServerError)
+		log.Printf("Error creating server: %v", err)
+		http.Error(w, "Failed to create server", http.StatusInternalServerError)
 		return
 	}
 
@@ -112,8 +203,8 @@ func (h *ServerHandler) handleCreateServer(w http.ResponseWriter, r *http.Reques
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message":   "server created with default channel",
-		"server_id": fmt.Sprintf("%d", serverID),
+		"message":   message,
+		"server_id": fmt.Sprintf("%d", server.ID),
 	})
 }
 
@@ -130,6 +221,7 @@ func (h *ServerHandler) handleGetUserServers(w http.ResponseWriter, r *http.Requ
 		ServerName string    `db:"server_name"`
 		Name       string    `db:"name"`
 		Type       string    `db:"type"`
+		Slowmode   int       `db:"slowmode_seconds"`
 		CreatedAt  time.Time `db:"created_at"`
 	}
 	err = h.DB.Select(&raw, `
@@ -139,6 +231,7 @@ func (h *ServerHandler) handleGetUserServers(w http.ResponseWriter, r *http.Requ
 			s.name AS server_name,
 			c.name,
 			c.type,
+			c.slowmode_seconds,
 			c.created_at
 		FROM 
 			channels c
@@ -169,11 +262,12 @@ func (h *ServerHandler) handleGetUserServers(w http.ResponseWriter, r *http.Requ
 			}
 		}
 		serverMap[row.ServerID].Channels = append(serverMap[row.ServerID].Channels, Channel{
-			ID:        row.ID,
-			ServerID:  row.ServerID,
-			Name:      row.Name,
-			Type:      row.Type,
-			CreatedAt: row.CreatedAt,
+			ID:              row.ID,
+			ServerID:        row.ServerID,
+			Name:            row.Name,
+			Type:            row.Type,
+			SlowmodeSeconds: row.Slowmode,
+			CreatedAt:       row.CreatedAt,
 		})
 	}
 
@@ -190,7 +284,7 @@ func (h *ServerHandler) handleGetUserServers(w http.ResponseWriter, r *http.Requ
 type CreateChannelRequest struct {
 	ServerID int64  `json:"server_id"`
 	Name     string `json:"name"`
-	Type     string `json:"type"` // 'text' or 'voice'
+	Type     string `json:"type"` // 'text', 'voice' or 'announcement'
 }
 
 func (h *ServerHandler) handleCreateChannel(w http.ResponseWriter, r *http.Request) {
@@ -205,8 +299,8 @@ func (h *ServerHandler) handleCreateChannel(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	if request.Type != "text" && request.Type != "voice" {
-		http.Error(w, "Invalid channel type: must be 'text' or 'voice'", http.StatusBadRequest)
+	if request.Type != "text" && request.Type != "voice" && request.Type != websocket.ChannelTypeAnnouncement {
+		http.Error(w, "Invalid channel type: must be 'text', 'voice' or 'announcement'", http.StatusBadRequest)
 		return
 	}
 	var exists bool
@@ -225,24 +319,134 @@ func (h *ServerHandler) handleCreateChannel(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var channelID int64
-	err = h.DB.QueryRow(`
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var channel Channel
+	err = tx.Get(&channel, `
 		INSERT INTO channels (server_id, name, type) 
 		VALUES ($1, $2, $3) 
-		RETURNING id
-	`, request.ServerID, request.Name, request.Type).Scan(&channelID)
+		RETURNING `+channelColumns,
+		request.ServerID, request.Name, request.Type)
 	if err != nil {
 		http.Error(w, "Failed to create channel", http.StatusInternalServerError)
 		return
 	}
+	err = auditlog.Record(tx, r, channel.ServerID, int64(userID), auditlog.ChannelCreate, channel.ID, auditlog.Diff(nil, channel))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(channel.ServerID), websocket.EventChannelCreate, channel)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message":    "channel created successfully",
-		"channel_id": fmt.Sprintf("%d", channelID),
+		"channel_id": fmt.Sprintf("%d", channel.ID),
 	})
 }
 
+// maxSlowmodeSeconds is the longest slow mode interval, six hours.
+const maxSlowmodeSeconds = 21600
+
+type UpdateChannelRequest struct {
+	Name            *string `json:"name"`
+	SlowmodeSeconds *int    `json:"slowmode_seconds"`
+}
+
+// handleUpdateChannel renames a channel or changes its slow mode. Fields left
+// out are unchanged.
+func (h *ServerHandler) handleUpdateChannel(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	channelID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	var request UpdateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Name != nil && (*request.Name == "" || len([]rune(*request.Name)) > 50) {
+		http.Error(w, "Channel name must be between 1 and 50 characters", http.StatusBadRequest)
+		return
+	}
+	if request.SlowmodeSeconds != nil && (*request.SlowmodeSeconds < 0 || *request.SlowmodeSeconds > maxSlowmodeSeconds) {
+		http.Error(w, "slowmode_seconds must be between 0 and 21600", http.StatusBadRequest)
+		return
+	}
+
+	var serverID int64
+	err = h.DB.Get(&serverID, "SELECT server_id FROM channels WHERE id = $1", channelID)
+	if err != nil {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageChannels)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage channels permission", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, channel Channel
+	err = tx.Get(&before, "SELECT "+channelColumns+" FROM channels WHERE id = $1 FOR UPDATE", channelID)
+	if err != nil {
+		http.Error(w, "Failed to update channel", http.StatusInternalServerError)
+		return
+	}
+	err = tx.Get(&channel, `
+		UPDATE channels SET
+			name = COALESCE($2, name),
+			slowmode_seconds = COALESCE($3, slowmode_seconds)
+		WHERE id = $1
+		RETURNING `+channelColumns,
+		channelID, request.Name, request.SlowmodeSeconds)
+	if err != nil {
+		log.Printf("Error updating channel: %v", err)
+		http.Error(w, "Failed to update channel", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.ChannelUpdate, channelID, auditlog.Diff(before, channel))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(channel.ServerID), websocket.EventChannelUpdate, channel)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
 func (h *ServerHandler) handleReadMessages(w http.ResponseWriter, r *http.Request) {
 	tokenStr := r.Header.Get("Authorization")
 	userID, err := auth.ValidateToken(tokenStr)
@@ -258,10 +462,16 @@ func (h *ServerHandler) handleReadMessages(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	channelNum, err := strconv.Atoi(channelID)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+
 	var ServerID int64
 	err = h.DB.Get(&ServerID, `
 		SELECT server_id FROM channels WHERE id = $1
-	`, channelID)
+	`, channelNum)
 	if err != nil {
 		http.Error(w, "Channel not found", http.StatusNotFound)
 		return
@@ -293,7 +503,7 @@ func (h *ServerHandler) handleReadMessages(w http.ResponseWriter, r *http.Reques
 
 	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
 
-	filter := bson.M{}
+	filter := bson.M{"channel_id": channelNum}
 	if beforeStr != "" {
 		oid, err := primitive.ObjectIDFromHex(beforeStr)
 		if err != nil {
@@ -323,6 +533,322 @@ func (h *ServerHandler) handleReadMessages(w http.ResponseWriter, r *http.Reques
 	if messages == nil {
 		messages = []ChatMessage{}
 	}
+	if err := h.resolveAuthors(messages, ServerID); err != nil {
+		log.Printf("Error resolving message authors: %v", err)
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
+
+// author is how a user is shown in a server.
+type author struct {
+	ID        int64  `db:"id"`
+	Name      string `db:"name"`
+	AvatarURL string `db:"avatar_url"`
+}
+
+// lookupAuthors returns how the users are shown in the server with one
+// query: the server nickname, else the display name, else the username.
+func (h *ServerHandler) lookupAuthors(serverID int64, userIDs []int64) (map[int64]author, error) {
+	authors := make(map[int64]author, len(userIDs))
+	if len(userIDs) == 0 {
+		return authors, nil
+	}
+	var rows []author
+	err := h.DB.Select(&rows, `
+		SELECT u.id, COALESCE(us.nickname, u.display_name, u.username) AS name, u.avatar_url
+		FROM users u
+		LEFT JOIN user_servers us ON us.user_id = u.id AND us.server_id = $2
+		WHERE u.id = ANY($1)
+	`, pq.Array(userIDs), serverID)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		authors[row.ID] = row
+	}
+	return authors, nil
+}
+
+// resolveAuthors fills in the name and avatar of each message's author.
+// Messages that carry their own name, like webhook posts, are left alone.
+func (h *ServerHandler) resolveAuthors(messages []ChatMessage, serverID int64) error {
+	var userIDs []int64
+	seen := make(map[int64]bool)
+	for _, message := range messages {
+		id := int64(message.UserID)
+		if message.UserName == "" && id != 0 && !seen[id] {
+			seen[id] = true
+			userIDs = append(userIDs, id)
+		}
+	}
+	authors, err := h.lookupAuthors(serverID, userIDs)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if messages[i].UserName != "" {
+			continue
+		}
+		if a, ok := authors[int64(messages[i].UserID)]; ok {
+			messages[i].UserName = a.Name
+			messages[i].AvatarURL = a.AvatarURL
+		}
+	}
+	return nil
+}
+
+type AddBotRequest struct {
+	BotID int64 `json:"bot_id"`
+}
+
+// handleAddBot adds one of the caller's bots to a server the caller administers.
+func (h *ServerHandler) handleAddBot(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	var request AddBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = h.DB.Get(&exists, `
+		SELECT EXISTS (
+			SELECT 1 FROM user_servers 
+			WHERE user_id = $1 AND server_id = $2 AND role IN ('owner', 'admin')
+		)
+	`, userID, serverID)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Forbidden: You are not an admin of this server", http.StatusForbidden)
+		return
+	}
+
+	err = h.DB.Get(&exists, `
+		SELECT EXISTS (
+			SELECT 1 FROM users WHERE id = $1 AND is_bot AND bot_owner_id = $2
+		)
+	`, request.BotID, userID)
+	if err != nil {
+		http.Error(w, "Failed to verify bot ownership", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO user_servers (user_id, server_id, role) VALUES ($1, $2, 'member')
+		ON CONFLICT (user_id, server_id) DO NOTHING
+	`, request.BotID, serverID)
+	if err != nil {
+		http.Error(w, "Failed to add bot to server", http.StatusInternalServerError)
+		return
+	}
+	added, _ := res.RowsAffected()
+	if added > 0 {
+		err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.BotAdd, request.BotID, nil)
+		if err != nil {
+			http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	if added > 0 {
+		h.Hub.Broadcast(int(serverID), websocket.EventMemberJoin, map[string]interface{}{
+			"server_id": serverID,
+			"user_id":   request.BotID,
+			"role":      "member",
+			"bot":       true,
+		})
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "bot added to server",
+	})
+}
+
+const (
+	maxServerNameLength        = 100
+	maxServerDescriptionLength = 300
+)
+
+type UpdateServerRequest struct {
+	Name                 *string `json:"name"`
+	Description          *string `json:"description"`
+	IconURL              *string `json:"icon_url"`
+	DefaultNotifications *string `json:"default_notifications"`
+	// SystemChannelID is where system messages are posted; 0 turns them off.
+	SystemChannelID *int64    `json:"system_channel_id"`
+	LinkPreviews    *bool     `json:"link_previews"`
+	Public          *bool     `json:"public"`
+	Tags            *[]string `json:"tags"`
+	Language        *string   `json:"language"`
+}
+
+func (r *UpdateServerRequest) validate() error {
+	if r.Name != nil {
+		*r.Name = strings.TrimSpace(*r.Name)
+		if *r.Name == "" || len([]rune(*r.Name)) > maxServerNameLength {
+			return errors.New("name must be between 1 and 100 characters")
+		}
+	}
+	if r.Description != nil && len([]rune(*r.Description)) > maxServerDescriptionLength {
+		return errors.New("description must be at most 300 characters")
+	}
+	// Icons are set by uploading them, which strips their metadata; only
+	// those, or none, are accepted here.
+	if r.IconURL != nil && *r.IconURL != "" && !images.ValidURL(*r.IconURL) {
+		return errors.New("icon_url must be empty or an uploaded image")
+	}
+	if r.DefaultNotifications != nil && *r.DefaultNotifications != "all_messages" && *r.DefaultNotifications != "only_mentions" {
+		return errors.New("default_notifications must be 'all_messages' or 'only_mentions'")
+	}
+	if r.Tags != nil {
+		tags, err := discovery.NormalizeTags(*r.Tags)
+		if err != nil {
+			return err
+		}
+		r.Tags = &tags
+	}
+	if r.Language != nil && !discovery.ValidLanguage(*r.Language) {
+		return errors.New("language must be a language code such as 'en' or 'pt-BR'")
+	}
+	return nil
+}
+
+// tagsParam passes tags to a query, as NULL when they are left out.
+func tagsParam(tags *[]string) pq.StringArray {
+	if tags == nil {
+		return nil
+	}
+	return pq.StringArray(*tags)
+}
+
+// handleUpdateServer changes server settings. Fields left out are unchanged.
+func (h *ServerHandler) handleUpdateServer(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	serverID, err := strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return
+	}
+	var request UpdateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageServer)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage server permission", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, server Server
+	err = tx.Get(&before, "SELECT "+serverColumns+" FROM servers WHERE id = $1 FOR UPDATE", serverID)
+	if err != nil {
+		http.Error(w, "Failed to update server", http.StatusInternalServerError)
+		return
+	}
+	if request.SystemChannelID != nil && *request.SystemChannelID != 0 {
+		var valid bool
+		err = tx.Get(&valid, `
+			SELECT EXISTS (SELECT 1 FROM channels WHERE id = $1 AND server_id = $2 AND type = 'text')
+		`, *request.SystemChannelID, serverID)
+		if err != nil {
+			http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "system_channel_id must be a text channel of this server", http.StatusBadRequest)
+			return
+		}
+	}
+	err = tx.Get(&server, `
+		UPDATE servers SET
+			name = COALESCE($2, name),
+			description = COALESCE($3, description),
+			icon_url = COALESCE($4, icon_url),
+			default_notifications = COALESCE($5, default_notifications),
+			system_channel_id = CASE WHEN $6::INT IS NULL THEN system_channel_id ELSE NULLIF($6::INT, 0) END,
+			link_previews = COALESCE($7, link_previews),
+			public = COALESCE($8, public),
+			tags = COALESCE($9, tags),
+			language = COALESCE($10, language)
+		WHERE id = $1
+		RETURNING `+serverColumns,
+		serverID, request.Name, request.Description, request.IconURL, request.DefaultNotifications,
+		request.SystemChannelID, request.LinkPreviews, request.Public, tagsParam(request.Tags), request.Language)
+	if err != nil {
+		log.Printf("Error updating server: %v", err)
+		http.Error(w, "Failed to update server", http.StatusInternalServerError)
+		return
+	}
+	if server.Public && (server.Description == "" || len(server.Tags) == 0) {
+		http.Error(w, "Public servers need a description and at least one tag", http.StatusBadRequest)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.ServerUpdate, serverID, auditlog.Diff(before, server))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Broadcast(int(serverID), websocket.EventServerUpdate, server)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
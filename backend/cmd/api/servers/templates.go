@@ -0,0 +1,448 @@
+package servers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+)
+
+const maxTemplateDescriptionLength = 120
+
+// TemplateChannel is a channel as saved in a template.
+type TemplateChannel struct {
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	SlowmodeSeconds int    `json:"slowmode_seconds"`
+}
+
+// TemplateSnapshot is the structure and settings of a server, without its
+// messages or members. Channels are in creation order, and the system channel
+// is referred to by its index since a new server gets new channel IDs.
+type TemplateSnapshot struct {
+	Description          string            `json:"description"`
+	IconURL              string            `json:"icon_url"`
+	DefaultNotifications string            `json:"default_notifications"`
+	LinkPreviews         bool              `json:"link_previews"`
+	SystemChannel        *int              `json:"system_channel"`
+	Channels             []TemplateChannel `json:"channels"`
+}
+
+func (s TemplateSnapshot) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *TemplateSnapshot) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("snapshot: expected []byte")
+	}
+	return json.Unmarshal(b, s)
+}
+
+// defaultSnapshot is what a server created without a template starts as.
+var defaultSnapshot = TemplateSnapshot{
+	DefaultNotifications: "all_messages",
+	LinkPreviews:         true,
+	Channels:             []TemplateChannel{{Name: "text", Type: "text"}},
+}
+
+// Template is a saved server structure that anyone with its code can create
+// servers from. Syncing it with its server bumps the version.
+type Template struct {
+	ID          int64            `db:"id" json:"id"`
+	Code        string           `db:"code" json:"code"`
+	ServerID    int64            `db:"server_id" json:"server_id"`
+	CreatedBy   *int64           `db:"created_by" json:"created_by"`
+	Name        string           `db:"name" json:"name"`
+	Description string           `db:"description" json:"description"`
+	Version     int              `db:"version" json:"version"`
+	Snapshot    TemplateSnapshot `db:"snapshot" json:"snapshot"`
+	UsageCount  int              `db:"usage_count" json:"usage_count"`
+	CreatedAt   time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time        `db:"updated_at" json:"updated_at"`
+}
+
+const templateColumns = "id, code, server_id, created_by, name, description, version, snapshot, usage_count, created_at, updated_at"
+
+type TemplateRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+func (r *TemplateRequest) validate() error {
+	if r.Name != nil {
+		*r.Name = strings.TrimSpace(*r.Name)
+		if *r.Name == "" || len([]rune(*r.Name)) > maxServerNameLength {
+			return errors.New("name must be between 1 and 100 characters")
+		}
+	}
+	if r.Description != nil && len([]rune(*r.Description)) > maxTemplateDescriptionLength {
+		return errors.New("description must be at most 120 characters")
+	}
+	return nil
+}
+
+func newTemplateCode() (string, error) {
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// snapshotServer reads the current structure and settings of a server.
+func snapshotServer(q sqlx.Queryer, serverID int64) (TemplateSnapshot, error) {
+	var server Server
+	if err := sqlx.Get(q, &server, "SELECT "+serverColumns+" FROM servers WHERE id = $1", serverID); err != nil {
+		return TemplateSnapshot{}, err
+	}
+	var channels []Channel
+	err := sqlx.Select(q, &channels, "SELECT "+channelColumns+" FROM channels WHERE server_id = $1 ORDER BY id", serverID)
+	if err != nil {
+		return TemplateSnapshot{}, err
+	}
+
+	snapshot := TemplateSnapshot{
+		Description:          server.Description,
+		IconURL:              server.IconURL,
+		DefaultNotifications: server.DefaultNotifications,
+		LinkPreviews:         server.LinkPreviews,
+		Channels:             make([]TemplateChannel, 0, len(channels)),
+	}
+	for i, channel := range channels {
+		snapshot.Channels = append(snapshot.Channels, TemplateChannel{
+			Name:            channel.Name,
+			Type:            channel.Type,
+			SlowmodeSeconds: channel.SlowmodeSeconds,
+		})
+		if server.SystemChannelID != nil && *server.SystemChannelID == channel.ID {
+			index := i
+			snapshot.SystemChannel = &index
+		}
+	}
+	return snapshot, nil
+}
+
+// createServer creates a server owned by ownerID with the structure of the
+// snapshot, recording it in the new server's audit log.
+func createServer(tx *sqlx.Tx, r *http.Request, ownerID int64, name string, snapshot TemplateSnapshot) (Server, error) {
+	var server Server
+	err := tx.Get(&server, `
+		INSERT INTO servers (name, owner_id, description, icon_url, default_notifications, link_previews)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+serverColumns,
+		name, ownerID, snapshot.Description, snapshot.IconURL, snapshot.DefaultNotifications, snapshot.LinkPreviews)
+	if err != nil {
+		return Server{}, fmt.Errorf("inserting server: %w", err)
+	}
+
+	for i, channel := range snapshot.Channels {
+		var channelID int64
+		err = tx.Get(&channelID, `
+			INSERT INTO channels (server_id, name, type, slowmode_seconds) VALUES ($1, $2, $3, $4) RETURNING id
+		`, server.ID, channel.Name, channel.Type, channel.SlowmodeSeconds)
+		if err != nil {
+			return Server{}, fmt.Errorf("inserting channel %q: %w", channel.Name, err)
+		}
+		if snapshot.SystemChannel != nil && *snapshot.SystemChannel == i && channel.Type == "text" {
+			err = tx.Get(&server, "UPDATE servers SET system_channel_id = $2 WHERE id = $1 RETURNING "+serverColumns, server.ID, channelID)
+			if err != nil {
+				return Server{}, fmt.Errorf("setting system channel: %w", err)
+			}
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO user_servers (user_id, server_id, role) VALUES ($1, $2, $3)", ownerID, server.ID, "owner")
+	if err != nil {
+		return Server{}, fmt.Errorf("linking owner: %w", err)
+	}
+
+	err = auditlog.Record(tx, r, server.ID, ownerID, auditlog.ServerCreate, server.ID, auditlog.Diff(nil, server))
+	if err != nil {
+		return Server{}, fmt.Errorf("recording audit log entry: %w", err)
+	}
+	return server, nil
+}
+
+// templateOwner checks that the user owns the server whose templates are
+// being managed. Templates copy no messages or members, so unlike transfers
+// and deletion this doesn't ask for a two-factor code.
+func (h *ServerHandler) templateOwner(w http.ResponseWriter, r *http.Request) (userID, serverID int64, ok bool) {
+	claimedID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	serverID, err = strconv.ParseInt(mux.Vars(r)["server_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server_id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	var ownerID int64
+	err = h.DB.Get(&ownerID, "SELECT owner_id FROM servers WHERE id = $1", serverID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return 0, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch server", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if ownerID != int64(claimedID) {
+		http.Error(w, "Forbidden: only the owner can manage templates", http.StatusForbidden)
+		return 0, 0, false
+	}
+	return int64(claimedID), serverID, true
+}
+
+// handleCreateTemplate saves the server's current structure as its template.
+func (h *ServerHandler) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.templateOwner(w, r)
+	if !ok {
+		return
+	}
+	var request TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Name == nil {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	description := ""
+	if request.Description != nil {
+		description = *request.Description
+	}
+	code, err := newTemplateCode()
+	if err != nil {
+		http.Error(w, "Failed to generate template code", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	snapshot, err := snapshotServer(tx, serverID)
+	if err != nil {
+		log.Printf("Error saving template of server %d: %v", serverID, err)
+		http.Error(w, "Failed to read server structure", http.StatusInternalServerError)
+		return
+	}
+	var template Template
+	err = tx.Get(&template, `
+		INSERT INTO server_templates (code, server_id, created_by, name, description, snapshot)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+templateColumns,
+		code, serverID, userID, *request.Name, description, snapshot)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		http.Error(w, "Server already has a template; sync it instead", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error creating template: %v", err)
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, userID, auditlog.TemplateCreate, template.ID, auditlog.Diff(nil, template))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// handleListTemplates returns the server's templates.
+func (h *ServerHandler) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	_, serverID, ok := h.templateOwner(w, r)
+	if !ok {
+		return
+	}
+	templates := []Template{}
+	err := h.DB.Select(&templates, "SELECT "+templateColumns+" FROM server_templates WHERE server_id = $1", serverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// handleSyncTemplate replaces a template's snapshot with the server's current
+// structure as a new version. The code stays the same.
+func (h *ServerHandler) handleSyncTemplate(w http.ResponseWriter, r *http.Request) {
+	h.changeTemplate(w, r, func(tx *sqlx.Tx, serverID int64, code string) (Template, error) {
+		snapshot, err := snapshotServer(tx, serverID)
+		if err != nil {
+			return Template{}, err
+		}
+		var template Template
+		err = tx.Get(&template, `
+			UPDATE server_templates SET snapshot = $3, version = version + 1, updated_at = NOW()
+			WHERE server_id = $1 AND code = $2
+			RETURNING `+templateColumns,
+			serverID, code, snapshot)
+		return template, err
+	})
+}
+
+// handleUpdateTemplate renames a template or changes its description.
+func (h *ServerHandler) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var request TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.changeTemplate(w, r, func(tx *sqlx.Tx, serverID int64, code string) (Template, error) {
+		var template Template
+		err := tx.Get(&template, `
+			UPDATE server_templates SET
+				name = COALESCE($3, name),
+				description = COALESCE($4, description),
+				updated_at = NOW()
+			WHERE server_id = $1 AND code = $2
+			RETURNING `+templateColumns,
+			serverID, code, request.Name, request.Description)
+		return template, err
+	})
+}
+
+// changeTemplate runs update on a template of the server in a transaction and
+// records the difference.
+func (h *ServerHandler) changeTemplate(w http.ResponseWriter, r *http.Request, update func(tx *sqlx.Tx, serverID int64, code string) (Template, error)) {
+	userID, serverID, ok := h.templateOwner(w, r)
+	if !ok {
+		return
+	}
+	code := mux.Vars(r)["code"]
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before Template
+	err = tx.Get(&before, `
+		SELECT `+templateColumns+` FROM server_templates WHERE server_id = $1 AND code = $2 FOR UPDATE
+	`, serverID, code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch template", http.StatusInternalServerError)
+		return
+	}
+	template, err := update(tx, serverID, code)
+	if err != nil {
+		log.Printf("Error updating template %s: %v", code, err)
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, userID, auditlog.TemplateUpdate, template.ID, auditlog.Diff(before, template))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// handleDeleteTemplate deletes a template. Servers created from it are not
+// affected.
+func (h *ServerHandler) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, serverID, ok := h.templateOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var template Template
+	err = tx.Get(&template, `
+		DELETE FROM server_templates WHERE server_id = $1 AND code = $2 RETURNING `+templateColumns,
+		serverID, mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, userID, auditlog.TemplateDelete, template.ID, auditlog.Diff(template, nil))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetTemplate shows what a server created from a template would look
+// like. The code is all that's needed, so templates can be shared as links.
+func (h *ServerHandler) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.ValidateToken(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var template Template
+	err := h.DB.Get(&template, "SELECT "+templateColumns+" FROM server_templates WHERE code = $1", mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
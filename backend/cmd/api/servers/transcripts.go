@@ -0,0 +1,260 @@
+package servers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mograby3500/mini-discord/markdown"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Transcript formats.
+const (
+	FormatJSONL = "jsonl"
+	FormatHTML  = "html"
+	FormatCSV   = "csv"
+)
+
+var transcriptContentTypes = map[string]string{
+	FormatJSONL: "application/x-ndjson",
+	FormatHTML:  "text/html; charset=utf-8",
+	FormatCSV:   "text/csv; charset=utf-8",
+}
+
+// TranscriptAuthor is who wrote an exported message.
+type TranscriptAuthor struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Bot       bool   `json:"bot"`
+	WebhookID int    `json:"webhook_id,omitempty"`
+}
+
+// TranscriptMessage is a message as exported. Optional parts are left out
+// when a message has none.
+type TranscriptMessage struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	ChannelID   int                `bson:"channel_id" json:"channel_id"`
+	ChannelName string             `bson:"-" json:"channel_name"`
+	UserID      int                `bson:"user_id" json:"-"`
+	UserName    string             `bson:"user_name,omitempty" json:"-"`
+	AvatarURL   string             `bson:"avatar_url,omitempty" json:"-"`
+	Bot         bool               `bson:"bot,omitempty" json:"-"`
+	WebhookID   int                `bson:"webhook_id,omitempty" json:"-"`
+	Author      TranscriptAuthor   `bson:"-" json:"author"`
+	Content     string             `bson:"content" json:"content"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	EditedAt    *time.Time         `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	Embeds      []bson.M           `bson:"embeds,omitempty" json:"embeds,omitempty"`
+	Attachments []bson.M           `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	Reactions   []bson.M           `bson:"reactions,omitempty" json:"reactions,omitempty"`
+	Interaction *struct {
+		ID     string `bson:"id" json:"id"`
+		Name   string `bson:"name" json:"name"`
+		UserID int    `bson:"user_id" json:"user_id"`
+	} `bson:"interaction,omitempty" json:"interaction,omitempty"`
+}
+
+// TranscriptHeader describes what a transcript covers.
+type TranscriptHeader struct {
+	ServerName  string
+	ChannelName string // empty for whole-server exports
+	After       *time.Time
+	Before      *time.Time
+	GeneratedAt time.Time
+}
+
+// transcriptWriter writes messages in one format. Nothing is buffered beyond
+// what flush writes out, so transcripts of any size stream.
+type transcriptWriter interface {
+	begin(header TranscriptHeader) error
+	write(message *TranscriptMessage) error
+	flush() error
+	end() error
+}
+
+func newTranscriptWriter(format string, w io.Writer) transcriptWriter {
+	switch format {
+	case FormatHTML:
+		return &htmlTranscript{w: w}
+	case FormatCSV:
+		return &csvTranscript{w: csv.NewWriter(w)}
+	default:
+		return &jsonlTranscript{encoder: json.NewEncoder(w)}
+	}
+}
+
+// jsonlTranscript writes one JSON object per line.
+type jsonlTranscript struct {
+	encoder *json.Encoder
+}
+
+func (t *jsonlTranscript) begin(TranscriptHeader) error { return nil }
+func (t *jsonlTranscript) flush() error                 { return nil }
+func (t *jsonlTranscript) end() error                   { return nil }
+
+func (t *jsonlTranscript) write(message *TranscriptMessage) error {
+	return t.encoder.Encode(message)
+}
+
+// csvTranscript writes one row per message, with embeds and the like as JSON.
+type csvTranscript struct {
+	w *csv.Writer
+}
+
+var csvColumns = []string{
+	"id", "created_at", "edited_at", "channel_id", "channel_name",
+	"author_id", "author_name", "bot", "webhook_id", "content",
+	"embeds", "attachments", "reactions",
+}
+
+func (t *csvTranscript) begin(TranscriptHeader) error {
+	return t.w.Write(csvColumns)
+}
+
+func (t *csvTranscript) write(m *TranscriptMessage) error {
+	editedAt := ""
+	if m.EditedAt != nil {
+		editedAt = m.EditedAt.UTC().Format(time.RFC3339)
+	}
+	return t.w.Write([]string{
+		m.ID.Hex(),
+		m.CreatedAt.UTC().Format(time.RFC3339),
+		editedAt,
+		strconv.Itoa(m.ChannelID),
+		csvCell(m.ChannelName),
+		strconv.FormatInt(m.Author.ID, 10),
+		csvCell(m.Author.Name),
+		strconv.FormatBool(m.Author.Bot),
+		strconv.Itoa(m.Author.WebhookID),
+		csvCell(m.Content),
+		csvJSON(m.Embeds),
+		csvJSON(m.Attachments),
+		csvJSON(m.Reactions),
+	})
+}
+
+func (t *csvTranscript) flush() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+func (t *csvTranscript) end() error {
+	return t.flush()
+}
+
+// csvCell keeps spreadsheets from running user content as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvJSON(v []bson.M) string {
+	if len(v) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// htmlTranscript writes a standalone page. Styles are inline and avatars are
+// absolute links back to this server.
+type htmlTranscript struct {
+	w io.Writer
+	// sections is set for whole-server exports, which get a heading per
+	// channel.
+	sections bool
+	channel  int
+}
+
+var transcriptTemplates = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 UTC") },
+	"content": func(s string) template.HTML {
+		parsed, err := markdown.Parse(s)
+		if err != nil {
+			return template.HTML(template.HTMLEscapeString(s))
+		}
+		return template.HTML(markdown.HTML(parsed.AST))
+	},
+}).Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.ServerName}}{{if .ChannelName}} – #{{.ChannelName}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #313338; color: #dbdee1; margin: 0; padding: 24px; }
+header { border-bottom: 1px solid #4e5058; margin-bottom: 16px; }
+h1 { font-size: 20px; margin: 0 0 4px; }
+h2 { font-size: 16px; margin: 24px 0 8px; color: #f2f3f5; }
+.meta { color: #949ba4; font-size: 12px; }
+.message { display: flex; gap: 12px; padding: 4px 0; }
+.avatar { width: 40px; height: 40px; border-radius: 50%; background: #5865f2; flex-shrink: 0; }
+.author { font-weight: 600; color: #f2f3f5; }
+.tag { background: #5865f2; color: #fff; border-radius: 3px; font-size: 10px; padding: 1px 4px; margin-left: 4px; }
+.content { overflow-wrap: anywhere; }
+.description { white-space: pre-wrap; }
+.embed { border-left: 4px solid #1e1f22; background: #2b2d31; border-radius: 4px; padding: 8px 12px; margin-top: 4px; max-width: 520px; }
+.spoiler { background: #1e1f22; color: transparent; }
+.spoiler:hover { color: inherit; }
+code, pre { background: #2b2d31; border-radius: 3px; }
+pre { padding: 8px; white-space: pre-wrap; }
+blockquote { border-left: 4px solid #4e5058; margin: 0; padding-left: 8px; }
+a { color: #00a8fc; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.ServerName}}{{if .ChannelName}} – #{{.ChannelName}}{{end}}</h1>
+<p class="meta">Exported {{time .GeneratedAt}}{{if .After}} · after {{time .After}}{{end}}{{if .Before}} · before {{time .Before}}{{end}}</p>
+</header>
+{{end}}
+{{define "channel"}}<h2>#{{.}}</h2>
+{{end}}
+{{define "message"}}<div class="message" id="m-{{.ID.Hex}}">
+{{if .Author.AvatarURL}}<img class="avatar" src="{{.Author.AvatarURL}}" alt="">{{else}}<div class="avatar"></div>{{end}}
+<div>
+<div><span class="author">{{.Author.Name}}</span>{{if .Author.Bot}}<span class="tag">BOT</span>{{end}} <span class="meta">{{time .CreatedAt}}{{if .EditedAt}} (edited){{end}}</span></div>
+{{if .Interaction}}<div class="meta">used /{{.Interaction.Name}}</div>{{end}}
+<div class="content">{{content .Content}}</div>
+{{range .Embeds}}<div class="embed">{{with index . "title"}}<div class="author">{{.}}</div>{{end}}{{with index . "description"}}<div class="description">{{.}}</div>{{end}}</div>
+{{end}}{{range .Attachments}}<div class="meta">Attachment: {{index . "filename"}}</div>
+{{end}}{{if .Reactions}}<div class="meta">{{range .Reactions}}{{index . "emoji"}} {{index . "count"}} {{end}}</div>{{end}}
+</div>
+</div>
+{{end}}
+{{define "end"}}</body>
+</html>
+{{end}}`))
+
+func (t *htmlTranscript) begin(header TranscriptHeader) error {
+	t.sections = header.ChannelName == ""
+	return transcriptTemplates.ExecuteTemplate(t.w, "begin", header)
+}
+
+func (t *htmlTranscript) write(message *TranscriptMessage) error {
+	if t.sections && message.ChannelID != t.channel {
+		t.channel = message.ChannelID
+		if err := transcriptTemplates.ExecuteTemplate(t.w, "channel", message.ChannelName); err != nil {
+			return err
+		}
+	}
+	return transcriptTemplates.ExecuteTemplate(t.w, "message", message)
+}
+
+func (t *htmlTranscript) flush() error { return nil }
+
+func (t *htmlTranscript) end() error {
+	return transcriptTemplates.ExecuteTemplate(t.w, "end", nil)
+}
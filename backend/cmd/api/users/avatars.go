@@ -0,0 +1,60 @@
+package users
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/images"
+)
+
+// handleUploadAvatar sets the caller's avatar to an uploaded image.
+func (h *UserHandler) handleUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	data, err := images.Read(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := images.Store(h.Storage, data)
+	if images.IsInvalid(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error storing avatar: %v", err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+
+	h.setAvatar(w, int64(userID), images.URL(key, images.DefaultSize))
+}
+
+// handleDeleteAvatar removes the caller's avatar.
+func (h *UserHandler) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	h.setAvatar(w, int64(userID), "")
+}
+
+func (h *UserHandler) setAvatar(w http.ResponseWriter, userID int64, avatarURL string) {
+	var profile Profile
+	err := h.DB.Get(&profile, "UPDATE users SET avatar_url = $2 WHERE id = $1 RETURNING "+profileColumns, userID, avatarURL)
+	if err != nil {
+		log.Printf("Error updating avatar: %v", err)
+		http.Error(w, "Failed to update avatar", http.StatusInternalServerError)
+		return
+	}
+	h.broadcastProfile(profile)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
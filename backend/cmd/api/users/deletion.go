@@ -0,0 +1,377 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// deletionGracePeriod is how long a deletion can be cancelled.
+	deletionGracePeriod = 14 * 24 * time.Hour
+	// deletionInterval is how often accounts due for deletion are deleted.
+	deletionInterval = time.Minute
+	// deletedUserName is shown in place of deleted users.
+	deletedUserName = "Deleted User"
+)
+
+// Deletion is the state of a user's account deletion.
+type Deletion struct {
+	RequestedAt  *time.Time `json:"requested_at"`
+	ScheduledFor *time.Time `json:"scheduled_for"`
+	KeepMessages bool       `json:"keep_messages"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	// KeepMessages leaves the user's messages in place, attributed to
+	// "Deleted User". Otherwise they are removed.
+	KeepMessages bool `json:"keep_messages"`
+}
+
+func newDeletion(requestedAt *time.Time, keepMessages bool) Deletion {
+	deletion := Deletion{RequestedAt: requestedAt, KeepMessages: keepMessages}
+	if requestedAt != nil {
+		scheduledFor := requestedAt.Add(deletionGracePeriod)
+		deletion.ScheduledFor = &scheduledFor
+	}
+	return deletion
+}
+
+// handleGetDeletion returns whether the caller's account is scheduled for
+// deletion.
+func (h *UserHandler) handleGetDeletion(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var user struct {
+		RequestedAt  *time.Time `db:"deletion_requested_at"`
+		KeepMessages bool       `db:"deletion_keeps_messages"`
+	}
+	err = h.DB.Get(&user, "SELECT deletion_requested_at, deletion_keeps_messages FROM users WHERE id = $1", int64(userID))
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newDeletion(user.RequestedAt, user.KeepMessages))
+}
+
+// handleScheduleDeletion schedules the caller's account for deletion after a
+// grace period, during which it keeps working and the deletion can be
+// cancelled. It needs the password and, if enabled, a two-factor code.
+func (h *UserHandler) handleScheduleDeletion(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var request DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var user struct {
+		Password string `db:"password"`
+		IsBot    bool   `db:"is_bot"`
+	}
+	if err := h.DB.Get(&user, "SELECT password, is_bot FROM users WHERE id = $1", int64(userID)); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if user.IsBot {
+		http.Error(w, "Bots are deleted by their owner", http.StatusForbidden)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.Password)) != nil {
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	}
+	if auth.WriteMFAError(w, auth.RequireMFA(r, int(userID))) {
+		return
+	}
+
+	var requestedAt time.Time
+	err = h.DB.Get(&requestedAt, `
+		UPDATE users
+		SET deletion_requested_at = COALESCE(deletion_requested_at, NOW()), deletion_keeps_messages = $2
+		WHERE id = $1
+		RETURNING deletion_requested_at
+	`, int64(userID), request.KeepMessages)
+	if err != nil {
+		log.Printf("Error scheduling deletion: %v", err)
+		http.Error(w, "Failed to schedule deletion", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(newDeletion(&requestedAt, request.KeepMessages))
+}
+
+// handleCancelDeletion cancels a scheduled deletion.
+func (h *UserHandler) handleCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	res, err := h.DB.Exec(`
+		UPDATE users SET deletion_requested_at = NULL
+		WHERE id = $1 AND deletion_requested_at IS NOT NULL AND deleted_at IS NULL
+	`, int64(userID))
+	if err != nil {
+		http.Error(w, "Failed to cancel deletion", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Account is not scheduled for deletion", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteScheduledAccounts periodically deletes accounts whose grace period
+// has ended.
+func (h *UserHandler) DeleteScheduledAccounts() {
+	ticker := time.NewTicker(deletionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var due []int64
+		err := h.DB.Select(&due, `
+			SELECT id FROM users
+			WHERE deletion_requested_at <= NOW() - $1::INT * INTERVAL '1 second' AND deleted_at IS NULL
+			ORDER BY deletion_requested_at
+		`, int(deletionGracePeriod.Seconds()))
+		if err != nil {
+			log.Println("Account deletion error:", err)
+			continue
+		}
+		for _, userID := range due {
+			if err := h.deleteAccount(userID); err != nil {
+				log.Printf("Error deleting account %d: %v", userID, err)
+			}
+		}
+		h.purgeDeletedMessages()
+	}
+}
+
+// purgeDeletedMessages removes the messages of deleted accounts that didn't
+// keep them. Purges are queued in Postgres, so they survive restarts.
+func (h *UserHandler) purgeDeletedMessages() {
+	var userIDs []int64
+	if err := h.DB.Select(&userIDs, "SELECT user_id FROM user_purges ORDER BY created_at"); err != nil {
+		log.Println("User purge error:", err)
+		return
+	}
+	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+	for _, userID := range userIDs {
+		res, err := collection.DeleteMany(context.Background(), bson.M{"user_id": userID, "webhook_id": bson.M{"$exists": false}})
+		if err != nil {
+			log.Printf("Error purging messages of user %d: %v", userID, err)
+			continue
+		}
+		if _, err := h.DB.Exec("DELETE FROM user_purges WHERE user_id = $1", userID); err != nil {
+			log.Printf("Error finishing purge of user %d: %v", userID, err)
+			continue
+		}
+		log.Printf("Purged %d messages of deleted user %d", res.DeletedCount, userID)
+	}
+}
+
+// membership is a user_servers row removed by an account deletion.
+type membership struct {
+	UserID   int64 `db:"user_id" json:"user_id"`
+	ServerID int64 `db:"server_id" json:"server_id"`
+}
+
+// deleteAccount anonymizes a user. Owned servers go to another member, or are
+// deleted if there is none; memberships, sessions, bots and exports are
+// removed. The row itself stays so that messages the user kept, audit
+// log entries and the like still point at someone.
+func (h *UserHandler) deleteAccount(userID int64) error {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var user struct {
+		Due          bool `db:"due"`
+		KeepMessages bool `db:"deletion_keeps_messages"`
+	}
+	err = tx.Get(&user, `
+		SELECT deletion_requested_at IS NOT NULL AND deleted_at IS NULL AS due, deletion_keeps_messages
+		FROM users WHERE id = $1
+		FOR UPDATE
+	`, userID)
+	if err != nil {
+		return err
+	}
+	if !user.Due {
+		// Cancelled since it was picked up, or already deleted.
+		return nil
+	}
+
+	type transfer struct {
+		ServerID int64
+		OwnerID  int64
+	}
+	var transfers []transfer
+	type removal struct {
+		ServerID   int
+		ChannelIDs []int
+	}
+	var removals []removal
+
+	var owned []int64
+	if err := tx.Select(&owned, "SELECT id FROM servers WHERE owner_id = $1 ORDER BY id FOR UPDATE", userID); err != nil {
+		return err
+	}
+	for _, serverID := range owned {
+		// Prefer admins, then whoever joined first, and avoid members who
+		// are leaving themselves.
+		var successor int64
+		err := tx.Get(&successor, `
+			SELECT us.user_id FROM user_servers us
+			JOIN users u ON u.id = us.user_id
+			WHERE us.server_id = $1 AND us.user_id <> $2 AND NOT u.is_bot
+			ORDER BY u.deletion_requested_at IS NOT NULL, us.role = 'admin' DESC, us.joined_at, us.user_id
+			LIMIT 1
+		`, serverID, userID)
+		if err == sql.ErrNoRows {
+			var channelIDs []int
+			if err := tx.Select(&channelIDs, "SELECT id FROM channels WHERE server_id = $1", serverID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM servers WHERE id = $1", serverID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("INSERT INTO server_purges (server_id) VALUES ($1) ON CONFLICT DO NOTHING", serverID); err != nil {
+				return err
+			}
+			removals = append(removals, removal{ServerID: int(serverID), ChannelIDs: channelIDs})
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE servers SET owner_id = $2 WHERE id = $1", serverID, successor); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE user_servers SET role = 'owner' WHERE server_id = $1 AND user_id = $2", serverID, successor); err != nil {
+			return err
+		}
+		changes := auditlog.Changes{{Key: "owner_id", Old: userID, New: successor}}
+		if err := auditlog.Record(tx, nil, serverID, userID, auditlog.ServerOwnerTransfer, serverID, changes); err != nil {
+			return err
+		}
+		transfers = append(transfers, transfer{ServerID: serverID, OwnerID: successor})
+	}
+
+	// The user's bots go with them.
+	var botIDs []int64
+	if err := tx.Select(&botIDs, "SELECT id FROM users WHERE bot_owner_id = $1", userID); err != nil {
+		return err
+	}
+	accountIDs := append([]int64{userID}, botIDs...)
+	var left []membership
+	err = tx.Select(&left, `
+		DELETE FROM user_servers WHERE user_id = ANY($1) RETURNING user_id, server_id
+	`, pq.Array(accountIDs))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE bot_owner_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"sessions", "email_tokens", "mfa_backup_codes", "failed_logins"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+			return err
+		}
+	}
+	var exportKeys []string
+	err = tx.Select(&exportKeys, `
+		DELETE FROM data_exports WHERE user_id = $1 AND storage_key IS NOT NULL RETURNING storage_key
+	`, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM data_exports WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	// Messages live in Mongo and are removed in the background.
+	if !user.KeepMessages {
+		if _, err := tx.Exec("INSERT INTO user_purges (user_id) VALUES ($1) ON CONFLICT DO NOTHING", userID); err != nil {
+			return err
+		}
+	}
+
+	// The username and email have to stay unique, so they are derived from the
+	// ID. An empty password hash never matches, so the account can't be used.
+	_, err = tx.Exec(`
+		UPDATE users SET
+			username = 'deleted_user_' || id,
+			email = 'deleted-' || id || '@deleted.invalid',
+			password = '',
+			email_verified = FALSE,
+			totp_secret = NULL,
+			totp_enabled = FALSE,
+			display_name = $2,
+			avatar_url = '',
+			bio = '',
+			banner_color = NULL,
+			pronouns = '',
+			deleted_at = NOW()
+		WHERE id = $1
+	`, userID, deletedUserName)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, id := range accountIDs {
+		h.Hub.DisconnectUser(int(id))
+	}
+	for _, key := range exportKeys {
+		if err := h.Storage.Delete(key); err != nil {
+			log.Printf("Error deleting export %s: %v", key, err)
+		}
+	}
+	for _, t := range transfers {
+		h.Hub.Broadcast(int(t.ServerID), websocket.EventServerUpdate, map[string]int64{"id": t.ServerID, "owner_id": t.OwnerID})
+		h.Hub.Broadcast(int(t.ServerID), websocket.EventMemberUpdate, map[string]interface{}{
+			"user_id": t.OwnerID, "server_id": t.ServerID, "role": "owner",
+		})
+	}
+	for _, m := range left {
+		h.Hub.Broadcast(int(m.ServerID), websocket.EventMemberLeave, m)
+	}
+	for _, removed := range removals {
+		h.Hub.DeleteServer(removed.ServerID, removed.ChannelIDs)
+	}
+	log.Printf("Deleted account %d", userID)
+	return nil
+}
@@ -0,0 +1,470 @@
+package users
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// exportInterval is how often queued exports are picked up.
+	exportInterval = 5 * time.Second
+	// exportCooldown is how long a user waits between exports.
+	exportCooldown = 24 * time.Hour
+	// exportRetention is how long a finished export can be downloaded.
+	exportRetention = 7 * 24 * time.Hour
+	// exportTimeout is how long an export may run before it is considered
+	// abandoned, e.g. by a restart, and picked up again.
+	exportTimeout = 10 * time.Minute
+	// exportFileName is the name exports are stored under.
+	exportFileName = "export.zip"
+)
+
+// Export statuses.
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+	ExportExpired = "expired"
+)
+
+// Export is a "download my data" request.
+type Export struct {
+	ID          int64      `db:"id" json:"id"`
+	UserID      int64      `db:"user_id" json:"-"`
+	Status      string     `db:"status" json:"status"`
+	StorageKey  *string    `db:"storage_key" json:"-"`
+	SizeBytes   *int64     `db:"size_bytes" json:"size_bytes"`
+	Error       *string    `db:"error" json:"-"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at"`
+	ExpiresAt   *time.Time `db:"expires_at" json:"expires_at"`
+	// DownloadURL is set once the export is ready.
+	DownloadURL string `db:"-" json:"download_url,omitempty"`
+}
+
+const exportColumns = "id, user_id, status, storage_key, size_bytes, error, created_at, completed_at, expires_at"
+
+func (e *Export) setDownloadURL() {
+	if e.Status == ExportReady {
+		e.DownloadURL = fmt.Sprintf("/users/@me/exports/%d/download", e.ID)
+	}
+}
+
+// handleCreateExport queues an archive of the caller's data. Users can ask for
+// one export a day.
+func (h *UserHandler) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the user so that concurrent requests can't both pass the check.
+	var isBot bool
+	if err := tx.Get(&isBot, "SELECT is_bot FROM users WHERE id = $1 FOR UPDATE", int64(userID)); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if isBot {
+		http.Error(w, "Bots can't export data", http.StatusForbidden)
+		return
+	}
+	var last time.Time
+	err = tx.Get(&last, `
+		SELECT created_at FROM data_exports
+		WHERE user_id = $1 AND status <> 'failed'
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, int64(userID))
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to fetch exports", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && time.Since(last) < exportCooldown {
+		retryAfter := exportCooldown - time.Since(last)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "You can request one export a day", http.StatusTooManyRequests)
+		return
+	}
+
+	var export Export
+	err = tx.Get(&export, "INSERT INTO data_exports (user_id) VALUES ($1) RETURNING "+exportColumns, int64(userID))
+	if err != nil {
+		log.Printf("Error creating export: %v", err)
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+// handleListExports returns the caller's exports, newest first.
+func (h *UserHandler) handleListExports(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	exports := []Export{}
+	err = h.DB.Select(&exports, `
+		SELECT `+exportColumns+` FROM data_exports
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, int64(userID))
+	if err != nil {
+		http.Error(w, "Failed to fetch exports", http.StatusInternalServerError)
+		return
+	}
+	for i := range exports {
+		exports[i].setDownloadURL()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exports)
+}
+
+// handleDownloadExport sends a finished export.
+func (h *UserHandler) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	exportID, err := strconv.ParseInt(mux.Vars(r)["export_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid export_id", http.StatusBadRequest)
+		return
+	}
+
+	var export Export
+	err = h.DB.Get(&export, "SELECT "+exportColumns+" FROM data_exports WHERE id = $1 AND user_id = $2", exportID, int64(userID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch export", http.StatusInternalServerError)
+		return
+	}
+	if export.Status != ExportReady || export.StorageKey == nil || (export.ExpiresAt != nil && time.Now().After(*export.ExpiresAt)) {
+		http.Error(w, "Export is not available", http.StatusConflict)
+		return
+	}
+
+	object, err := h.Storage.Open(*export.StorageKey, exportFileName)
+	if err != nil {
+		log.Printf("Error opening export %d: %v", export.ID, err)
+		http.Error(w, "Failed to fetch export", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	name := fmt.Sprintf("mini-discord-data-%d.zip", export.ID)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, name, object.ModTime(), object)
+}
+
+// ProcessExports periodically builds queued exports, one at a time, and
+// removes the files of expired ones. The queue is kept in Postgres, so it
+// survives restarts.
+func (h *UserHandler) ProcessExports() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.expireExports()
+		for {
+			export, err := h.claimExport()
+			if err == sql.ErrNoRows {
+				break
+			} else if err != nil {
+				log.Println("Export queue error:", err)
+				break
+			}
+			h.runExport(export)
+		}
+	}
+}
+
+// claimExport marks the oldest queued export as running and returns it.
+func (h *UserHandler) claimExport() (*Export, error) {
+	var export Export
+	err := h.DB.Get(&export, `
+		UPDATE data_exports SET status = 'running', started_at = NOW()
+		WHERE id = (
+			SELECT id FROM data_exports
+			WHERE status = 'pending'
+				OR (status = 'running' AND started_at < NOW() - $1::INT * INTERVAL '1 second')
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+exportColumns,
+		int(exportTimeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (h *UserHandler) runExport(export *Export) {
+	key, size, err := h.storeExport(export.UserID)
+	if err == nil {
+		_, err = h.DB.Exec(`
+			UPDATE data_exports
+			SET status = 'ready', storage_key = $2, size_bytes = $3, completed_at = NOW(),
+				expires_at = NOW() + $4::INT * INTERVAL '1 second'
+			WHERE id = $1
+		`, export.ID, key, size, int(exportRetention.Seconds()))
+		if err == nil {
+			log.Printf("Built export %d for user %d (%d bytes)", export.ID, export.UserID, size)
+			return
+		}
+	}
+
+	log.Printf("Error building export %d: %v", export.ID, err)
+	_, err = h.DB.Exec(`
+		UPDATE data_exports SET status = 'failed', error = $2, completed_at = NOW() WHERE id = $1
+	`, export.ID, err.Error())
+	if err != nil {
+		log.Printf("Error failing export %d: %v", export.ID, err)
+	}
+}
+
+// expireExports deletes the files of exports past their retention.
+func (h *UserHandler) expireExports() {
+	var keys []string
+	err := h.DB.Select(&keys, `
+		UPDATE data_exports SET status = 'expired'
+		WHERE status = 'ready' AND expires_at <= NOW()
+		RETURNING storage_key
+	`)
+	if err != nil {
+		log.Println("Export expiry error:", err)
+		return
+	}
+	for _, key := range keys {
+		if err := h.Storage.Delete(key); err != nil {
+			log.Printf("Error deleting export %s: %v", key, err)
+		}
+	}
+}
+
+// exportedAccount is the account part of an export.
+type exportedAccount struct {
+	Profile
+	Email               string     `db:"email" json:"email"`
+	EmailVerified       bool       `db:"email_verified" json:"email_verified"`
+	TOTPEnabled         bool       `db:"totp_enabled" json:"totp_enabled"`
+	DeletionRequestedAt *time.Time `db:"deletion_requested_at" json:"deletion_requested_at"`
+}
+
+type exportedMembership struct {
+	ServerID     int64      `db:"server_id" json:"server_id"`
+	ServerName   string     `db:"server_name" json:"server_name"`
+	Nickname     *string    `db:"nickname" json:"nickname"`
+	Role         string     `db:"role" json:"role"`
+	JoinedAt     time.Time  `db:"joined_at" json:"joined_at"`
+	TimeoutUntil *time.Time `db:"timeout_until" json:"timeout_until"`
+}
+
+type exportedServer struct {
+	ID          int64     `db:"id" json:"id"`
+	Name        string    `db:"name" json:"name"`
+	Description string    `db:"description" json:"description"`
+	IconURL     string    `db:"icon_url" json:"icon_url"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	Channels    []struct {
+		ID        int64     `db:"id" json:"id"`
+		Name      string    `db:"name" json:"name"`
+		Type      string    `db:"type" json:"type"`
+		CreatedAt time.Time `db:"created_at" json:"created_at"`
+	} `db:"-" json:"channels"`
+}
+
+type exportedMessage struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	ServerID  int                `bson:"server_id" json:"server_id"`
+	ChannelID int                `bson:"channel_id" json:"channel_id"`
+	Content   string             `bson:"content" json:"content"`
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	Embeds    []bson.M           `bson:"embeds,omitempty" json:"embeds,omitempty"`
+}
+
+// storeExport builds the user's export in a temporary file, so large ones
+// aren't held in memory, and stores it. It returns the storage key and size.
+func (h *UserHandler) storeExport(userID int64) (string, int64, error) {
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := h.buildExport(tmp, userID); err != nil {
+		return "", 0, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	// Exports of unchanged data are identical, so they get a key of their
+	// own rather than sharing a file that either one's expiry would delete.
+	key, err := storage.RandomKey()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := h.Storage.Put(key, exportFileName, tmp); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// buildExport writes the user's account, memberships, owned servers and
+// messages to w as a zip of JSON files.
+func (h *UserHandler) buildExport(w io.Writer, userID int64) error {
+	var account exportedAccount
+	err := h.DB.Get(&account, `
+		SELECT `+profileColumns+`, email, email_verified, totp_enabled, deletion_requested_at
+		FROM users WHERE id = $1
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("account: %w", err)
+	}
+
+	memberships := []exportedMembership{}
+	err = h.DB.Select(&memberships, `
+		SELECT us.server_id, s.name AS server_name, us.nickname, us.role, us.joined_at, us.timeout_until
+		FROM user_servers us
+		JOIN servers s ON s.id = us.server_id
+		WHERE us.user_id = $1
+		ORDER BY us.joined_at
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("memberships: %w", err)
+	}
+
+	owned := []exportedServer{}
+	err = h.DB.Select(&owned, `
+		SELECT id, name, description, icon_url, created_at FROM servers WHERE owner_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("servers: %w", err)
+	}
+	for i := range owned {
+		err = h.DB.Select(&owned[i].Channels, `
+			SELECT id, name, type, created_at FROM channels WHERE server_id = $1 ORDER BY id
+		`, owned[i].ID)
+		if err != nil {
+			return fmt.Errorf("channels: %w", err)
+		}
+	}
+
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"account.json", account},
+		{"memberships.json", memberships},
+		{"servers.json", owned},
+	}
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON(f, file.data); err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+	f, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	if err := h.writeMessages(f, userID); err != nil {
+		return fmt.Errorf("messages: %w", err)
+	}
+	return archive.Close()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeMessages streams every message the user sent as a JSON array, so
+// large histories aren't held in memory twice.
+func (h *UserHandler) writeMessages(w io.Writer, userID int64) error {
+	collection := h.MongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{"user_id": userID, "webhook_id": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+	first := true
+	for cursor.Next(context.Background()) {
+		var message exportedMessage
+		if err := cursor.Decode(&message); err != nil {
+			return err
+		}
+		b, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
@@ -0,0 +1,221 @@
+package users
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/images"
+	"github.com/mograby3500/mini-discord/storage"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxDisplayNameLength = 32
+	maxBioLength         = 190
+	maxPronounsLength    = 40
+	maxBannerColor       = 0xFFFFFF
+)
+
+type UserHandler struct {
+	DB      *sqlx.DB
+	MongoDB *mongo.Client
+	Hub     *websocket.Hub
+	Storage storage.Storage
+}
+
+// Profile is what other users see of a user.
+type Profile struct {
+	ID          int64     `db:"id" json:"id"`
+	Username    string    `db:"username" json:"username"`
+	DisplayName *string   `db:"display_name" json:"display_name"`
+	AvatarURL   string    `db:"avatar_url" json:"avatar_url"`
+	Bio         string    `db:"bio" json:"bio"`
+	BannerColor *int      `db:"banner_color" json:"banner_color"`
+	Pronouns    string    `db:"pronouns" json:"pronouns"`
+	Bot         bool      `db:"is_bot" json:"bot"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+const profileColumns = "id, username, display_name, avatar_url, bio, banner_color, pronouns, is_bot, created_at"
+
+// MutualServer is a server both the viewer and the user are in.
+type MutualServer struct {
+	ID   int64  `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+	// Nickname is the user's nickname there.
+	Nickname *string `db:"nickname" json:"nickname"`
+}
+
+func (h *UserHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/users/@me", h.handleUpdateProfile).Methods("PATCH")
+	router.HandleFunc("/users/@me/avatar", h.handleUploadAvatar).Methods("PUT")
+	router.HandleFunc("/users/@me/avatar", h.handleDeleteAvatar).Methods("DELETE")
+	router.HandleFunc("/users/@me/exports", h.handleCreateExport).Methods("POST")
+	router.HandleFunc("/users/@me/exports", h.handleListExports).Methods("GET")
+	router.HandleFunc("/users/@me/exports/{export_id}/download", h.handleDownloadExport).Methods("GET")
+	router.HandleFunc("/users/@me/deletion", h.handleGetDeletion).Methods("GET")
+	router.HandleFunc("/users/@me/deletion", h.handleScheduleDeletion).Methods("POST")
+	router.HandleFunc("/users/@me/deletion", h.handleCancelDeletion).Methods("DELETE")
+	router.HandleFunc("/users/{user_id}/profile", h.handleGetProfile).Methods("GET")
+}
+
+// nullableInt is a JSON field that tells null apart from a field left out.
+type nullableInt struct {
+	Set   bool
+	Value *int
+}
+
+func (n *nullableInt) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.Value = nil
+		return nil
+	}
+	return json.Unmarshal(b, &n.Value)
+}
+
+type UpdateProfileRequest struct {
+	// An empty display name removes it.
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Bio         *string `json:"bio"`
+	// BannerColor is an RGB value; null removes it.
+	BannerColor nullableInt `json:"banner_color"`
+	Pronouns    *string     `json:"pronouns"`
+}
+
+func (r *UpdateProfileRequest) validate() error {
+	if r.DisplayName != nil {
+		*r.DisplayName = strings.TrimSpace(*r.DisplayName)
+		if len([]rune(*r.DisplayName)) > maxDisplayNameLength {
+			return errors.New("display_name must be at most 32 characters")
+		}
+	}
+	// Avatars are set by uploading them, which strips their metadata; only
+	// those, or none, are accepted here.
+	if r.AvatarURL != nil && *r.AvatarURL != "" && !images.ValidURL(*r.AvatarURL) {
+		return errors.New("avatar_url must be empty or an uploaded image")
+	}
+	if r.Bio != nil && len([]rune(*r.Bio)) > maxBioLength {
+		return errors.New("bio must be at most 190 characters")
+	}
+	if v := r.BannerColor.Value; v != nil && (*v < 0 || *v > maxBannerColor) {
+		return errors.New("banner_color must be between 0 and 16777215")
+	}
+	if r.Pronouns != nil {
+		*r.Pronouns = strings.TrimSpace(*r.Pronouns)
+		if len([]rune(*r.Pronouns)) > maxPronounsLength {
+			return errors.New("pronouns must be at most 40 characters")
+		}
+	}
+	return nil
+}
+
+// handleUpdateProfile changes the caller's profile. Fields left out are
+// unchanged. Servers the user is in are told about the change.
+func (h *UserHandler) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var request UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var profile Profile
+	err = h.DB.Get(&profile, `
+		UPDATE users SET
+			display_name = CASE WHEN $2::TEXT IS NULL THEN display_name ELSE NULLIF($2::TEXT, '') END,
+			avatar_url = COALESCE($3, avatar_url),
+			bio = COALESCE($4, bio),
+			banner_color = CASE WHEN $5::BOOLEAN THEN $6::INT ELSE banner_color END,
+			pronouns = COALESCE($7, pronouns)
+		WHERE id = $1
+		RETURNING `+profileColumns,
+		int64(userID), request.DisplayName, request.AvatarURL, request.Bio,
+		request.BannerColor.Set, request.BannerColor.Value, request.Pronouns)
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	h.broadcastProfile(profile)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// broadcastProfile tells every server the user is in about their profile.
+func (h *UserHandler) broadcastProfile(profile Profile) {
+	var serverIDs []int
+	if err := h.DB.Select(&serverIDs, "SELECT server_id FROM user_servers WHERE user_id = $1", profile.ID); err != nil {
+		log.Printf("Error fetching servers of user %d: %v", profile.ID, err)
+	}
+	for _, serverID := range serverIDs {
+		h.Hub.Broadcast(serverID, websocket.EventUserUpdate, profile)
+	}
+}
+
+// handleGetProfile returns a user's profile and the servers the caller
+// shares with them.
+func (h *UserHandler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	targetID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	var profile Profile
+	err = h.DB.Get(&profile, "SELECT "+profileColumns+" FROM users WHERE id = $1", targetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
+		return
+	}
+
+	mutual := []MutualServer{}
+	err = h.DB.Select(&mutual, `
+		SELECT s.id, s.name, theirs.nickname
+		FROM user_servers theirs
+		JOIN user_servers mine ON mine.server_id = theirs.server_id AND mine.user_id = $2
+		JOIN servers s ON s.id = theirs.server_id
+		WHERE theirs.user_id = $1
+		ORDER BY s.name
+	`, targetID, int64(userID))
+	if err != nil {
+		log.Printf("Error fetching mutual servers: %v", err)
+		http.Error(w, "Failed to fetch profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profile":        profile,
+		"mutual_servers": mutual,
+	})
+}
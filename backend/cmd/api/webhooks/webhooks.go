@@ -0,0 +1,494 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/cmd/api/auditlog"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/markdown"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/ratelimit"
+	"github.com/mograby3500/mini-discord/websocket"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxNameLength        = 80
+	maxEmbeds            = 10
+	maxEmbedTitle        = 256
+	maxEmbedDescription  = 4096
+	maxEmbedFooter       = 2048
+	maxEmbedFields       = 25
+	maxEmbedFieldName    = 256
+	maxEmbedFieldValue   = 1024
+	maxEmbedColor        = 0xFFFFFF
+	executeBurst         = 5
+	executeRefillPeriod  = 2 * time.Second
+	maxExecuteBodyLength = 1 << 20
+)
+
+type WebhookHandler struct {
+	DB      *sqlx.DB
+	MongoDB *mongo.Client
+	Hub     *websocket.Hub
+	limiter *ratelimit.Limiter
+}
+
+type Webhook struct {
+	ID        int64     `db:"id" json:"id"`
+	ServerID  int64     `db:"server_id" json:"server_id"`
+	ChannelID int64     `db:"channel_id" json:"channel_id"`
+	Name      string    `db:"name" json:"name"`
+	AvatarURL string    `db:"avatar_url" json:"avatar_url"`
+	CreatedBy *int64    `db:"created_by" json:"created_by"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+const webhookColumns = "id, server_id, channel_id, name, avatar_url, created_by, created_at"
+
+func (h *WebhookHandler) RegisterRoutes(router *mux.Router) {
+	h.limiter = ratelimit.New(executeBurst, executeRefillPeriod)
+
+	router.HandleFunc("/channels/{channel_id}/webhooks", h.handleCreateWebhook).Methods("POST")
+	router.HandleFunc("/channels/{channel_id}/webhooks", h.handleListChannelWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks/{webhook_id}", h.handleUpdateWebhook).Methods("PATCH")
+	router.HandleFunc("/webhooks/{webhook_id}", h.handleDeleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{webhook_id}/{token}", h.handleExecuteWebhook).Methods("POST")
+}
+
+func newWebhookToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+func validHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// requireManageWebhooks checks the permission in the server the channel
+// belongs to and returns that server.
+func (h *WebhookHandler) requireManageWebhooks(w http.ResponseWriter, userID float64, channelID int64) (int64, bool) {
+	var serverID int64
+	err := h.DB.Get(&serverID, "SELECT server_id FROM channels WHERE id = $1", channelID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	allowed, err := permissions.Check(h.DB, int64(userID), serverID, permissions.ManageWebhooks)
+	if err != nil {
+		http.Error(w, "Failed to verify user permissions", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !allowed {
+		http.Error(w, "Forbidden: missing manage webhooks permission", http.StatusForbidden)
+		return 0, false
+	}
+	return serverID, true
+}
+
+type WebhookRequest struct {
+	Name      *string `json:"name"`
+	AvatarURL *string `json:"avatar_url"`
+	ChannelID *int64  `json:"channel_id"`
+}
+
+func (r *WebhookRequest) validate() error {
+	if r.Name != nil && (*r.Name == "" || len([]rune(*r.Name)) > maxNameLength) {
+		return errors.New("name must be between 1 and 80 characters")
+	}
+	if r.AvatarURL != nil && *r.AvatarURL != "" && !validHTTPURL(*r.AvatarURL) {
+		return errors.New("avatar_url must be an http(s) URL")
+	}
+	return nil
+}
+
+// handleCreateWebhook creates a webhook for the channel. The token is part of
+// the returned URL and is not retrievable afterwards.
+func (h *WebhookHandler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	channelID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	var request WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Name == nil {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	avatarURL := ""
+	if request.AvatarURL != nil {
+		avatarURL = *request.AvatarURL
+	}
+
+	serverID, ok := h.requireManageWebhooks(w, userID, channelID)
+	if !ok {
+		return
+	}
+
+	token, tokenHash, err := newWebhookToken()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var webhook Webhook
+	err = tx.Get(&webhook, `
+		INSERT INTO webhooks (server_id, channel_id, name, avatar_url, token_hash, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+webhookColumns,
+		serverID, channelID, *request.Name, avatarURL, tokenHash, int64(userID))
+	if err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, serverID, int64(userID), auditlog.WebhookCreate, webhook.ID, auditlog.Diff(nil, webhook))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhook": webhook,
+		"token":   token,
+		"url":     fmt.Sprintf("/webhooks/%d/%s", webhook.ID, token),
+	})
+}
+
+func (h *WebhookHandler) handleListChannelWebhooks(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	channelID, err := strconv.ParseInt(mux.Vars(r)["channel_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid channel_id", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.requireManageWebhooks(w, userID, channelID); !ok {
+		return
+	}
+
+	webhooks := []Webhook{}
+	err = h.DB.Select(&webhooks, `
+		SELECT `+webhookColumns+` FROM webhooks WHERE channel_id = $1 ORDER BY created_at
+	`, channelID)
+	if err != nil {
+		http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// loadManagedWebhook fetches the webhook if the user may manage it. The
+// user's ID is returned with it.
+func (h *WebhookHandler) loadManagedWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, int64, bool) {
+	tokenStr := r.Header.Get("Authorization")
+	userID, err := auth.ValidateToken(tokenStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	webhookID, err := strconv.ParseInt(mux.Vars(r)["webhook_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook_id", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	var webhook Webhook
+	err = h.DB.Get(&webhook, "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", webhookID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch webhook", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+
+	if _, ok := h.requireManageWebhooks(w, userID, webhook.ChannelID); !ok {
+		return nil, 0, false
+	}
+	return &webhook, int64(userID), true
+}
+
+func (h *WebhookHandler) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, userID, ok := h.loadManagedWebhook(w, r)
+	if !ok {
+		return
+	}
+	before := *webhook
+
+	var request WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Name != nil {
+		webhook.Name = *request.Name
+	}
+	if request.AvatarURL != nil {
+		webhook.AvatarURL = *request.AvatarURL
+	}
+	if request.ChannelID != nil && *request.ChannelID != webhook.ChannelID {
+		var sameServer bool
+		err := h.DB.Get(&sameServer, `
+			SELECT EXISTS (SELECT 1 FROM channels WHERE id = $1 AND server_id = $2)
+		`, *request.ChannelID, webhook.ServerID)
+		if err != nil {
+			http.Error(w, "Failed to fetch channel", http.StatusInternalServerError)
+			return
+		}
+		if !sameServer {
+			http.Error(w, "channel_id must be a channel of the same server", http.StatusBadRequest)
+			return
+		}
+		webhook.ChannelID = *request.ChannelID
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE webhooks SET name = $2, avatar_url = $3, channel_id = $4 WHERE id = $1
+	`, webhook.ID, webhook.Name, webhook.AvatarURL, webhook.ChannelID)
+	if err != nil {
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, webhook.ServerID, userID, auditlog.WebhookUpdate, webhook.ID, auditlog.Diff(before, *webhook))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (h *WebhookHandler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, userID, ok := h.loadManagedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Could not start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM webhooks WHERE id = $1", webhook.ID); err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	err = auditlog.Record(tx, r, webhook.ServerID, userID, auditlog.WebhookDelete, webhook.ID, auditlog.Diff(*webhook, nil))
+	if err != nil {
+		http.Error(w, "Failed to record audit log entry", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ExecuteRequest struct {
+	Content   string            `json:"content"`
+	Username  string            `json:"username"`
+	AvatarURL string            `json:"avatar_url"`
+	Embeds    []websocket.Embed `json:"embeds"`
+}
+
+func (r *ExecuteRequest) validate() error {
+	if r.Content == "" && len(r.Embeds) == 0 {
+		return errors.New("content or embeds is required")
+	}
+	if len([]rune(r.Username)) > maxNameLength {
+		return errors.New("username must be at most 80 characters")
+	}
+	if r.AvatarURL != "" && !validHTTPURL(r.AvatarURL) {
+		return errors.New("avatar_url must be an http(s) URL")
+	}
+	if len(r.Embeds) > maxEmbeds {
+		return errors.New("at most 10 embeds are allowed")
+	}
+	for i, e := range r.Embeds {
+		switch {
+		case len([]rune(e.Title)) > maxEmbedTitle:
+			return fmt.Errorf("embeds[%d].title is too long", i)
+		case len([]rune(e.Description)) > maxEmbedDescription:
+			return fmt.Errorf("embeds[%d].description is too long", i)
+		case len([]rune(e.Footer)) > maxEmbedFooter:
+			return fmt.Errorf("embeds[%d].footer is too long", i)
+		case e.Color < 0 || e.Color > maxEmbedColor:
+			return fmt.Errorf("embeds[%d].color must be between 0 and 0xFFFFFF", i)
+		case e.URL != "" && !validHTTPURL(e.URL):
+			return fmt.Errorf("embeds[%d].url must be an http(s) URL", i)
+		case e.ImageURL != "" && !validHTTPURL(e.ImageURL):
+			return fmt.Errorf("embeds[%d].image_url must be an http(s) URL", i)
+		case len(e.Fields) > maxEmbedFields:
+			return fmt.Errorf("embeds[%d] has more than 25 fields", i)
+		}
+		for j, f := range e.Fields {
+			if f.Name == "" || len([]rune(f.Name)) > maxEmbedFieldName || f.Value == "" || len([]rune(f.Value)) > maxEmbedFieldValue {
+				return fmt.Errorf("embeds[%d].fields[%d] must have a name of up to 256 and a value of up to 1024 characters", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// handleExecuteWebhook posts a message into the webhook's channel. The URL
+// token is the only credential. With ?wait=true the created message is returned.
+func (h *WebhookHandler) handleExecuteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID, err := strconv.ParseInt(vars["webhook_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook_id", http.StatusBadRequest)
+		return
+	}
+
+	var webhook struct {
+		Webhook
+		TokenHash string `db:"token_hash"`
+	}
+	err = h.DB.Get(&webhook, "SELECT "+webhookColumns+", token_hash FROM webhooks WHERE id = $1", webhookID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to fetch webhook", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256([]byte(vars["token"]))
+	if err == sql.ErrNoRows || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(webhook.TokenHash)) != 1 {
+		http.Error(w, "Unknown webhook", http.StatusNotFound)
+		return
+	}
+
+	res := h.limiter.Take(strconv.FormatInt(webhook.ID, 10))
+	ratelimit.WriteHeaders(w, res)
+	if !res.Allowed {
+		ratelimit.WriteTooManyRequests(w, res, false)
+		return
+	}
+
+	var request ExecuteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecuteBodyLength)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := websocket.Message{
+		ChannelID: int(webhook.ChannelID),
+		Content:   request.Content,
+		Type:      "text",
+		ServerId:  int(webhook.ServerID),
+		CreatedAt: time.Now(),
+		Bot:       true,
+		WebhookID: int(webhook.ID),
+		UserName:  webhook.Name,
+		AvatarURL: webhook.AvatarURL,
+		Embeds:    request.Embeds,
+	}
+	if request.Username != "" {
+		message.UserName = request.Username
+	}
+	if request.AvatarURL != "" {
+		message.AvatarURL = request.AvatarURL
+	}
+
+	if err := websocket.Publish(h.MongoDB, h.Hub, &message); err != nil {
+		var invalid *markdown.ValidationError
+		if errors.As(err, &invalid) {
+			http.Error(w, invalid.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("MongoDB insert error:", err)
+		http.Error(w, "Failed to post message", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("wait") != "true" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
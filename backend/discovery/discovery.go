@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// MinMembers is how many members, bots aside, a public server needs
+	// before it is listed.
+	MinMembers = 10
+	// MaxSearchLength bounds search terms.
+	MaxSearchLength = 100
+	// MaxPageSize is the most servers returned by one List call.
+	MaxPageSize = 100
+	// MaxTags is how many tags a server can have.
+	MaxTags = 5
+	// MaxTagLength bounds each tag.
+	MaxTagLength = 24
+)
+
+// Sort orders.
+const (
+	SortMembers  = "members"
+	SortActivity = "activity"
+)
+
+var sortOrders = map[string]string{
+	SortMembers:  "member_count DESC",
+	SortActivity: "s.weekly_messages DESC, member_count DESC",
+}
+
+var (
+	tagPattern      = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+)
+
+// Listing is a public server as shown in discovery.
+type Listing struct {
+	ID             int64          `db:"id" json:"id"`
+	Name           string         `db:"name" json:"name"`
+	Description    string         `db:"description" json:"description"`
+	IconURL        string         `db:"icon_url" json:"icon_url"`
+	Tags           pq.StringArray `db:"tags" json:"tags"`
+	Language       string         `db:"language" json:"language"`
+	MemberCount    int            `db:"member_count" json:"member_count"`
+	WeeklyMessages int            `db:"weekly_messages" json:"weekly_messages"`
+	// Joined is whether the user listing servers is already a member.
+	Joined bool `db:"joined" json:"joined"`
+}
+
+// Query selects listed servers. Search matches part of the name or a whole
+// tag, case-insensitively; Tag and Language narrow the results down.
+type Query struct {
+	Search   string
+	Tag      string
+	Language string
+	Sort     string
+	Offset   int
+	Limit    int
+}
+
+func (q *Query) Validate() error {
+	q.Search = strings.TrimSpace(q.Search)
+	if len([]rune(q.Search)) > MaxSearchLength {
+		return errors.New("query must be at most 100 characters")
+	}
+	q.Tag = strings.ToLower(strings.TrimSpace(q.Tag))
+	if q.Language != "" && !ValidLanguage(q.Language) {
+		return errors.New("language must be a language code such as 'en' or 'pt-BR'")
+	}
+	if q.Sort == "" {
+		q.Sort = SortMembers
+	}
+	if _, ok := sortOrders[q.Sort]; !ok {
+		return errors.New("sort must be 'members' or 'activity'")
+	}
+	if q.Offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	if q.Limit < 1 || q.Limit > MaxPageSize {
+		return errors.New("limit must be between 1 and 100")
+	}
+	return nil
+}
+
+// NormalizeTags lowercases and deduplicates tags, checking each one.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > MaxTagLength || !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q must be up to 24 letters, digits and dashes", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxTags {
+		return nil, errors.New("a server can have at most 5 tags")
+	}
+	return normalized, nil
+}
+
+// ValidLanguage reports whether s is a language code such as "en" or "pt-BR".
+func ValidLanguage(s string) bool {
+	return languagePattern.MatchString(s)
+}
+
+// likeContains escapes s for use as a LIKE pattern matching any part of a
+// string.
+func likeContains(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(strings.ToLower(s)) + "%"
+}
+
+// List returns the public servers matching the query. Servers that were
+// delisted or have fewer than MinMembers members are left out.
+func List(db *sqlx.DB, userID int64, q Query) ([]Listing, error) {
+	list := []Listing{}
+	err := db.Select(&list, `
+		SELECT s.id, s.name, s.description, s.icon_url, s.tags, s.language, s.weekly_messages,
+			m.member_count,
+			EXISTS (SELECT 1 FROM user_servers WHERE user_id = $1 AND server_id = s.id) AS joined
+		FROM servers s
+		CROSS JOIN LATERAL (
+			SELECT COUNT(*) AS member_count
+			FROM user_servers us
+			JOIN users u ON u.id = us.user_id
+			WHERE us.server_id = s.id AND NOT u.is_bot
+		) m
+		WHERE s.public AND s.delisted_at IS NULL AND m.member_count >= $2
+			AND ($3::TEXT = '' OR LOWER(s.name) LIKE $4 OR LOWER($3::TEXT) = ANY(s.tags))
+			AND ($5::TEXT = '' OR $5::TEXT = ANY(s.tags))
+			AND ($6::TEXT = '' OR s.language = $6::TEXT)
+		ORDER BY `+sortOrders[q.Sort]+`, s.id
+		LIMIT $7 OFFSET $8
+	`, userID, MinMembers, q.Search, likeContains(q.Search), q.Tag, q.Language, q.Limit, q.Offset)
+	return list, err
+}
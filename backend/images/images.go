@@ -0,0 +1,214 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	// Formats accepted for uploads.
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"github.com/mograby3500/mini-discord/storage"
+)
+
+const (
+	// MaxUploadSize is the largest image file accepted.
+	MaxUploadSize = 8 << 20
+	// maxDimension bounds the width and height of uploads, so a small file
+	// can't decode into a huge bitmap.
+	maxDimension = 4096
+	// DefaultSize is the size image URLs point at.
+	DefaultSize = 256
+)
+
+// Sizes are the square sizes every image is stored in.
+var Sizes = []int{64, 128, 256, 512}
+
+// ContentType is the type images are stored and served as.
+const ContentType = "image/png"
+
+// acceptedTypes are the sniffed content types uploads may have.
+var acceptedTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+var (
+	ErrTooLarge        = errors.New("image must be at most 8 MB")
+	ErrUnsupportedType = errors.New("image must be a PNG, JPEG or GIF")
+	ErrBadDimensions   = errors.New("image must be at most 4096x4096 pixels")
+	ErrInvalid         = errors.New("image could not be decoded")
+)
+
+// Name returns the file name of an image size.
+func Name(size int) string {
+	return fmt.Sprintf("%d.png", size)
+}
+
+// ValidName reports whether name is the file name of an image size.
+func ValidName(name string) bool {
+	for _, size := range Sizes {
+		if name == Name(size) {
+			return true
+		}
+	}
+	return false
+}
+
+// URL returns the path an image is served at.
+func URL(key string, size int) string {
+	return fmt.Sprintf("/media/%s/%s", key, Name(size))
+}
+
+// ValidURL reports whether u could have been returned by URL, i.e. is an
+// image uploaded to this API.
+func ValidURL(u string) bool {
+	parts := strings.Split(u, "/")
+	return len(parts) == 4 && parts[0] == "" && parts[1] == "media" &&
+		storage.ValidKey(parts[2]) && ValidName(parts[3])
+}
+
+// Read returns the image uploaded in a request, either as the "file" field of
+// a multipart form or as the raw body.
+func Read(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize+1<<20)
+	body := io.Reader(r.Body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return nil, ErrTooLarge
+			}
+			return nil, errors.New("missing file")
+		}
+		defer file.Close()
+		body = file
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MaxUploadSize+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, ErrTooLarge
+		}
+		return nil, err
+	}
+	if len(data) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Process validates an uploaded image and renders it in every size as PNG.
+// Decoding and re-encoding drops any metadata the upload carried, such as
+// EXIF location data. Images that aren't square are cropped to their centre,
+// and animated GIFs keep their first frame.
+func Process(data []byte) (map[int][]byte, error) {
+	if !acceptedTypes[http.DetectContentType(data)] {
+		return nil, ErrUnsupportedType
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > maxDimension || config.Height > maxDimension {
+		return nil, ErrBadDimensions
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	square := crop(img)
+	encoded := make(map[int][]byte, len(Sizes))
+	for _, size := range Sizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, resize(square, size)); err != nil {
+			return nil, err
+		}
+		encoded[size] = buf.Bytes()
+	}
+	return encoded, nil
+}
+
+// Store processes an upload and stores every size. The key is the content
+// address of the largest size, so uploading the same image twice stores it
+// once.
+func Store(s storage.Storage, data []byte) (string, error) {
+	encoded, err := Process(data)
+	if err != nil {
+		return "", err
+	}
+	key := storage.Key(encoded[Sizes[len(Sizes)-1]])
+	for _, size := range Sizes {
+		if err := s.Put(key, Name(size), bytes.NewReader(encoded[size])); err != nil {
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+// IsInvalid reports whether err means the upload itself was bad.
+func IsInvalid(err error) bool {
+	return errors.Is(err, ErrTooLarge) || errors.Is(err, ErrUnsupportedType) ||
+		errors.Is(err, ErrBadDimensions) || errors.Is(err, ErrInvalid)
+}
+
+// crop returns the centred square of img as RGBA.
+func crop(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	n := min(b.Dx(), b.Dy())
+	origin := image.Pt(b.Min.X+(b.Dx()-n)/2, b.Min.Y+(b.Dy()-n)/2)
+	square := image.NewRGBA(image.Rect(0, 0, n, n))
+	draw.Draw(square, square.Bounds(), img, origin, draw.Src)
+	return square
+}
+
+// resize scales a square image to size by averaging the source pixels each
+// target pixel covers. Images smaller than size are scaled up.
+func resize(src *image.RGBA, size int) *image.RGBA {
+	n := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := span(y, n, size)
+		for x := 0; x < size; x++ {
+			x0, x1 := span(x, n, size)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += int(p[0])
+					sum[1] += int(p[1])
+					sum[2] += int(p[2])
+					sum[3] += int(p[3])
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			d := dst.Pix[y*dst.Stride+x*4 : y*dst.Stride+x*4+4]
+			for i := range d {
+				d[i] = uint8((sum[i] + count/2) / count)
+			}
+		}
+	}
+	return dst
+}
+
+// span returns the source pixels [from, to) covered by target pixel i when
+// scaling n pixels to size.
+func span(i, n, size int) (from, to int) {
+	from = i * n / size
+	to = (i + 1) * n / size
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
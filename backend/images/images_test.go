@@ -0,0 +1,191 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/mograby3500/mini-discord/storage"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func filled(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestProcessSizes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, filled(300, 200, color.RGBA{200, 10, 10, 255}), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := Process(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	for _, size := range Sizes {
+		img, format, err := image.Decode(bytes.NewReader(encoded[size]))
+		if err != nil || format != "png" {
+			t.Fatalf("size %d: decoded as %q, %v", size, format, err)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d: got %dx%d", size, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestProcessRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"text", []byte("hello, not an image"), ErrUnsupportedType},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), ErrUnsupportedType},
+		{"truncated png", encodePNG(t, filled(10, 10, color.White))[:40], ErrInvalid},
+		{"too wide", encodePNG(t, image.NewGray(image.Rect(0, 0, maxDimension+1, 1))), ErrBadDimensions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Process(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Process() error = %v, want %v", err, tt.want)
+			}
+			if !IsInvalid(err) {
+				t.Errorf("IsInvalid(%v) = false", err)
+			}
+		})
+	}
+}
+
+func TestCropCentres(t *testing.T) {
+	// A wide image: red bars left and right of a blue 100x100 centre.
+	img := filled(300, 100, color.RGBA{255, 0, 0, 255})
+	for y := 0; y < 100; y++ {
+		for x := 100; x < 200; x++ {
+			img.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+	square := crop(img)
+	if b := square.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Fatalf("crop() = %v, want 100x100", b)
+	}
+	for _, p := range []image.Point{{0, 0}, {99, 0}, {0, 99}, {99, 99}, {50, 50}} {
+		if got := square.RGBAAt(p.X, p.Y); got != (color.RGBA{0, 0, 255, 255}) {
+			t.Errorf("pixel %v = %v, want the blue centre", p, got)
+		}
+	}
+
+	tall := crop(filled(10, 30, color.White).SubImage(image.Rect(0, 5, 10, 30)))
+	if b := tall.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+		t.Errorf("crop() of an offset image = %v, want 10x10", b)
+	}
+}
+
+func TestResizeAverages(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.SetRGBA(0, 0, color.RGBA{0, 0, 0, 255})
+	src.SetRGBA(1, 0, color.RGBA{255, 255, 255, 255})
+	src.SetRGBA(0, 1, color.RGBA{255, 255, 255, 255})
+	src.SetRGBA(1, 1, color.RGBA{0, 0, 0, 255})
+
+	if got := resize(src, 1).RGBAAt(0, 0); got != (color.RGBA{128, 128, 128, 255}) {
+		t.Errorf("downscaled pixel = %v, want mid grey", got)
+	}
+
+	up := resize(src, 4)
+	if got := up.RGBAAt(0, 0); got != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("upscaled top left = %v, want black", got)
+	}
+	if got := up.RGBAAt(3, 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("upscaled top right = %v, want white", got)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	tests := []struct {
+		i, n, size     int
+		wantFrom, want int
+	}{
+		{0, 512, 64, 0, 8},
+		{63, 512, 64, 504, 512},
+		{0, 3, 2, 0, 1},
+		{1, 3, 2, 1, 3},
+		// Upscaling still covers one source pixel.
+		{5, 2, 8, 1, 2},
+	}
+	for _, tt := range tests {
+		from, to := span(tt.i, tt.n, tt.size)
+		if from != tt.wantFrom || to != tt.want {
+			t.Errorf("span(%d, %d, %d) = [%d, %d), want [%d, %d)", tt.i, tt.n, tt.size, from, to, tt.wantFrom, tt.want)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := &storage.DiskStorage{Dir: t.TempDir()}
+	data := encodePNG(t, filled(64, 64, color.RGBA{1, 2, 3, 255}))
+
+	key, err := Store(s, data)
+	if err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if !storage.ValidKey(key) {
+		t.Fatalf("Store() key = %q", key)
+	}
+	for _, size := range Sizes {
+		obj, err := s.Open(key, Name(size))
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", Name(size), err)
+		}
+		obj.Close()
+	}
+
+	again, err := Store(s, data)
+	if err != nil || again != key {
+		t.Errorf("storing the same image again = %q, %v; want %q", again, err, key)
+	}
+}
+
+func TestNames(t *testing.T) {
+	if !ValidName("256.png") || ValidName("300.png") || ValidName("../256.png") {
+		t.Error("ValidName accepts the wrong names")
+	}
+	if got := URL("abc", DefaultSize); got != "/media/abc/256.png" {
+		t.Errorf("URL() = %q", got)
+	}
+
+	key := storage.Key([]byte("image"))
+	if !ValidURL(URL(key, DefaultSize)) {
+		t.Errorf("ValidURL(%q) = false", URL(key, DefaultSize))
+	}
+	for _, u := range []string{
+		"https://example.com/a.png",
+		"//example.com/media/" + key + "/256.png",
+		"/media/" + key + "/300.png",
+		"/media/abc/256.png",
+		"/media/" + key + "/256.png/x",
+		"media/" + key + "/256.png",
+	} {
+		if ValidURL(u) {
+			t.Errorf("ValidURL(%q) = true", u)
+		}
+	}
+}
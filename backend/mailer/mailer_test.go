@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewRequiresMailer(t *testing.T) {
+	t.Setenv("MAILER", "")
+	if _, err := New(); err == nil {
+		t.Error("New() with MAILER unset succeeded")
+	}
+	t.Setenv("MAILER", "pigeon")
+	if _, err := New(); err == nil {
+		t.Error("New() with an unknown MAILER succeeded")
+	}
+	t.Setenv("MAILER", "memory")
+	if m, err := New(); err != nil {
+		t.Errorf("New() = %v", err)
+	} else if _, ok := m.(*MemoryMailer); !ok {
+		t.Errorf("New() = %T, want *MemoryMailer", m)
+	}
+}
+
+func TestFileMailerUsesFrom(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MAILER", "file")
+	t.Setenv("MAIL_DIR", dir)
+	t.Setenv("MAIL_FROM", "hello@example.com")
+	m, err := New()
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if err := m.Send(context.Background(), Message{To: "a@b.c", Subject: "Hi", Body: "body"}); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("wrote %d files, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "From: hello@example.com\r\n") {
+		t.Errorf("message doesn't use MAIL_FROM:\n%s", data)
+	}
+}
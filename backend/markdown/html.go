@@ -0,0 +1,58 @@
+package markdown
+
+import (
+	"html"
+	"strings"
+)
+
+// htmlTags maps formatting nodes to the element they render as.
+var htmlTags = map[NodeType]string{
+	Bold:       "strong",
+	Italic:     "em",
+	Underline:  "u",
+	Strike:     "s",
+	BlockQuote: "blockquote",
+}
+
+// HTML renders parsed content as escaped HTML, e.g. for transcripts. Spoilers
+// become spans with the "spoiler" class, for a stylesheet to hide.
+func HTML(nodes []*Node) string {
+	var b strings.Builder
+	writeHTML(&b, nodes)
+	return b.String()
+}
+
+func writeHTML(b *strings.Builder, nodes []*Node) {
+	for _, n := range nodes {
+		switch n.Type {
+		case Text:
+			b.WriteString(strings.ReplaceAll(html.EscapeString(n.Text), "\n", "<br>"))
+		case Code:
+			b.WriteString("<code>" + html.EscapeString(n.Text) + "</code>")
+		case CodeBlock:
+			b.WriteString("<pre><code")
+			if n.Lang != "" {
+				b.WriteString(` class="language-` + html.EscapeString(n.Lang) + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(n.Text) + "</code></pre>")
+		case Spoiler:
+			b.WriteString(`<span class="spoiler">`)
+			writeHTML(b, n.Children)
+			b.WriteString("</span>")
+		case Link:
+			// parseLink only accepts http(s) URLs.
+			b.WriteString(`<a href="` + html.EscapeString(n.URL) + `" rel="noopener noreferrer nofollow">`)
+			writeHTML(b, n.Children)
+			b.WriteString("</a>")
+		default:
+			tag, ok := htmlTags[n.Type]
+			if !ok {
+				writeHTML(b, n.Children)
+				continue
+			}
+			b.WriteString("<" + tag + ">")
+			writeHTML(b, n.Children)
+			b.WriteString("</" + tag + ">")
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Package markdown validates message content and parses the markdown subset
+// clients render: bold, italics, underline, strikethrough, spoilers, inline
+// code, code blocks with a language, block quotes and masked links.
+package markdown
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxLength is the longest message content in characters.
+	MaxLength = 2000
+	// MaxLines is the most lines a message may span.
+	MaxLines = 100
+	// maxDepth bounds how deeply inline formatting nests.
+	maxDepth = 8
+	// spoilerMask replaces spoilers in previews.
+	spoilerMask = "▮▮▮"
+)
+
+// NodeType is the kind of an AST node.
+type NodeType string
+
+const (
+	Text       NodeType = "text"
+	Bold       NodeType = "bold"
+	Italic     NodeType = "italic"
+	Underline  NodeType = "underline"
+	Strike     NodeType = "strike"
+	Spoiler    NodeType = "spoiler"
+	Code       NodeType = "code"
+	CodeBlock  NodeType = "code_block"
+	BlockQuote NodeType = "block_quote"
+	Link       NodeType = "link"
+)
+
+// Node is an element of parsed content. Text, Code and CodeBlock nodes carry
+// Text; the others carry Children.
+type Node struct {
+	Type     NodeType `json:"type"`
+	Text     string   `json:"text,omitempty"`
+	Lang     string   `json:"lang,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Children []*Node  `json:"children,omitempty"`
+}
+
+// ValidationError is returned for content that can't be sent.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// Content is sanitized message content with its parsed form.
+type Content struct {
+	// Text is the sanitized content; it is what gets stored.
+	Text string
+	AST  []*Node
+	// PlainText has the formatting removed, e.g. for search.
+	PlainText string
+}
+
+// Parse sanitizes content, checks its limits and parses it. Empty content is
+// valid; callers decide whether a message needs any.
+func Parse(content string) (*Content, error) {
+	text := Sanitize(content)
+	if n := utf8.RuneCountInString(text); n > MaxLength {
+		return nil, &ValidationError{fmt.Sprintf("content must be at most %d characters", MaxLength)}
+	}
+	if strings.Count(text, "\n")+1 > MaxLines {
+		return nil, &ValidationError{fmt.Sprintf("content must be at most %d lines", MaxLines)}
+	}
+	ast := parseBlocks(text)
+	return &Content{Text: text, AST: ast, PlainText: PlainText(ast)}, nil
+}
+
+// PlainText returns the text of the nodes without formatting.
+func PlainText(nodes []*Node) string {
+	var b strings.Builder
+	writePlain(&b, nodes, false)
+	return strings.TrimSpace(b.String())
+}
+
+// Preview returns up to max characters of plain text with spoilers hidden,
+// for notifications.
+func Preview(nodes []*Node, max int) string {
+	var b strings.Builder
+	writePlain(&b, nodes, true)
+	preview := strings.Join(strings.Fields(b.String()), " ")
+	if utf8.RuneCountInString(preview) <= max {
+		return preview
+	}
+	runes := []rune(preview)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+func writePlain(b *strings.Builder, nodes []*Node, hideSpoilers bool) {
+	for _, n := range nodes {
+		// Blocks always start on a line of their own.
+		if (n.Type == CodeBlock || n.Type == BlockQuote) && b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteByte('\n')
+		}
+		switch n.Type {
+		case Text, Code:
+			b.WriteString(n.Text)
+		case CodeBlock:
+			b.WriteString(n.Text)
+			if !strings.HasSuffix(n.Text, "\n") {
+				b.WriteByte('\n')
+			}
+		case BlockQuote:
+			writePlain(b, n.Children, hideSpoilers)
+			b.WriteByte('\n')
+		case Spoiler:
+			if hideSpoilers {
+				b.WriteString(spoilerMask)
+			} else {
+				writePlain(b, n.Children, hideSpoilers)
+			}
+		default:
+			writePlain(b, n.Children, hideSpoilers)
+		}
+	}
+}
+
+var langPattern = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,32}$`)
+
+// parseBlocks splits out code blocks, then block quotes, and parses the rest inline.
+func parseBlocks(text string) []*Node {
+	var nodes []*Node
+	for text != "" {
+		start := strings.Index(text, "```")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start+3:], "```")
+		if end < 0 {
+			break
+		}
+		body := text[start+3 : start+3+end]
+		lang := ""
+		if nl := strings.IndexByte(body, '\n'); nl >= 0 && langPattern.MatchString(body[:nl]) {
+			lang, body = body[:nl], body[nl+1:]
+		}
+		nodes = append(nodes, parseQuotes(text[:start])...)
+		nodes = append(nodes, &Node{Type: CodeBlock, Lang: lang, Text: strings.TrimPrefix(body, "\n")})
+		text = text[start+3+end+3:]
+	}
+	return append(nodes, parseQuotes(text)...)
+}
+
+// parseQuotes handles "> " lines and ">>> ", which quotes everything after it.
+func parseQuotes(text string) []*Node {
+	if text == "" {
+		return nil
+	}
+	var nodes []*Node
+	var plain, quoted []string
+	flushPlain := func() {
+		if len(plain) > 0 {
+			nodes = append(nodes, parseInline(strings.Join(plain, "\n"), 0)...)
+			plain = nil
+		}
+	}
+	flushQuote := func() {
+		if len(quoted) > 0 {
+			nodes = append(nodes, &Node{Type: BlockQuote, Children: parseInline(strings.Join(quoted, "\n"), 0)})
+			quoted = nil
+		}
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, ">>> "):
+			flushPlain()
+			quoted = append(quoted, strings.TrimPrefix(line, ">>> "))
+			quoted = append(quoted, lines[i+1:]...)
+			flushQuote()
+			return nodes
+		case strings.HasPrefix(line, "> "):
+			flushPlain()
+			quoted = append(quoted, strings.TrimPrefix(line, "> "))
+		default:
+			flushQuote()
+			plain = append(plain, line)
+		}
+	}
+	flushQuote()
+	flushPlain()
+	return nodes
+}
+
+// delimiters are tried in order, so longer ones win over their prefixes.
+var delimiters = []struct {
+	marker string
+	typ    NodeType
+}{
+	{"||", Spoiler},
+	{"**", Bold},
+	{"__", Underline},
+	{"~~", Strike},
+	{"*", Italic},
+	{"_", Italic},
+}
+
+const escapable = "\\*_~`|[]()>"
+
+// parseInline parses formatting within a block. Unmatched markers stay text.
+func parseInline(text string, depth int) []*Node {
+	var nodes []*Node
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() > 0 {
+			nodes = append(nodes, &Node{Type: Text, Text: buf.String()})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		if rest[0] == '\\' && len(rest) > 1 && strings.IndexByte(escapable, rest[1]) >= 0 {
+			buf.WriteByte(rest[1])
+			i += 2
+			continue
+		}
+
+		if rest[0] == '`' {
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				flush()
+				nodes = append(nodes, &Node{Type: Code, Text: rest[1 : 1+end]})
+				i += end + 2
+				continue
+			}
+		}
+
+		if rest[0] == '[' {
+			if node, n := parseLink(rest, depth); node != nil {
+				flush()
+				nodes = append(nodes, node)
+				i += n
+				continue
+			}
+		}
+
+		if depth < maxDepth {
+			if node, n := parseDelimited(rest, depth); node != nil {
+				flush()
+				nodes = append(nodes, node)
+				i += n
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		buf.WriteString(rest[:size])
+		i += size
+	}
+	flush()
+	return nodes
+}
+
+// parseDelimited parses a span such as **bold** at the start of text and
+// returns it with the number of bytes it covers.
+func parseDelimited(text string, depth int) (*Node, int) {
+	for _, d := range delimiters {
+		if !strings.HasPrefix(text, d.marker) {
+			continue
+		}
+		m := len(d.marker)
+		inner := text[m:]
+		// Single-character markers must hug their content, so "2 * 3 * 4"
+		// stays text.
+		if m == 1 && (inner == "" || inner[0] == ' ' || inner[0] == '\n' || inner[0] == d.marker[0]) {
+			return nil, 0
+		}
+		end := findCloser(inner, d.marker)
+		if end <= 0 {
+			continue
+		}
+		if m == 1 && (inner[end-1] == ' ' || inner[end-1] == '\n') {
+			continue
+		}
+		return &Node{Type: d.typ, Children: parseInline(inner[:end], depth+1)}, m + end + m
+	}
+	return nil, 0
+}
+
+// findCloser returns the index of the marker closing a span, skipping escaped
+// characters and inline code.
+func findCloser(text, marker string) int {
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] == '`':
+			if end := strings.IndexByte(text[i+1:], '`'); end >= 0 {
+				i += end + 1
+			}
+		case strings.HasPrefix(text[i:], marker):
+			// Don't let "*" close on the first half of "**".
+			if len(marker) == 1 && strings.HasPrefix(text[i+1:], marker) {
+				i++
+				continue
+			}
+			// In a longer run, close on its last characters so "***a***"
+			// is bold around italics.
+			if i > 0 {
+				run := i + len(marker)
+				for run < len(text) && text[run] == marker[0] {
+					run++
+				}
+				return run - len(marker)
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// parseLink parses a masked link, [text](https://example.com). Links to
+// anything but http(s), or whose text is a different URL than the target,
+// stay text.
+func parseLink(text string, depth int) (*Node, int) {
+	closeText := strings.Index(text, "](")
+	if closeText < 1 || strings.ContainsAny(text[1:closeText], "[]\n") {
+		return nil, 0
+	}
+	closeURL := strings.IndexByte(text[closeText+2:], ')')
+	if closeURL < 1 {
+		return nil, 0
+	}
+	label := text[1:closeText]
+	target := strings.TrimSpace(text[closeText+2 : closeText+2+closeURL])
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, 0
+	}
+	if shown, err := url.Parse(strings.TrimSpace(label)); err == nil && shown.Host != "" && !strings.EqualFold(shown.Host, u.Host) {
+		return nil, 0
+	}
+	return &Node{Type: Link, URL: u.String(), Children: parseInline(label, depth+1)}, closeText + 2 + closeURL + 1
+}
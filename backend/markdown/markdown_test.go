@@ -0,0 +1,184 @@
+package markdown
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, content string) string {
+	t.Helper()
+	parsed, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse(%q) error = %v", content, err)
+	}
+	return HTML(parsed.AST)
+}
+
+func TestNesting(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"bold", "**hi**", "<strong>hi</strong>"},
+		{"italic both markers", "*a* _b_", "<em>a</em> <em>b</em>"},
+		{"bold italic", "***hi***", "<strong><em>hi</em></strong>"},
+		{"underline in bold", "**a __b__ c**", "<strong>a <u>b</u> c</strong>"},
+		{"strike in spoiler", "||~~gone~~||", `<span class="spoiler"><s>gone</s></span>`},
+		{"formatted link label", "[**docs**](https://example.com)", `<a href="https://example.com" rel="noopener noreferrer nofollow"><strong>docs</strong></a>`},
+		{"unmatched marker", "**open", "**open"},
+		{"spaced asterisks", "2 * 3 * 4", "2 * 3 * 4"},
+		{"inner marker not a closer", "*a **b** c*", "<em>a <strong>b</strong> c</em>"},
+		{"bold italic underscores", "___hi___", "<u><em>hi</em></u>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(t, tt.in); got != tt.want {
+				t.Errorf("HTML(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	if got := HTML(parseInline("**a**", maxDepth-1)); got != "<strong>a</strong>" {
+		t.Errorf("below the limit: %s", got)
+	}
+	if got := HTML(parseInline("**a**", maxDepth)); got != "**a**" {
+		t.Errorf("at the limit: %s", got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"escaped marker", `\*not italic\*`, "*not italic*"},
+		{"escaped backslash", `\\*a*`, `\<em>a</em>`},
+		{"non-escapable", `\d`, `\d`},
+		{"html is escaped", "<b>&</b>", "&lt;b&gt;&amp;&lt;/b&gt;"},
+		{"html in formatting", "**<i>**", "<strong>&lt;i&gt;</strong>"},
+		{"newlines", "a\nb", "a<br>b"},
+		{"javascript link", "[x](javascript:alert(1))", "[x](javascript:alert(1))"},
+		{"link text spoofing another host", "[https://bank.example](https://evil.example)",
+			"[https://bank.example](https://evil.example)"},
+		{"link text naming its own host", "[https://example.com](https://example.com/a)",
+			`<a href="https://example.com/a" rel="noopener noreferrer nofollow">https://example.com</a>`},
+		{"quote in url", `[x](https://example.com/"onmouseover=")`,
+			`<a href="https://example.com/%22onmouseover=%22" rel="noopener noreferrer nofollow">x</a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(t, tt.in); got != tt.want {
+				t.Errorf("HTML(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"code span", "run `ls -l` now", "run <code>ls -l</code> now"},
+		{"no formatting in code", "`**x**`", "<code>**x**</code>"},
+		{"code hides closer", "*a `*` b*", "<em>a <code>*</code> b</em>"},
+		{"escaped html in code", "`<script>`", "<code>&lt;script&gt;</code>"},
+		{"unclosed code", "`open", "`open"},
+		{"code block", "```\nx := 1\n```", "<pre><code>x := 1\n</code></pre>"},
+		{"code block lang", "```go\nx := 1\n```", `<pre><code class="language-go">x := 1` + "\n</code></pre>"},
+		{"invalid lang stays code", "```not a lang\nx\n```", "<pre><code>not a lang\nx\n</code></pre>"},
+		{"block between text", "a\n```\n**b**\n```\nc", "a<br><pre><code>**b**\n</code></pre><br>c"},
+		{"quote", "> quoted\nplain", "<blockquote>quoted</blockquote>plain"},
+		{"multi-line quote", "a\n>>> b\nc", "a<blockquote>b<br>c</blockquote>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(t, tt.in); got != tt.want {
+				t.Errorf("HTML(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		name, in, text, plain string
+	}{
+		{"user mention", "hi <@42>", "hi <@42>", "hi <@42>"},
+		{"role mention", "<@&7> ping", "<@&7> ping", "<@&7> ping"},
+		{"everyone", "@everyone **now**", "@everyone **now**", "@everyone now"},
+		{"zero width space can't hide a mention", "@every​one", "@everyone", "@everyone"},
+		{"bidi override stripped", "<@‮42>", "<@42>", "<@42>"},
+		{"mention in code stays literal", "`<@42>`", "`<@42>`", "<@42>"},
+		{"mention in formatting", "**<@42>**", "**<@42>**", "<@42>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := Parse(tt.in)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if parsed.Text != tt.text {
+				t.Errorf("Text = %q, want %q", parsed.Text, tt.text)
+			}
+			if parsed.PlainText != tt.plain {
+				t.Errorf("PlainText = %q, want %q", parsed.PlainText, tt.plain)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"crlf", "a\r\nb\rc", "a\nb\nc"},
+		{"control chars", "a\x00b\x07c\td", "abc\td"},
+		{"trims", "  hi \n", "hi"},
+		{"joiner runs collapsed", "a‍‍‍b", "a‍b"},
+		{"combining marks capped", "e" + strings.Repeat("́", 10), "e" + strings.Repeat("́", maxCombiningMarks)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.in); got != tt.want {
+				t.Errorf("Sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{"max length", strings.Repeat("é", MaxLength), false},
+		{"too long", strings.Repeat("é", MaxLength+1), true},
+		{"max lines", strings.Repeat("a\n", MaxLines-1) + "a", false},
+		{"too many lines", strings.Repeat("a\n", MaxLines) + "a", true},
+		{"stripped characters don't count", strings.Repeat("a​", MaxLength), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.in)
+			var invalid *ValidationError
+			if got := errors.As(err, &invalid); got != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreview(t *testing.T) {
+	parsed, err := Parse("**Big** news: ||the end||\n\n> quoted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Preview(parsed.AST, 100), "Big news: "+spoilerMask+" quoted"; got != want {
+		t.Errorf("Preview() = %q, want %q", got, want)
+	}
+	if got := Preview(parsed.AST, 8); got != "Big new…" {
+		t.Errorf("Preview(8) = %q", got)
+	}
+}
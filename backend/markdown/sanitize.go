@@ -0,0 +1,77 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxCombiningMarks is how many combining marks may follow one character.
+// Real scripts need a few; stacks of dozens are only used to deface chats.
+const maxCombiningMarks = 4
+
+// stripped are invisible characters that are abused to hide text, break
+// mentions or reverse how a line is displayed.
+var stripped = map[rune]bool{
+	'\u00ad': true, // soft hyphen
+	'\u061c': true, // arabic letter mark
+	'\u180e': true, // mongolian vowel separator
+	'\u200b': true, // zero width space
+	'\u200e': true, // left-to-right mark
+	'\u200f': true, // right-to-left mark
+	'\u202a': true, // bidi embeddings and overrides
+	'\u202b': true,
+	'\u202c': true,
+	'\u202d': true,
+	'\u202e': true,
+	'\u2060': true, // word joiner and invisible operators
+	'\u2061': true,
+	'\u2062': true,
+	'\u2063': true,
+	'\u2064': true,
+	'\u2066': true, // bidi isolates
+	'\u2067': true,
+	'\u2068': true,
+	'\u2069': true,
+	'\ufeff': true, // byte order mark
+}
+
+// isJoiner reports whether r is a zero-width (non-)joiner. Those are kept
+// because emoji sequences and some scripts need them, but runs are collapsed.
+func isJoiner(r rune) bool {
+	return r == '\u200c' || r == '\u200d'
+}
+
+// Sanitize normalizes line endings, removes control and invisible formatting
+// characters, caps combining mark stacks and trims surrounding whitespace.
+func Sanitize(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	var b strings.Builder
+	b.Grow(len(s))
+	marks := 0
+	var prev rune
+	for _, r := range s {
+		switch {
+		case r == '\r':
+			r = '\n'
+		case r == unicode.ReplacementChar:
+			continue
+		case unicode.IsControl(r) && r != '\n' && r != '\t':
+			continue
+		case stripped[r]:
+			continue
+		case isJoiner(r) && isJoiner(prev):
+			continue
+		case unicode.Is(unicode.Mn, r):
+			marks++
+			if marks > maxCombiningMarks {
+				continue
+			}
+		default:
+			marks = 0
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,111 @@
+package members
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxSearchLength bounds search prefixes.
+	MaxSearchLength = 32
+	// MaxPageSize is the most members returned by one List call.
+	MaxPageSize = 1000
+)
+
+// Presence statuses.
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Roles lists the roles a member can have.
+var Roles = []string{"owner", "admin", "member"}
+
+// Member is a server member as shown in the member list.
+type Member struct {
+	UserID       int64      `db:"user_id" json:"user_id"`
+	Username     string     `db:"username" json:"username"`
+	Nickname     *string    `db:"nickname" json:"nickname"`
+	Role         string     `db:"role" json:"role"`
+	Bot          bool       `db:"is_bot" json:"bot"`
+	JoinedAt     time.Time  `db:"joined_at" json:"joined_at"`
+	TimeoutUntil *time.Time `db:"timeout_until" json:"timeout_until"`
+	Status       string     `db:"-" json:"status"`
+}
+
+// Query selects members. Search matches the start of the username or
+// nickname, case-insensitively. After is the user ID to continue after.
+type Query struct {
+	Search string
+	Role   string
+	After  int64
+	Limit  int
+}
+
+func (q *Query) Validate() error {
+	q.Search = strings.TrimSpace(q.Search)
+	if len([]rune(q.Search)) > MaxSearchLength {
+		return errors.New("query must be at most 32 characters")
+	}
+	if q.Role != "" && !slices.Contains(Roles, q.Role) {
+		return errors.New("unknown role")
+	}
+	if q.Limit < 1 || q.Limit > MaxPageSize {
+		return errors.New("limit must be between 1 and 1000")
+	}
+	return nil
+}
+
+// likePrefix escapes s for use as a LIKE prefix.
+func likePrefix(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(strings.ToLower(s)) + "%"
+}
+
+const filter = `
+	us.server_id = $1
+	AND ($2::TEXT = '' OR LOWER(u.username) LIKE $3 OR LOWER(us.nickname) LIKE $3)
+	AND ($4::TEXT = '' OR us.role = $4::TEXT)
+`
+
+// List returns members ordered by user ID. Status is left for the caller,
+// which knows who is connected.
+func List(db *sqlx.DB, serverID int64, q Query) ([]Member, error) {
+	list := []Member{}
+	err := db.Select(&list, `
+		SELECT us.user_id, u.username, us.nickname, us.role, u.is_bot, us.joined_at,
+			CASE WHEN us.timeout_until > NOW() THEN us.timeout_until END AS timeout_until
+		FROM user_servers us
+		JOIN users u ON u.id = us.user_id
+		WHERE `+filter+` AND us.user_id > $5
+		ORDER BY us.user_id
+		LIMIT $6
+	`, serverID, q.Search, likePrefix(q.Search), q.Role, q.After, q.Limit)
+	return list, err
+}
+
+// Count returns how many members match the query, ignoring After and Limit.
+func Count(db *sqlx.DB, serverID int64, q Query) (int, error) {
+	var n int
+	err := db.Get(&n, `
+		SELECT COUNT(*)
+		FROM user_servers us
+		JOIN users u ON u.id = us.user_id
+		WHERE `+filter,
+		serverID, q.Search, likePrefix(q.Search), q.Role)
+	return n, err
+}
+
+// SetPresence fills in the status of each member.
+func SetPresence(list []Member, online func(userID int) bool) {
+	for i := range list {
+		list[i].Status = StatusOffline
+		if online(int(list[i].UserID)) {
+			list[i].Status = StatusOnline
+		}
+	}
+}
@@ -0,0 +1,2 @@
+-- Usernames are unique regardless of case.
+CREATE UNIQUE INDEX users_username_lower_key ON users (LOWER(username));
@@ -0,0 +1,18 @@
+-- Failure counters for login throttling, keyed by 'email:<address>' or 'ip:<address>'.
+CREATE TABLE login_throttle (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP
+);
+
+CREATE TABLE failed_logins (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    reason VARCHAR(30) NOT NULL, -- 'invalid_password', 'invalid_mfa_code' or 'locked'
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_failed_logins_user_id ON failed_logins(user_id, created_at DESC);
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN bot_owner_id INT REFERENCES users(id) ON DELETE CASCADE;
+
+-- A bot has at most one token; regenerating replaces it.
+CREATE TABLE bot_tokens (
+    bot_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
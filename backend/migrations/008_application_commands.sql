@@ -0,0 +1,17 @@
+-- HTTP endpoint interactions are POSTed to. Bots without one receive
+-- interactions over their gateway connection.
+ALTER TABLE users ADD COLUMN interactions_url TEXT;
+
+CREATE TABLE application_commands (
+    id SERIAL PRIMARY KEY,
+    bot_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    server_id INT REFERENCES servers(id) ON DELETE CASCADE, -- NULL for global commands
+    name VARCHAR(32) NOT NULL,
+    description VARCHAR(100) NOT NULL DEFAULT '',
+    options JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX application_commands_scope_name_key
+    ON application_commands (bot_id, COALESCE(server_id, 0), name);
@@ -0,0 +1,12 @@
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    server_id INT NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    channel_id INT NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    name VARCHAR(80) NOT NULL,
+    avatar_url TEXT NOT NULL DEFAULT '',
+    token_hash CHAR(64) NOT NULL,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_webhooks_channel_id ON webhooks(channel_id);
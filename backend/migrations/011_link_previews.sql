@@ -0,0 +1 @@
+ALTER TABLE servers ADD COLUMN link_previews BOOLEAN NOT NULL DEFAULT TRUE;
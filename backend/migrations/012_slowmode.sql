@@ -0,0 +1,2 @@
+ALTER TABLE channels ADD COLUMN slowmode_seconds INT NOT NULL DEFAULT 0
+    CHECK (slowmode_seconds BETWEEN 0 AND 21600);
@@ -0,0 +1,16 @@
+CREATE TABLE automod_rules (
+    id SERIAL PRIMARY KEY,
+    server_id INT NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    trigger VARCHAR(32) NOT NULL, -- keyword, invite, mention_spam, repeated_message, caps
+    config JSONB NOT NULL DEFAULT '{}',
+    actions JSONB NOT NULL DEFAULT '[]',
+    exempt_roles TEXT[] NOT NULL DEFAULT '{}',
+    exempt_channels INT[] NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_automod_rules_server_id ON automod_rules(server_id);
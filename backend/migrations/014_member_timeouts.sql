@@ -0,0 +1,5 @@
+-- Members who are timed out can read but not send until then.
+ALTER TABLE user_servers ADD COLUMN timeout_until TIMESTAMP;
+
+-- Lets the expiry job find running timeouts without scanning all memberships.
+CREATE INDEX idx_user_servers_timeout_until ON user_servers(timeout_until) WHERE timeout_until IS NOT NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE audit_log_entries (
+    id BIGSERIAL PRIMARY KEY,
+    server_id INT NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(64) NOT NULL,
+    target_id BIGINT,
+    changes JSONB NOT NULL DEFAULT '[]',
+    reason VARCHAR(512),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_log_entries_server_id ON audit_log_entries(server_id, id DESC);
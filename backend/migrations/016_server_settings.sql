@@ -0,0 +1,10 @@
+ALTER TABLE servers ADD COLUMN description VARCHAR(300) NOT NULL DEFAULT '';
+ALTER TABLE servers ADD COLUMN icon_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE servers ADD COLUMN default_notifications VARCHAR(20) NOT NULL DEFAULT 'all_messages'; -- all_messages or only_mentions
+ALTER TABLE servers ADD COLUMN system_channel_id INT REFERENCES channels(id) ON DELETE SET NULL;
+
+-- Servers whose Mongo messages still have to be removed after deletion.
+CREATE TABLE server_purges (
+    server_id INT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
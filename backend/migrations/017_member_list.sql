@@ -0,0 +1,6 @@
+-- Per-server nicknames; NULL shows the username.
+ALTER TABLE user_servers ADD COLUMN nickname VARCHAR(32);
+
+-- The member list pages through a server by user ID and searches by prefix.
+CREATE INDEX idx_user_servers_server_user ON user_servers(server_id, user_id);
+CREATE INDEX idx_user_servers_nickname_lower ON user_servers(server_id, LOWER(nickname) text_pattern_ops);
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN display_name VARCHAR(32);
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio VARCHAR(190) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN banner_color INT CHECK (banner_color BETWEEN 0 AND 16777215);
+ALTER TABLE users ADD COLUMN pronouns VARCHAR(40) NOT NULL DEFAULT '';
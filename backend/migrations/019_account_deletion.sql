@@ -0,0 +1,30 @@
+-- Accounts scheduled for deletion are anonymized once the grace period ends.
+ALTER TABLE users ADD COLUMN deletion_requested_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN deletion_keeps_messages BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX idx_users_deletion_requested ON users (deletion_requested_at)
+    WHERE deletion_requested_at IS NOT NULL AND deleted_at IS NULL;
+
+-- Archives of a user's data, built in the background.
+CREATE TABLE data_exports (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, running, ready, failed or expired
+    storage_key CHAR(64),
+    size_bytes BIGINT,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_data_exports_user ON data_exports (user_id, created_at DESC);
+CREATE INDEX idx_data_exports_pending ON data_exports (created_at) WHERE status IN ('pending', 'running');
+
+-- Deleted users whose Mongo messages still have to be removed.
+CREATE TABLE user_purges (
+    user_id INT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,15 @@
+-- Saved server structures that new servers can be created from. A server has
+-- at most one template, which is re-synced rather than duplicated.
+CREATE TABLE server_templates (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(16) NOT NULL UNIQUE,
+    server_id INT NOT NULL UNIQUE REFERENCES servers(id) ON DELETE CASCADE,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    name VARCHAR(100) NOT NULL,
+    description VARCHAR(120) NOT NULL DEFAULT '',
+    version INT NOT NULL DEFAULT 1,
+    snapshot JSONB NOT NULL,
+    usage_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
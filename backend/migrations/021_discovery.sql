@@ -0,0 +1,17 @@
+-- Public servers are listed in discovery and anyone can join them from there.
+ALTER TABLE servers ADD COLUMN public BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE servers ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE servers ADD COLUMN language VARCHAR(10) NOT NULL DEFAULT 'en';
+-- Messages sent in the last week, refreshed in the background for sorting.
+ALTER TABLE servers ADD COLUMN weekly_messages INT NOT NULL DEFAULT 0;
+-- Staff can take a server out of discovery, which also stops people joining it
+-- from there. The owner can't undo it.
+ALTER TABLE servers ADD COLUMN delisted_at TIMESTAMP;
+ALTER TABLE servers ADD COLUMN delisted_reason TEXT;
+
+CREATE INDEX idx_servers_discoverable ON servers (id) WHERE public AND delisted_at IS NULL;
+CREATE INDEX idx_servers_tags ON servers USING GIN (tags);
+
+-- Staff moderate discovery. There is no endpoint for this; it is granted in
+-- the database.
+ALTER TABLE users ADD COLUMN is_staff BOOLEAN NOT NULL DEFAULT FALSE;
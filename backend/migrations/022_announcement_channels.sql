@@ -0,0 +1,26 @@
+-- channels.type may now also be 'announcement'. Text channels can follow an
+-- announcement channel to get copies of the messages published in it.
+CREATE TABLE channel_follows (
+    id SERIAL PRIMARY KEY,
+    source_channel_id INT NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    target_channel_id INT NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (source_channel_id, target_channel_id)
+);
+
+CREATE INDEX idx_channel_follows_target ON channel_follows(target_channel_id);
+
+-- Published, edited and deleted announcements whose copies still have to be
+-- created, updated or deleted. Jobs are retried with a backoff.
+CREATE TABLE crosspost_jobs (
+    id SERIAL PRIMARY KEY,
+    message_id CHAR(24) NOT NULL,
+    channel_id INT NOT NULL,
+    action VARCHAR(10) NOT NULL, -- create, update or delete
+    attempts INT NOT NULL DEFAULT 0,
+    run_after TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_crosspost_jobs_due ON crosspost_jobs(run_after, id);
@@ -0,0 +1,12 @@
+-- Emails are stored trimmed and lowercased, and are unique regardless of
+-- case. Where accounts only differed by case, the oldest one keeps the
+-- address and the others get a placeholder until support sorts them out.
+UPDATE users u SET email = LEFT('conflict-' || u.id || '+' || LOWER(TRIM(u.email)), 100), email_verified = FALSE
+WHERE EXISTS (
+    SELECT 1 FROM users o
+    WHERE LOWER(TRIM(o.email)) = LOWER(TRIM(u.email)) AND o.id < u.id
+);
+
+UPDATE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email));
+
+CREATE UNIQUE INDEX users_email_lower_key ON users (LOWER(email));
@@ -0,0 +1,7 @@
+-- Bots verify interaction callbacks with their own signing secret instead of
+-- a key derived from their token. Existing bots get one they can rotate to
+-- learn it.
+ALTER TABLE users ADD COLUMN interactions_secret CHAR(64);
+
+UPDATE users SET interactions_secret = REPLACE(gen_random_uuid()::text || gen_random_uuid()::text, '-', '')
+WHERE is_bot;
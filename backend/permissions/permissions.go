@@ -0,0 +1,79 @@
+package permissions
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Permission is a bit set of actions a member may take in a server.
+type Permission uint64
+
+const (
+	ManageChannels Permission = 1 << iota
+	ManageWebhooks
+	ManageServer
+	// ModerateMembers allows timing members out.
+	ModerateMembers
+	ViewAuditLog
+	// ManageNicknames allows changing other members' nicknames.
+	ManageNicknames
+	// ExportMessages allows archiving the message history of channels.
+	ExportMessages
+	// SendAnnouncements allows posting in announcement channels and
+	// publishing to the channels following them.
+	SendAnnouncements
+	// ManageMessages allows deleting other members' messages.
+	ManageMessages
+)
+
+// All grants every permission.
+const All Permission = ^Permission(0)
+
+// rolePermissions maps the roles stored in user_servers to what they grant.
+var rolePermissions = map[string]Permission{
+	"owner":  All,
+	"admin":  ManageChannels | ManageWebhooks | ManageServer | ModerateMembers | ViewAuditLog | ManageNicknames | ExportMessages | SendAnnouncements | ManageMessages,
+	"member": 0,
+}
+
+// ForRole returns the permissions granted by a role.
+func ForRole(role string) Permission {
+	return rolePermissions[role]
+}
+
+// Has reports whether p includes every permission in q.
+func (p Permission) Has(q Permission) bool {
+	return p&q == q
+}
+
+// Check reports whether the user is a member of the server with the permission.
+func Check(db *sqlx.DB, userID, serverID int64, perm Permission) (bool, error) {
+	var role string
+	err := db.Get(&role, `
+		SELECT role FROM user_servers WHERE user_id = $1 AND server_id = $2
+	`, userID, serverID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return ForRole(role).Has(perm), nil
+}
+
+// TimeoutUntil returns when the member's timeout ends, or nil if they aren't
+// timed out. Timed out members can read the server but not send to it.
+func TimeoutUntil(db *sqlx.DB, userID, serverID int64) (*time.Time, error) {
+	var until time.Time
+	err := db.Get(&until, `
+		SELECT timeout_until FROM user_servers
+		WHERE user_id = $1 AND server_id = $2 AND timeout_until > NOW()
+	`, userID, serverID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &until, nil
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCooldown bounds the intervals a Cooldown is used with; older entries
+// can't block anything and are swept.
+const maxCooldown = 6 * time.Hour
+
+// Cooldown lets each key act once per interval, e.g. for slow mode. The
+// interval is passed per call since it may change at any time.
+type Cooldown struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func NewCooldown() *Cooldown {
+	return &Cooldown{last: make(map[string]time.Time)}
+}
+
+// Wait returns how much of interval is left since the last action recorded
+// for key, or zero if the key may act now.
+func (c *Cooldown) Wait(key string, interval time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.last[key]; ok {
+		if wait := interval - time.Since(last); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Record starts a new interval for key. Callers record once the action has
+// actually happened, so failed attempts don't use up the interval.
+func (c *Cooldown) Record(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.last) > sweepThreshold {
+		for k, t := range c.last {
+			if now.Sub(t) > maxCooldown {
+				delete(c.last, k)
+			}
+		}
+	}
+	c.last[key] = now
+}
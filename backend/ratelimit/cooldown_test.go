@@ -0,0 +1,28 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCooldown(t *testing.T) {
+	c := NewCooldown()
+	if wait := c.Wait("a", time.Minute); wait != 0 {
+		t.Fatalf("Wait() before any action = %v", wait)
+	}
+	// Checking alone doesn't start the interval.
+	if wait := c.Wait("a", time.Minute); wait != 0 {
+		t.Fatalf("Wait() after a check = %v", wait)
+	}
+
+	c.Record("a")
+	if wait := c.Wait("a", time.Minute); wait <= 0 || wait > time.Minute {
+		t.Errorf("Wait() after Record = %v, want within a minute", wait)
+	}
+	if wait := c.Wait("b", time.Minute); wait != 0 {
+		t.Errorf("Wait() for another key = %v", wait)
+	}
+	if wait := c.Wait("a", 0); wait != 0 {
+		t.Errorf("Wait() with no interval = %v", wait)
+	}
+}
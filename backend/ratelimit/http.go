@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rule allows Limit requests per Period.
+type Rule struct {
+	Limit  int
+	Period time.Duration
+}
+
+// HTTP limits requests per route bucket and per client. A route's bucket is
+// its method and path template, e.g. "POST /channels/{channel_id}/webhooks".
+// Every client also has a global bucket shared by all routes.
+type HTTP struct {
+	// Identify returns who a request comes from, e.g. a user or an IP.
+	Identify func(r *http.Request) string
+
+	global   *Limiter
+	fallback *Limiter
+	routes   map[string]*Limiter
+}
+
+// NewHTTP returns limits using the rule of a route's bucket, or fallback for
+// routes without one, plus the global rule across all routes.
+func NewHTTP(identify func(r *http.Request) string, global, fallback Rule, routes map[string]Rule) *HTTP {
+	l := &HTTP{
+		Identify: identify,
+		global:   New(global.Limit, global.Period),
+		fallback: New(fallback.Limit, fallback.Period),
+		routes:   make(map[string]*Limiter, len(routes)),
+	}
+	for bucket, rule := range routes {
+		l.routes[bucket] = New(rule.Limit, rule.Period)
+	}
+	return l
+}
+
+// bucketName names the route bucket of a request matched by mux.
+func bucketName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.Method + " " + r.URL.Path
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return r.Method + " " + r.URL.Path
+	}
+	return r.Method + " " + template
+}
+
+// Middleware enforces the limits. It is meant for mux.Router.Use, which runs
+// it after routing so the route template is known.
+func (l *HTTP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := l.Identify(r)
+
+		if res := l.global.Take(client); !res.Allowed {
+			WriteTooManyRequests(w, res, true)
+			return
+		}
+
+		name := bucketName(r)
+		limiter, ok := l.routes[name]
+		if !ok {
+			limiter = l.fallback
+		}
+		res := limiter.Take(name + "|" + client)
+		w.Header().Set("X-RateLimit-Bucket", name)
+		WriteHeaders(w, res)
+		if !res.Allowed {
+			WriteTooManyRequests(w, res, false)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(math.Ceil(d.Seconds()*1000)/1000, 'f', -1, 64)
+}
+
+// WriteHeaders sets the X-RateLimit-* headers describing a bucket.
+func WriteHeaders(w http.ResponseWriter, res Result) {
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(res.ResetAfter).Unix(), 10))
+	h.Set("X-RateLimit-Reset-After", seconds(res.ResetAfter))
+}
+
+// WriteTooManyRequests answers 429 with Retry-After in whole seconds and the
+// precise wait in the body.
+func WriteTooManyRequests(w http.ResponseWriter, res Result, global bool) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	if global {
+		w.Header().Set("X-RateLimit-Global", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       "You are being rate limited.",
+		"retry_after": math.Ceil(res.RetryAfter.Seconds()*1000) / 1000,
+		"global":      global,
+	})
+}
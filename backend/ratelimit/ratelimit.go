@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets keyed by arbitrary strings. Each bucket
+// holds up to limit tokens and refills completely over the period.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   float64
+	rate    float64 // tokens per second
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// sweepThreshold is the number of buckets above which full buckets are evicted.
+const sweepThreshold = 10000
+
+func New(limit int, period time.Duration) *Limiter {
+	return &Limiter{
+		limit:   float64(limit),
+		rate:    float64(limit) / period.Seconds(),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Result describes a bucket after a request was counted against it.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+	// RetryAfter is how long until a token is available; zero when allowed.
+	RetryAfter time.Duration
+}
+
+// Take takes a token from the bucket of key and reports the bucket's state.
+func (l *Limiter) Take(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > sweepThreshold {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.limit, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.limit, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	res := Result{Allowed: b.tokens >= 1, Limit: int(l.limit)}
+	if res.Allowed {
+		b.tokens--
+	} else {
+		res.RetryAfter = l.after(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.ResetAfter = l.after(l.limit - b.tokens)
+	return res
+}
+
+// after is how long the bucket takes to gain the tokens.
+func (l *Limiter) after(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled, since they behave like new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.limit {
+			delete(l.buckets, key)
+		}
+	}
+}
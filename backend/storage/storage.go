@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned for keys that were never stored.
+var ErrNotFound = errors.New("storage: not found")
+
+// Object is a stored file opened for reading.
+type Object interface {
+	io.ReadSeekCloser
+	ModTime() time.Time
+}
+
+// Storage keeps immutable files. Shared files are content-addressed: a key is
+// derived from the content, so the same file is only stored once and what a
+// key refers to never changes. Files deleted on their own schedule get a
+// RandomKey instead, so deleting one can't remove another's copy.
+type Storage interface {
+	// Put stores what r yields as the file name under key. Storing a file
+	// that is already there does nothing.
+	Put(key, name string, r io.Reader) error
+	Open(key, name string) (Object, error)
+	// Delete removes every file stored under key.
+	Delete(key string) error
+}
+
+// New returns the storage backend configured by the environment. Files are
+// kept on local disk under STORAGE_DIR.
+func New() Storage {
+	return &DiskStorage{Dir: os.Getenv("STORAGE_DIR")}
+}
+
+// Key returns the content address of data.
+func Key(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// RandomKey returns a new key that no other file has.
+func RandomKey() (string, error) {
+	buf := make([]byte, sha256.Size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+var (
+	keyPattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	namePattern = regexp.MustCompile(`^[0-9a-z_-]+(\.[0-9a-z]+)?$`)
+)
+
+// ValidKey reports whether key could have been returned by Key or RandomKey.
+func ValidKey(key string) bool {
+	return keyPattern.MatchString(key)
+}
+
+func validate(key, name string) error {
+	if !ValidKey(key) || !namePattern.MatchString(name) {
+		return fmt.Errorf("storage: invalid key %q/%q", key, name)
+	}
+	return nil
+}
+
+// DiskStorage stores files in a directory tree under Dir, sharded by the
+// first two characters of the key.
+type DiskStorage struct {
+	Dir string
+}
+
+func (s *DiskStorage) path(key, name string) string {
+	dir := s.Dir
+	if dir == "" {
+		dir = "uploads"
+	}
+	return filepath.Join(dir, key[:2], key, name)
+}
+
+func (s *DiskStorage) Put(key, name string, r io.Reader) error {
+	if err := validate(key, name); err != nil {
+		return err
+	}
+	path := s.path(key, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create storage dir: %w", err)
+	}
+	// Write to a temporary file first so readers never see a partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStorage) Open(key, name string) (Object, error) {
+	if err := validate(key, name); err != nil {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(key, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &diskObject{File: f, modTime: info.ModTime()}, nil
+}
+
+func (s *DiskStorage) Delete(key string) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+	return os.RemoveAll(filepath.Dir(s.path(key, "_")))
+}
+
+type diskObject struct {
+	*os.File
+	modTime time.Time
+}
+
+func (o *diskObject) ModTime() time.Time {
+	return o.modTime
+}
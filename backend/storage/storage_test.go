@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	s := &DiskStorage{Dir: t.TempDir()}
+	data := []byte("hello")
+	key := Key(data)
+
+	if err := s.Put(key, "a.txt", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	obj, err := s.Open(key, "a.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(got) != "hello" {
+		t.Errorf("read %q, want %q", got, "hello")
+	}
+	if obj.ModTime().IsZero() {
+		t.Error("ModTime() is zero")
+	}
+
+	// Stored files are immutable: a second Put under the same name is ignored.
+	if err := s.Put(key, "a.txt", strings.NewReader("changed")); err != nil {
+		t.Fatalf("second Put() error = %v", err)
+	}
+	obj, _ = s.Open(key, "a.txt")
+	got, _ = io.ReadAll(obj)
+	obj.Close()
+	if string(got) != "hello" {
+		t.Errorf("after second Put read %q, want %q", got, "hello")
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := s.Open(key, "a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() after Delete error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDiskStorageLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := &DiskStorage{Dir: dir}
+	key := Key([]byte("x"))
+	if err := s.Put(key, "x.bin", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, key[:2], key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "x.bin" {
+		t.Errorf("directory holds %v, want only x.bin", entries)
+	}
+}
+
+func TestDiskStorageRejectsBadKeys(t *testing.T) {
+	s := &DiskStorage{Dir: t.TempDir()}
+	key := Key([]byte("x"))
+	tests := []struct{ key, name string }{
+		{"../../etc", "passwd"},
+		{key[:63], "a.txt"},
+		{key, "../a.txt"},
+		{key, "a/b"},
+		{key, "A.TXT"},
+		{key, ""},
+	}
+	for _, tt := range tests {
+		if err := s.Put(tt.key, tt.name, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q, %q) succeeded", tt.key, tt.name)
+		}
+		if _, err := s.Open(tt.key, tt.name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Open(%q, %q) error = %v, want %v", tt.key, tt.name, err, ErrNotFound)
+		}
+	}
+	if err := s.Delete("../.."); err == nil {
+		t.Error("Delete of an invalid key succeeded")
+	}
+}
+
+func TestKey(t *testing.T) {
+	a, b := Key([]byte("a")), Key([]byte("b"))
+	if a == b || a != Key([]byte("a")) {
+		t.Error("Key is not a content address")
+	}
+	if !ValidKey(a) || ValidKey("xyz") {
+		t.Error("ValidKey accepts the wrong keys")
+	}
+
+	r1, err := RandomKey()
+	if err != nil {
+		t.Fatalf("RandomKey() error = %v", err)
+	}
+	r2, _ := RandomKey()
+	if r1 == r2 || !ValidKey(r1) {
+		t.Errorf("RandomKey() = %q, %q, want distinct valid keys", r1, r2)
+	}
+}
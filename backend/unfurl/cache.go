@@ -0,0 +1,70 @@
+package unfurl
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	cacheTTL        = time.Hour
+	failureCacheTTL = 10 * time.Minute
+)
+
+type cacheEntry struct {
+	meta    *Metadata
+	err     error
+	expires time.Time
+}
+
+// cache keeps fetched metadata, and failures for a shorter time, so a link
+// posted many times is only fetched once.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]cacheEntry
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[string]cacheEntry)}
+}
+
+func (c *cache) get(key string) (*Metadata, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil, false
+	}
+	return entry.meta, entry.err, true
+}
+
+func (c *cache) put(key string, meta *Metadata, err error) {
+	ttl := cacheTTL
+	if err != nil {
+		ttl = failureCacheTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[key] = cacheEntry{meta: meta, err: err, expires: time.Now().Add(ttl)}
+}
+
+// evict drops expired entries, or an arbitrary one if none have expired.
+// The caller must hold the mutex.
+func (c *cache) evict() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,348 @@
+// Package unfurl fetches link preview metadata from untrusted URLs.
+package unfurl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	fetchTimeout     = 5 * time.Second
+	maxBodySize      = 1 << 20
+	maxOEmbedSize    = 64 << 10
+	maxRedirects     = 3
+	maxTitleLength   = 256
+	maxDescLength    = 1024
+	maxSiteLength    = 128
+	userAgent        = "Mozilla/5.0 (compatible; mini-discord-unfurler/1.0)"
+	defaultCacheSize = 1000
+)
+
+var (
+	ErrBlockedAddress = errors.New("unfurl: destination is not a public address")
+	ErrUnsupported    = errors.New("unfurl: unsupported content")
+	ErrNoMetadata     = errors.New("unfurl: page has no metadata")
+)
+
+// Metadata is what a link preview shows.
+type Metadata struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image_url"`
+	SiteName    string `json:"site_name"`
+}
+
+// blockedPrefixes are ranges that are not covered by the netip predicates but
+// must not be reachable either.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// isPublic reports whether the fetcher may connect to the address.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetcher fetches pages for link previews. It only connects to public
+// addresses; the check runs on the resolved address of every connection, so
+// redirects and DNS tricks can't reach internal hosts.
+type Fetcher struct {
+	client *http.Client
+	cache  *cache
+}
+
+// New returns a Fetcher that only reaches public addresses.
+func New() *Fetcher {
+	return newFetcher(isPublic)
+}
+
+func newFetcher(allowed func(netip.Addr) bool) *Fetcher {
+	client := newClient(allowed, fetchTimeout)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("unfurl: too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("unfurl: redirect to unsupported scheme")
+		}
+		return nil
+	}
+	return &Fetcher{client: client, cache: newCache(defaultCacheSize)}
+}
+
+// NewClient returns an HTTP client that, like a Fetcher, only connects to
+// public addresses. Use it for any request to a URL a user gave us.
+func NewClient(timeout time.Duration) *http.Client {
+	return newClient(isPublic, timeout)
+}
+
+func newClient(allowed func(netip.Addr) bool, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !allowed(addr) {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		// Never go through a proxy: it would connect on our behalf and skip the check.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// Fetch returns the preview metadata of a page. Results, including failures,
+// are cached.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Metadata, error) {
+	if meta, err, ok := f.cache.get(rawURL); ok {
+		return meta, err
+	}
+	meta, err := f.fetch(ctx, rawURL)
+	if ctx.Err() == nil {
+		f.cache.put(rawURL, meta, err)
+	}
+	return meta, err
+}
+
+func (f *Fetcher) get(ctx context.Context, rawURL, accept string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrUnsupported
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", accept)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrBlockedAddress) {
+			return nil, ErrBlockedAddress
+		}
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unfurl: unexpected status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, rawURL string) (*Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	resp, err := f.get(ctx, rawURL, "text/html,application/xhtml+xml")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrUnsupported
+	}
+
+	page := parseHead(io.LimitReader(resp.Body, maxBodySize))
+	base := resp.Request.URL
+
+	meta := &Metadata{
+		URL:         firstNonEmpty(resolve(base, page.meta["og:url"]), rawURL),
+		Title:       firstNonEmpty(page.meta["og:title"], page.meta["twitter:title"], page.title),
+		Description: firstNonEmpty(page.meta["og:description"], page.meta["twitter:description"], page.meta["description"]),
+		ImageURL:    resolve(base, firstNonEmpty(page.meta["og:image"], page.meta["twitter:image"])),
+		SiteName:    page.meta["og:site_name"],
+	}
+
+	if page.oembed != "" && (meta.Title == "" || meta.ImageURL == "" || meta.SiteName == "") {
+		if oe, err := f.fetchOEmbed(ctx, resolve(base, page.oembed)); err == nil {
+			meta.Title = firstNonEmpty(meta.Title, oe.Title)
+			meta.ImageURL = firstNonEmpty(meta.ImageURL, resolve(base, oe.ThumbnailURL))
+			meta.SiteName = firstNonEmpty(meta.SiteName, oe.ProviderName)
+		}
+	}
+
+	meta.Title = truncate(meta.Title, maxTitleLength)
+	meta.Description = truncate(meta.Description, maxDescLength)
+	meta.SiteName = truncate(meta.SiteName, maxSiteLength)
+	if meta.Title == "" && meta.Description == "" {
+		return nil, ErrNoMetadata
+	}
+	return meta, nil
+}
+
+type oEmbed struct {
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// fetchOEmbed reads an oEmbed JSON document. It goes through the same client,
+// so the discovery link can't point at internal hosts either.
+func (f *Fetcher) fetchOEmbed(ctx context.Context, rawURL string) (*oEmbed, error) {
+	resp, err := f.get(ctx, rawURL, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var oe oEmbed
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOEmbedSize)).Decode(&oe); err != nil {
+		return nil, err
+	}
+	return &oe, nil
+}
+
+type head struct {
+	title  string
+	meta   map[string]string
+	oembed string
+}
+
+// parseHead collects the title, meta tags and oEmbed link of a document. It
+// stops at <body>, since metadata only lives in the head.
+func parseHead(r io.Reader) head {
+	page := head{meta: make(map[string]string)}
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return page
+		case html.TextToken:
+			if inTitle && page.title == "" {
+				page.title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				return page
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+			switch string(name) {
+			case "body":
+				return page
+			case "title":
+				inTitle = true
+			case "meta":
+				key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"]))
+				if key != "" && page.meta[key] == "" {
+					page.meta[key] = strings.TrimSpace(attrs["content"])
+				}
+			case "link":
+				if strings.EqualFold(attrs["type"], "application/json+oembed") && page.oembed == "" {
+					page.oembed = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+// resolve makes ref absolute against base and drops anything that isn't http(s).
+func resolve(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func truncate(s string, max int) string {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+var urlPattern = regexp.MustCompile(`<?https?://[^\s<>]+>?`)
+
+// ExtractURLs returns up to max distinct http(s) URLs in the text. URLs
+// wrapped in angle brackets are skipped, which lets users suppress previews.
+func ExtractURLs(text string, max int) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		if strings.HasPrefix(match, "<") && strings.HasSuffix(match, ">") {
+			continue
+		}
+		match = strings.TrimPrefix(match, "<")
+		match = strings.TrimRight(match, ".,;:!?)]}'\">")
+		if u, err := url.Parse(match); err != nil || u.Host == "" || seen[match] {
+			continue
+		}
+		seen[match] = true
+		urls = append(urls, match)
+		if len(urls) == max {
+			break
+		}
+	}
+	return urls
+}
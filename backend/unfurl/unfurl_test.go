@@ -0,0 +1,174 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// allowAll lets tests reach httptest servers on loopback.
+func allowAll(netip.Addr) bool { return true }
+
+func serve(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func htmlPage(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback address")
+	})
+
+	_, err := New().Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestFetchBlocksRedirectsToPrivateAddresses(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+
+	// Only the test server counts as public, so the redirect is checked by
+	// the dialer rather than short-circuited.
+	loopback := netip.MustParseAddr("127.0.0.1")
+	f := newFetcher(func(addr netip.Addr) bool { return addr == loopback })
+	_, err := f.Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublic(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublic(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFetchOpenGraph(t *testing.T) {
+	srv := serve(t, htmlPage(`<!doctype html>
+<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content=" OG title ">
+<meta property="og:description" content="OG description">
+<meta name="description" content="Plain description">
+<meta property="og:image" content="/cover.png">
+<meta property="og:site_name" content="Example">
+</head><body><meta property="og:title" content="ignored"></body></html>`))
+
+	meta, err := newFetcher(allowAll).Fetch(context.Background(), srv.URL+"/post")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	want := Metadata{
+		URL:         srv.URL + "/post",
+		Title:       "OG title",
+		Description: "OG description",
+		ImageURL:    srv.URL + "/cover.png",
+		SiteName:    "Example",
+	}
+	if *meta != want {
+		t.Errorf("Fetch() = %+v, want %+v", *meta, want)
+	}
+}
+
+func TestFetchFallsBackToTitleAndOEmbed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video", htmlPage(`<html><head><title>Page title</title>
+<link rel="alternate" type="application/json+oembed" href="/oembed"></head></html>`))
+	mux.HandleFunc("/oembed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title":"oEmbed title","provider_name":"Tube","thumbnail_url":"javascript:alert(1)"}`)
+	})
+	srv := serve(t, mux.ServeHTTP)
+
+	meta, err := newFetcher(allowAll).Fetch(context.Background(), srv.URL+"/video")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if meta.Title != "Page title" || meta.SiteName != "Tube" {
+		t.Errorf("Fetch() = %+v", *meta)
+	}
+	if meta.ImageURL != "" {
+		t.Errorf("ImageURL = %q, want non-http URLs dropped", meta.ImageURL)
+	}
+}
+
+func TestFetchSizeCap(t *testing.T) {
+	padding := strings.Repeat("<!-- padding -->", maxBodySize/16+1)
+	srv := serve(t, htmlPage("<html><head>"+padding+`<meta property="og:title" content="Too late"></head></html>`))
+
+	_, err := newFetcher(allowAll).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrNoMetadata)
+	}
+}
+
+func TestFetchTruncates(t *testing.T) {
+	long := strings.Repeat("é", maxTitleLength+50)
+	srv := serve(t, htmlPage(`<html><head><meta property="og:title" content="`+long+`"></head></html>`))
+
+	meta, err := newFetcher(allowAll).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if n := len([]rune(meta.Title)); n != maxTitleLength {
+		t.Errorf("title has %d runes, want %d", n, maxTitleLength)
+	}
+}
+
+func TestFetchRejectsNonHTML(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	})
+
+	_, err := newFetcher(allowAll).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	text := "see https://a.example/x, <https://b.example> and (https://c.example/y) https://a.example/x"
+	got := ExtractURLs(text, 5)
+	want := []string{"https://a.example/x", "https://c.example/y"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ExtractURLs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mograby3500/mini-discord/cmd/api/automod"
+	"github.com/mograby3500/mini-discord/markdown"
+	"github.com/mograby3500/mini-discord/permissions"
+)
+
+// maxFlaggedContent bounds how much of a flagged message an alert quotes.
+const maxFlaggedContent = 1000
+
+type member struct {
+	Role         string     `db:"role"`
+	TimedOut     bool       `db:"timed_out"`
+	TimeoutUntil *time.Time `db:"timeout_until"`
+}
+
+// Blocked is why a message may not be sent. Match is set when an AutoMod
+// rule blocked it.
+type Blocked struct {
+	Reason string
+	Match  *automod.Match
+}
+
+// Moderate decides whether a message may be sent, or an edit saved. Timed out
+// members can't send; otherwise the message is run through the server's
+// AutoMod rules and their actions are applied. It returns nil if the message
+// is allowed.
+func (h *WebsocketHandler) Moderate(message *Message) (*Blocked, error) {
+	var m member
+	err := h.DB.Get(&m, `
+		SELECT role, COALESCE(timeout_until > NOW(), FALSE) AS timed_out, timeout_until
+		FROM user_servers WHERE user_id = $1 AND server_id = $2
+	`, message.UserID, message.ServerId)
+	if err == sql.ErrNoRows {
+		return &Blocked{Reason: "you are not a member of this server"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if m.TimedOut {
+		return &Blocked{Reason: timedOutMessage(*m.TimeoutUntil)}, nil
+	}
+	if !permissions.ForRole(m.Role).Has(permissions.SendAnnouncements) {
+		var channelType string
+		err := h.DB.Get(&channelType, "SELECT type FROM channels WHERE id = $1", message.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		if channelType == ChannelTypeAnnouncement {
+			return &Blocked{Reason: "you can't post in announcement channels"}, nil
+		}
+	}
+	if h.AutoMod == nil {
+		return nil, nil
+	}
+
+	// Invalid content is rejected by Publish; there is nothing to check yet.
+	parsed, err := markdown.Parse(message.Content)
+	if err != nil {
+		return nil, nil
+	}
+	matches, err := h.AutoMod.Evaluate(automod.Message{
+		ServerID:  message.ServerId,
+		ChannelID: message.ChannelID,
+		UserID:    message.UserID,
+		Role:      m.Role,
+		Content:   parsed.Text,
+		PlainText: parsed.PlainText,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var blocked *Blocked
+	for i, match := range matches {
+		for _, action := range match.Actions {
+			switch action.Type {
+			case automod.ActionBlock:
+				if blocked != nil {
+					continue
+				}
+				blocked = &Blocked{Reason: action.Message, Match: &matches[i]}
+				if blocked.Reason == "" {
+					blocked.Reason = "Your message was blocked by this server's AutoMod."
+				}
+			case automod.ActionFlag:
+				h.flag(message, parsed.Text, match, action.ChannelID)
+			case automod.ActionTimeout:
+				h.timeout(message.UserID, message.ServerId, action.DurationSeconds)
+			}
+		}
+	}
+	return blocked, nil
+}
+
+// moderate runs Moderate on a message sent through the gateway. It reports
+// false once the client has been told why the message was dropped.
+func (c *Client) moderate(h *WebsocketHandler, message *Message) (bool, error) {
+	blocked, err := h.Moderate(message)
+	if err != nil {
+		return false, err
+	}
+	if blocked == nil {
+		return true, nil
+	}
+	if blocked.Match != nil {
+		h.Hub.sendToClient(c, EventAutoModBlocked, map[string]interface{}{
+			"op":         OpSendMessage,
+			"channel_id": message.ChannelID,
+			"rule_id":    blocked.Match.RuleID,
+			"rule_name":  blocked.Match.RuleName,
+			"message":    blocked.Reason,
+		})
+	} else {
+		c.sendError(h.Hub, OpSendMessage, blocked.Reason)
+	}
+	return false, nil
+}
+
+// flag posts an alert about a message to a moderators' channel.
+func (h *WebsocketHandler) flag(message *Message, content string, match automod.Match, channelID int64) {
+	if len(content) > maxFlaggedContent {
+		content = content[:maxFlaggedContent] + "…"
+	}
+	fields := []EmbedField{
+		{Name: "User", Value: fmt.Sprintf("<@%d>", message.UserID), Inline: true},
+		{Name: "Channel", Value: fmt.Sprintf("<#%d>", message.ChannelID), Inline: true},
+		{Name: "Trigger", Value: string(match.Trigger), Inline: true},
+	}
+	if match.Matched != "" {
+		fields = append(fields, EmbedField{Name: "Matched", Value: strings.TrimSpace(match.Matched)})
+	}
+
+	alert := Message{
+		ChannelID: int(channelID),
+		ServerId:  message.ServerId,
+		Type:      "automod",
+		UserName:  "AutoMod",
+		CreatedAt: time.Now(),
+		Bot:       true,
+		Embeds: []Embed{{
+			Title:       "AutoMod: " + match.RuleName,
+			Description: content,
+			Color:       0xED4245,
+			Fields:      fields,
+		}},
+	}
+	if err := h.publish(alert); err != nil {
+		log.Printf("Error posting automod alert to channel %d: %v", channelID, err)
+	}
+}
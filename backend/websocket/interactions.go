@@ -0,0 +1,453 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/cmd/api/commands"
+	"github.com/mograby3500/mini-discord/markdown"
+	"github.com/mograby3500/mini-discord/permissions"
+	"github.com/mograby3500/mini-discord/unfurl"
+)
+
+const (
+	// initialResponseDeadline is how long a bot has to answer or defer.
+	initialResponseDeadline = 3 * time.Second
+	// deferredResponseDeadline is how long a deferred interaction stays open.
+	deferredResponseDeadline = 15 * time.Minute
+	// maxInteractionResponseBody bounds what is read from HTTP callbacks.
+	maxInteractionResponseBody = 64 << 10
+)
+
+// Interaction response types.
+const (
+	ResponseChannelMessage = "CHANNEL_MESSAGE"
+	ResponseDeferred       = "DEFERRED"
+)
+
+var (
+	errUnknownInteraction = errors.New("unknown or expired interaction")
+	errAlreadyDeferred    = errors.New("interaction already deferred")
+	errEmptyResponse      = errors.New("response content is empty")
+	errUnknownResponse    = errors.New("unknown response type")
+	errBotTimedOut        = errors.New("the application is timed out in this server")
+)
+
+// Interaction is what a bot receives when a user invokes one of its commands.
+type Interaction struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CommandID int64                  `json:"command_id"`
+	Name      string                 `json:"name"`
+	Options   map[string]interface{} `json:"options"`
+	UserID    int                    `json:"user_id"`
+	ServerID  int                    `json:"server_id"`
+	ChannelID int                    `json:"channel_id"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// MessageInteraction is attached to messages sent in response to a command.
+type MessageInteraction struct {
+	ID     string `bson:"id" json:"id"`
+	Name   string `bson:"name" json:"name"`
+	UserID int    `bson:"user_id" json:"user_id"`
+}
+
+type InteractionResponse struct {
+	Type string `json:"type"`
+	Data struct {
+		Content   string `json:"content"`
+		Ephemeral bool   `json:"ephemeral"`
+	} `json:"data"`
+}
+
+type pendingInteraction struct {
+	Interaction
+	botID    int
+	deferred bool
+	timer    *time.Timer
+}
+
+// interactionRegistry tracks interactions waiting for a bot's response.
+type interactionRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*pendingInteraction
+}
+
+func newInteractionRegistry() *interactionRegistry {
+	return &interactionRegistry{pending: make(map[string]*pendingInteraction)}
+}
+
+func (r *interactionRegistry) add(p *pendingInteraction, onExpire func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[p.ID] = p
+	p.timer = time.AfterFunc(initialResponseDeadline, func() {
+		if r.remove(p.ID) != nil {
+			onExpire()
+		}
+	})
+}
+
+// remove forgets the interaction and returns it if it was still pending.
+func (r *interactionRegistry) remove(id string) *pendingInteraction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(r.pending, id)
+	p.timer.Stop()
+	return p
+}
+
+// claim applies a bot's response to a pending interaction. Deferring keeps it
+// pending with a longer deadline; any other response completes it.
+func (r *interactionRegistry) claim(id string, botID int, responseType string) (*pendingInteraction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[id]
+	if !ok || p.botID != botID {
+		return nil, errUnknownInteraction
+	}
+	if responseType == ResponseDeferred {
+		if p.deferred {
+			return nil, errAlreadyDeferred
+		}
+		p.deferred = true
+		p.timer.Reset(deferredResponseDeadline)
+		return p, nil
+	}
+	delete(r.pending, id)
+	p.timer.Stop()
+	return p, nil
+}
+
+func newInteractionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (c *Client) handleInvokeCommand(h *WebsocketHandler, data json.RawMessage) {
+	var invocation struct {
+		CommandID int64                  `json:"command_id"`
+		ChannelID int                    `json:"channel_id"`
+		Options   map[string]interface{} `json:"options"`
+	}
+	if err := json.Unmarshal(data, &invocation); err != nil {
+		c.sendError(h.Hub, OpInvokeCommand, "invalid payload")
+		return
+	}
+	// The command runs in the channel's server, whatever the client claims.
+	serverID, ok := c.channelServer(invocation.ChannelID)
+	if !ok {
+		c.sendError(h.Hub, OpInvokeCommand, "not authorized for this channel")
+		return
+	}
+
+	cmd, err := commands.FindForServer(h.DB, invocation.CommandID, serverID)
+	if err == sql.ErrNoRows {
+		c.sendError(h.Hub, OpInvokeCommand, "unknown command")
+		return
+	} else if err != nil {
+		log.Println("Database error (commands):", err)
+		c.sendError(h.Hub, OpInvokeCommand, "server error")
+		return
+	}
+	until, err := permissions.TimeoutUntil(h.DB, int64(c.userID), int64(serverID))
+	if err != nil {
+		log.Println("Database error (timeout):", err)
+		c.sendError(h.Hub, OpInvokeCommand, "server error")
+		return
+	}
+	if until != nil {
+		c.sendError(h.Hub, OpInvokeCommand, timedOutMessage(*until))
+		return
+	}
+	options, err := cmd.ResolveOptions(invocation.Options)
+	if err != nil {
+		c.sendError(h.Hub, OpInvokeCommand, err.Error())
+		return
+	}
+	if err := cmd.CheckReferences(h.DB, options, serverID); errors.Is(err, commands.ErrUnknownReference) {
+		c.sendError(h.Hub, OpInvokeCommand, err.Error())
+		return
+	} else if err != nil {
+		log.Println("Database error (command options):", err)
+		c.sendError(h.Hub, OpInvokeCommand, "server error")
+		return
+	}
+
+	id, err := newInteractionID()
+	if err != nil {
+		c.sendError(h.Hub, OpInvokeCommand, "server error")
+		return
+	}
+	interaction := Interaction{
+		ID:        id,
+		Type:      "APPLICATION_COMMAND",
+		CommandID: cmd.ID,
+		Name:      cmd.Name,
+		Options:   options,
+		UserID:    c.userID,
+		ServerID:  serverID,
+		ChannelID: invocation.ChannelID,
+		CreatedAt: time.Now(),
+	}
+	botID := int(cmd.BotID)
+
+	h.Hub.interactions.add(&pendingInteraction{Interaction: interaction, botID: botID}, func() {
+		h.Hub.SendToUser(interaction.UserID, EventInteractionFailed, map[string]string{
+			"interaction_id": interaction.ID,
+			"message":        "the application did not respond in time",
+		})
+	})
+
+	go h.dispatchInteraction(botID, interaction)
+}
+
+// dispatchInteraction hands the interaction to the bot, over HTTP when the bot
+// has an interactions URL and over its gateway connection otherwise.
+func (h *WebsocketHandler) dispatchInteraction(botID int, interaction Interaction) {
+	var bot struct {
+		URL    sql.NullString `db:"interactions_url"`
+		Secret sql.NullString `db:"interactions_secret"`
+	}
+	err := h.DB.Get(&bot, "SELECT interactions_url, interactions_secret FROM users WHERE id = $1", botID)
+	if err != nil {
+		log.Println("Database error (bot):", err)
+		h.failInteraction(interaction.ID, "server error")
+		return
+	}
+
+	if !bot.URL.Valid || bot.URL.String == "" {
+		if !h.Hub.IsUserConnected(botID) {
+			h.failInteraction(interaction.ID, "the application is not connected")
+			return
+		}
+		h.Hub.SendToUser(botID, EventInteractionCreate, interaction)
+		return
+	}
+
+	if !bot.Secret.Valid {
+		h.failInteraction(interaction.ID, "the application has no signing secret")
+		return
+	}
+	response, err := postInteraction(bot.URL.String, bot.Secret.String, interaction)
+	if err != nil {
+		log.Printf("Interaction callback to bot %d failed: %v", botID, err)
+		h.failInteraction(interaction.ID, "the application did not respond")
+		return
+	}
+	if response == nil {
+		// The bot will answer through the callback endpoint.
+		return
+	}
+	if err := h.respondToInteraction(botID, interaction.ID, *response); err != nil && err != errUnknownInteraction {
+		h.failInteraction(interaction.ID, err.Error())
+	}
+}
+
+// interactionClient posts to bots' interactions URLs. Those are set by users,
+// so it only connects to public addresses and doesn't follow redirects.
+var interactionClient = func() *http.Client {
+	client := unfurl.NewClient(initialResponseDeadline)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}()
+
+// postInteraction POSTs the interaction to a bot's URL. Requests are signed
+// with HMAC-SHA256 keyed by the bot's interactions secret. A 2xx response
+// with a body is read as the response.
+func postInteraction(url, secret string, interaction Interaction) (*InteractionResponse, error) {
+	body, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature-SHA256", hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := interactionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxInteractionResponseBody))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+	var response InteractionResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, fmt.Errorf("invalid response body: %w", err)
+	}
+	return &response, nil
+}
+
+func (h *WebsocketHandler) failInteraction(id, reason string) {
+	p := h.Hub.interactions.remove(id)
+	if p == nil {
+		return
+	}
+	h.Hub.SendToUser(p.UserID, EventInteractionFailed, map[string]string{
+		"interaction_id": id,
+		"message":        reason,
+	})
+}
+
+// respondToInteraction applies a bot's response: deferring notifies the
+// invoker, a message is either sent to the invoker alone (ephemeral) or
+// stored and broadcast to the channel.
+func (h *WebsocketHandler) respondToInteraction(botID int, id string, response InteractionResponse) error {
+	switch response.Type {
+	case ResponseDeferred:
+	case ResponseChannelMessage:
+		parsed, err := markdown.Parse(response.Data.Content)
+		if err != nil {
+			return err
+		}
+		if parsed.Text == "" {
+			return errEmptyResponse
+		}
+		response.Data.Content = parsed.Text
+	default:
+		return errUnknownResponse
+	}
+
+	p, err := h.Hub.interactions.claim(id, botID, response.Type)
+	if err != nil {
+		return err
+	}
+
+	if response.Type == ResponseDeferred {
+		h.Hub.SendToUser(p.UserID, EventInteractionDeferred, map[string]interface{}{
+			"interaction_id": p.ID,
+			"channel_id":     p.ChannelID,
+			"bot_id":         botID,
+		})
+		return nil
+	}
+
+	message := Message{
+		ChannelID: p.ChannelID,
+		UserID:    botID,
+		Content:   response.Data.Content,
+		Type:      "text",
+		ServerId:  p.ServerID,
+		CreatedAt: time.Now(),
+		Bot:       true,
+		Interaction: &MessageInteraction{
+			ID:     p.ID,
+			Name:   p.Name,
+			UserID: p.UserID,
+		},
+	}
+	if response.Data.Ephemeral {
+		message.Ephemeral = true
+		h.Hub.SendToUser(p.UserID, EventMessageCreate, message)
+		return nil
+	}
+	until, err := permissions.TimeoutUntil(h.DB, int64(botID), int64(p.ServerID))
+	if err != nil {
+		return err
+	}
+	if until != nil {
+		return errBotTimedOut
+	}
+	return h.publish(message)
+}
+
+func (c *Client) handleInteractionResponse(h *WebsocketHandler, data json.RawMessage) {
+	if !c.isBot {
+		c.sendError(h.Hub, OpInteractionResponse, "only bots can respond to interactions")
+		return
+	}
+	var payload struct {
+		InteractionID string `json:"interaction_id"`
+		InteractionResponse
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		c.sendError(h.Hub, OpInteractionResponse, "invalid payload")
+		return
+	}
+	if err := h.respondToInteraction(c.userID, payload.InteractionID, payload.InteractionResponse); err != nil {
+		c.sendError(h.Hub, OpInteractionResponse, err.Error())
+	}
+}
+
+// handleInteractionCallback lets bots respond over REST, which HTTP-only bots
+// use to complete deferred interactions.
+func (h *WebsocketHandler) handleInteractionCallback(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.Authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !claims.IsBot {
+		http.Error(w, "Forbidden: only bots can respond to interactions", http.StatusForbidden)
+		return
+	}
+
+	var response InteractionResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err = h.respondToInteraction(claims.UserID, mux.Vars(r)["interaction_id"], response)
+	var invalid *markdown.ValidationError
+	switch {
+	case err == errUnknownInteraction:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == errBotTimedOut:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err == errAlreadyDeferred, err == errEmptyResponse, err == errUnknownResponse, errors.As(err, &invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Println("Interaction response error:", err)
+		http.Error(w, "Failed to deliver response", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mograby3500/mini-discord/unfurl"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxLinkPreviews bounds the previews attached to one message.
+	maxLinkPreviews = 3
+	// linkPreviewTimeout bounds the work done for one message.
+	linkPreviewTimeout = 10 * time.Second
+)
+
+// LinkPreviewer attaches previews of the links in new messages. It listens to
+// MESSAGE_CREATE, fetches in the background and sends MESSAGE_UPDATE once the
+// embeds are stored.
+type LinkPreviewer struct {
+	DB      *sqlx.DB
+	MongoDB *mongo.Client
+	Hub     *Hub
+	Fetcher *unfurl.Fetcher
+}
+
+// Listen has the signature of a Listener.
+func (p *LinkPreviewer) Listen(serverID int, eventType string, data interface{}) {
+	if eventType != EventMessageCreate {
+		return
+	}
+	message, ok := data.(Message)
+	if !ok || message.ID == "" || len(message.Embeds) > 0 {
+		return
+	}
+	urls := unfurl.ExtractURLs(message.Content, maxLinkPreviews)
+	if len(urls) == 0 {
+		return
+	}
+	go p.attach(message, urls)
+}
+
+func (p *LinkPreviewer) attach(message Message, urls []string) {
+	var enabled bool
+	err := p.DB.Get(&enabled, "SELECT link_previews FROM servers WHERE id = $1", message.ServerId)
+	if err != nil {
+		log.Println("Database error (link previews):", err)
+		return
+	}
+	if !enabled {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+
+	var embeds []Embed
+	for _, u := range urls {
+		meta, err := p.Fetcher.Fetch(ctx, u)
+		if err != nil {
+			continue
+		}
+		embeds = append(embeds, Embed{
+			Title:       meta.Title,
+			Description: meta.Description,
+			URL:         meta.URL,
+			ImageURL:    meta.ImageURL,
+			SiteName:    meta.SiteName,
+		})
+	}
+	if len(embeds) == 0 {
+		return
+	}
+
+	oid, err := primitive.ObjectIDFromHex(message.ID)
+	if err != nil {
+		return
+	}
+	// Only fill in embeds if nothing else set them in the meantime.
+	res, err := messagesCollection(p.MongoDB).UpdateOne(ctx,
+		bson.M{"_id": oid, "embeds": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"embeds": embeds}},
+	)
+	if err != nil {
+		log.Println("MongoDB update error (link previews):", err)
+		return
+	}
+	if res.ModifiedCount == 0 {
+		return
+	}
+
+	p.Hub.Broadcast(message.ServerId, EventMessageUpdate, map[string]interface{}{
+		"id":         message.ID,
+		"channel_id": message.ChannelID,
+		"server_id":  message.ServerId,
+		"embeds":     embeds,
+	})
+}
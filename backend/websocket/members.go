@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/mograby3500/mini-discord/members"
+)
+
+const (
+	// memberChunkSize is how many members a MEMBERS_CHUNK event carries.
+	memberChunkSize = 1000
+	// maxRequestedMembers bounds one REQUEST_MEMBERS, so a request can't
+	// queue more chunks than a connection buffers.
+	maxRequestedMembers = 10 * memberChunkSize
+)
+
+// MembersChunk is one part of the answer to a REQUEST_MEMBERS op.
+type MembersChunk struct {
+	ServerID   int              `json:"server_id"`
+	Members    []members.Member `json:"members"`
+	ChunkIndex int              `json:"chunk_index"`
+	ChunkCount int              `json:"chunk_count"`
+	// Nonce is echoed from the request so clients can match the chunks.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// handleRequestMembers lets clients load the member list of a large server
+// lazily: members matching a username or nickname prefix, or with limit 0
+// everyone, are sent back in MEMBERS_CHUNK events.
+func (c *Client) handleRequestMembers(h *WebsocketHandler, data json.RawMessage) {
+	var request struct {
+		ServerID int    `json:"server_id"`
+		Query    string `json:"query"`
+		Limit    int    `json:"limit"`
+		Nonce    string `json:"nonce"`
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		c.sendError(h.Hub, OpRequestMembers, "invalid payload")
+		return
+	}
+	if !c.inServer(request.ServerID) {
+		c.sendError(h.Hub, OpRequestMembers, "not a member of this server")
+		return
+	}
+	if request.Limit < 0 || request.Limit > maxRequestedMembers {
+		c.sendError(h.Hub, OpRequestMembers, "limit must be between 0 and 10000")
+		return
+	}
+	if len(request.Nonce) > 32 {
+		c.sendError(h.Hub, OpRequestMembers, "nonce must be at most 32 characters")
+		return
+	}
+	limit := request.Limit
+	if limit == 0 {
+		limit = maxRequestedMembers
+	}
+	query := members.Query{Search: request.Query, Limit: min(limit, memberChunkSize)}
+	if err := query.Validate(); err != nil {
+		c.sendError(h.Hub, OpRequestMembers, err.Error())
+		return
+	}
+
+	go func() {
+		serverID := int64(request.ServerID)
+		total, err := members.Count(h.DB, serverID, query)
+		if err != nil {
+			log.Println("Database error (members):", err)
+			c.sendError(h.Hub, OpRequestMembers, "server error")
+			return
+		}
+		total = min(total, limit)
+		chunkCount := max((total+memberChunkSize-1)/memberChunkSize, 1)
+
+		sent := 0
+		for i := 0; i < chunkCount; i++ {
+			query.Limit = min(memberChunkSize, total-sent)
+			chunk := []members.Member{}
+			if query.Limit > 0 {
+				chunk, err = members.List(h.DB, serverID, query)
+				if err != nil {
+					log.Println("Database error (members):", err)
+					c.sendError(h.Hub, OpRequestMembers, "server error")
+					return
+				}
+			}
+			members.SetPresence(chunk, h.Hub.IsUserConnected)
+			h.Hub.sendToClient(c, EventMembersChunk, MembersChunk{
+				ServerID:   request.ServerID,
+				Members:    chunk,
+				ChunkIndex: i,
+				ChunkCount: chunkCount,
+				Nonce:      request.Nonce,
+			})
+			if len(chunk) == 0 {
+				return
+			}
+			sent += len(chunk)
+			query.After = chunk[len(chunk)-1].UserID
+		}
+	}()
+}
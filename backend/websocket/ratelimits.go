@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mograby3500/mini-discord/permissions"
+)
+
+const (
+	// frameBurst frames per framePeriod may be sent by each user, across
+	// all of their connections.
+	frameBurst  = 120
+	framePeriod = time.Minute
+	// userMessageBurst messages per userMessagePeriod may be sent by each user.
+	userMessageBurst  = 5
+	userMessagePeriod = 5 * time.Second
+	// channelMessageBurst messages per channelMessagePeriod may be sent to a
+	// channel by everyone together.
+	channelMessageBurst  = 30
+	channelMessagePeriod = 10 * time.Second
+)
+
+// slowModeInterval returns the slow mode interval that applies to the user in
+// the channel, or zero if there is none. Members who can manage channels are
+// exempt.
+func (h *WebsocketHandler) slowModeInterval(userID, channelID, serverID int) (time.Duration, error) {
+	var seconds int
+	err := h.DB.Get(&seconds, "SELECT slowmode_seconds FROM channels WHERE id = $1", channelID)
+	if err != nil || seconds == 0 {
+		return 0, err
+	}
+
+	exempt, err := permissions.Check(h.DB, int64(userID), int64(serverID), permissions.ManageChannels)
+	if err != nil || exempt {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// SlowModeWait returns the slow mode interval that applies to the user in
+// the channel and how much longer they have to wait before sending there.
+func (h *WebsocketHandler) SlowModeWait(userID, channelID, serverID int) (interval, wait time.Duration, err error) {
+	interval, err = h.slowModeInterval(userID, channelID, serverID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return interval, h.slowMode.Wait(slowModeKey(userID, channelID), interval), nil
+}
+
+// RecordSlowMode starts the user's slow mode cooldown in the channel.
+func (h *WebsocketHandler) RecordSlowMode(userID, channelID int) {
+	h.slowMode.Record(slowModeKey(userID, channelID))
+}
+
+func slowModeKey(userID, channelID int) string {
+	return fmt.Sprintf("%d:%d", channelID, userID)
+}
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"log"
+	"time"
+)
+
+// timedOutMessage tells a member why they can't send.
+func timedOutMessage(until time.Time) string {
+	return "you are timed out until " + until.Format(time.RFC3339)
+}
+
+// timeout keeps the user from sending to the server for a while and tells
+// the server. An existing longer timeout is kept.
+func (h *WebsocketHandler) timeout(userID, serverID, seconds int) {
+	var member struct {
+		Role         string    `db:"role"`
+		TimeoutUntil time.Time `db:"timeout_until"`
+	}
+	err := h.DB.Get(&member, `
+		UPDATE user_servers
+		SET timeout_until = GREATEST(COALESCE(timeout_until, NOW()), NOW() + $3::INT * INTERVAL '1 second')
+		WHERE user_id = $1 AND server_id = $2
+		RETURNING role, timeout_until
+	`, userID, serverID, seconds)
+	if err != nil {
+		log.Printf("Error timing out user %d in server %d: %v", userID, serverID, err)
+		return
+	}
+	h.Hub.Broadcast(serverID, EventMemberUpdate, map[string]interface{}{
+		"user_id":       userID,
+		"server_id":     serverID,
+		"role":          member.Role,
+		"timeout_until": member.TimeoutUntil,
+	})
+}
@@ -2,9 +2,13 @@ package websocket
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,40 +18,229 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
 	"github.com/mograby3500/mini-discord/cmd/api/auth"
+	"github.com/mograby3500/mini-discord/cmd/api/automod"
+	"github.com/mograby3500/mini-discord/markdown"
+	"github.com/mograby3500/mini-discord/ratelimit"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Message represents a chat message stored in the database
 type Message struct {
-	ID        string    `bson:"_id,omitempty" json:"id"`
-	ChannelID int       `bson:"channel_id" json:"channel_id"`
-	UserID    int       `bson:"user_id" json:"user_id"`
-	Content   string    `bson:"content" json:"content"`
-	Type      string    `bson:"type" json:"type"`
-	ServerId  int       `bson:"server_id" json:"server_id"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ID          string              `bson:"_id,omitempty" json:"id"`
+	ChannelID   int                 `bson:"channel_id" json:"channel_id"`
+	UserID      int                 `bson:"user_id" json:"user_id"`
+	Content     string              `bson:"content" json:"content"`
+	Type        string              `bson:"type" json:"type"`
+	ServerId    int                 `bson:"server_id" json:"server_id"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+	Bot         bool                `bson:"bot,omitempty" json:"bot"`
+	Interaction *MessageInteraction `bson:"interaction,omitempty" json:"interaction,omitempty"`
+	// Ephemeral messages are only delivered to one user and never stored.
+	Ephemeral bool `bson:"-" json:"ephemeral,omitempty"`
+	// Webhook messages have no user; they carry their own name and avatar.
+	WebhookID int     `bson:"webhook_id,omitempty" json:"webhook_id,omitempty"`
+	UserName  string  `bson:"user_name,omitempty" json:"user_name,omitempty"`
+	AvatarURL string  `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	Embeds    []Embed `bson:"embeds,omitempty" json:"embeds,omitempty"`
+	// PlainText is the content without markdown, for search and previews.
+	PlainText string     `bson:"plain_text,omitempty" json:"-"`
+	EditedAt  *time.Time `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	// PublishedAt is set on announcements once they were sent to the
+	// channels following theirs.
+	PublishedAt *time.Time `bson:"published_at,omitempty" json:"published_at,omitempty"`
+	// Crosspost is set on the copies of published announcements.
+	Crosspost *Crosspost `bson:"crosspost,omitempty" json:"crosspost,omitempty"`
 }
 
+// Crosspost is where a copied announcement was published.
+type Crosspost struct {
+	MessageID   string `bson:"message_id" json:"message_id"`
+	ChannelID   int    `bson:"channel_id" json:"channel_id"`
+	ServerID    int    `bson:"server_id" json:"server_id"`
+	ChannelName string `bson:"channel_name" json:"channel_name"`
+	ServerName  string `bson:"server_name" json:"server_name"`
+}
+
+// ChannelTypeAnnouncement is the type of channels only members with the send
+// announcements permission post in, and that other servers can follow.
+const ChannelTypeAnnouncement = "announcement"
+
+// Embed is a rich content block attached to a message.
+type Embed struct {
+	Title       string       `bson:"title,omitempty" json:"title,omitempty"`
+	Description string       `bson:"description,omitempty" json:"description,omitempty"`
+	URL         string       `bson:"url,omitempty" json:"url,omitempty"`
+	Color       int          `bson:"color,omitempty" json:"color,omitempty"`
+	ImageURL    string       `bson:"image_url,omitempty" json:"image_url,omitempty"`
+	SiteName    string       `bson:"site_name,omitempty" json:"site_name,omitempty"`
+	Footer      string       `bson:"footer,omitempty" json:"footer,omitempty"`
+	Fields      []EmbedField `bson:"fields,omitempty" json:"fields,omitempty"`
+}
+
+type EmbedField struct {
+	Name   string `bson:"name" json:"name"`
+	Value  string `bson:"value" json:"value"`
+	Inline bool   `bson:"inline,omitempty" json:"inline,omitempty"`
+}
+
+// CloseSessionRevoked is the close code sent to connections whose session was revoked.
+const CloseSessionRevoked = 4004
+
+// CloseAccountDeleted is the close code sent to connections of deleted accounts.
+const CloseAccountDeleted = 4005
+
+// Event types sent to clients.
+const (
+	EventMessageCreate       = "MESSAGE_CREATE"
+	EventMessageUpdate       = "MESSAGE_UPDATE"
+	EventMessageDelete       = "MESSAGE_DELETE"
+	EventMemberJoin          = "MEMBER_JOIN"
+	EventMemberLeave         = "MEMBER_LEAVE"
+	EventMemberUpdate        = "MEMBER_UPDATE"
+	EventChannelCreate       = "CHANNEL_CREATE"
+	EventChannelUpdate       = "CHANNEL_UPDATE"
+	EventChannelDelete       = "CHANNEL_DELETE"
+	EventServerUpdate        = "SERVER_UPDATE"
+	EventServerDelete        = "SERVER_DELETE"
+	EventInteractionCreate   = "INTERACTION_CREATE"
+	EventInteractionDeferred = "INTERACTION_DEFERRED"
+	EventInteractionFailed   = "INTERACTION_FAILED"
+	EventError               = "ERROR"
+	EventRateLimited         = "RATE_LIMITED"
+	EventAutoModBlocked      = "AUTOMOD_BLOCKED"
+	EventMembersChunk        = "MEMBERS_CHUNK"
+	EventUserUpdate          = "USER_UPDATE"
+)
+
+// Ops clients can send.
+const (
+	OpSendMessage         = "SEND_MESSAGE"
+	OpInvokeCommand       = "INVOKE_COMMAND"
+	OpInteractionResponse = "INTERACTION_RESPONSE"
+	OpRequestMembers      = "REQUEST_MEMBERS"
+)
+
+// Event is a frame sent to clients. Exactly one of serverID, userID and
+// client selects who receives it.
+type Event struct {
+	Type string      `json:"t"`
+	Data interface{} `json:"d"`
+
+	serverID int
+	userID   int
+	client   *Client
+	// evictChannels are removed from clients along with serverID after a
+	// SERVER_DELETE event is delivered.
+	evictChannels []int
+}
+
+// inboundFrame is a frame received from a client.
+type inboundFrame struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+// Listener observes every event broadcast to a server, e.g. to forward it
+// outside the gateway. It runs on the broadcasting goroutine.
+type Listener func(serverID int, eventType string, data interface{})
+
 type Hub struct {
-	clients    map[int]map[int]*Client
-	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
-	mutex      sync.Mutex
+	clients      map[int]map[*Client]bool
+	users        map[int]map[*Client]bool
+	sessions     map[int]map[*Client]bool
+	broadcast    chan Event
+	direct       chan Event
+	register     chan *Client
+	unregister   chan *Client
+	interactions *interactionRegistry
+	listeners    []Listener
+	mutex        sync.Mutex
 }
 
 type Client struct {
-	conn     *websocket.Conn
-	userID   int
-	send     chan Message
+	conn      *websocket.Conn
+	userID    int
+	sessionID int
+	isBot     bool
+	send      chan Event
+	// access guards servers and channels, which the hub changes while the
+	// read loop checks them. channels maps each channel to its server.
+	access   sync.RWMutex
 	servers  []int
-	channels []int
+	channels map[int]int
+	// closed is set once send has been closed; only Hub.Run touches it.
+	closed bool
+}
+
+// inServer reports whether the connection receives the server's events.
+func (c *Client) inServer(serverID int) bool {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return slices.Contains(c.servers, serverID)
+}
+
+// channelServer returns the server of a channel the connection may use. The
+// server always comes from here, never from what the client sent.
+func (c *Client) channelServer(channelID int) (int, bool) {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	serverID, ok := c.channels[channelID]
+	return serverID, ok
+}
+
+func (c *Client) serverIDs() []int {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return slices.Clone(c.servers)
+}
+
+func (c *Client) setAccess(serverIDs []int, channels map[int]int) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.servers, c.channels = serverIDs, channels
+}
+
+// addServer adds a server and its channels, reporting false if the
+// connection already had it.
+func (c *Client) addServer(serverID int, channelIDs []int) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if slices.Contains(c.servers, serverID) {
+		return false
+	}
+	c.servers = append(c.servers, serverID)
+	if c.channels == nil {
+		c.channels = make(map[int]int)
+	}
+	for _, channelID := range channelIDs {
+		c.channels[channelID] = serverID
+	}
+	return true
+}
+
+func (c *Client) removeServer(serverID int, channelIDs []int) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.servers = slices.DeleteFunc(c.servers, func(id int) bool {
+		return id == serverID
+	})
+	for _, channelID := range channelIDs {
+		delete(c.channels, channelID)
+	}
 }
 
 type WebsocketHandler struct {
 	MongoDB *mongo.Client
+	DB      *sqlx.DB
 	Hub     *Hub
+	// AutoMod checks messages sent through the gateway; nil disables it.
+	AutoMod *automod.Engine
+
+	frameLimiter   *ratelimit.Limiter
+	userLimiter    *ratelimit.Limiter
+	channelLimiter *ratelimit.Limiter
+	slowMode       *ratelimit.Cooldown
 }
 
 var upgrader = websocket.Upgrader{
@@ -60,17 +253,71 @@ var upgrader = websocket.Upgrader{
 
 func NewHub() *Hub {
 	return &Hub{
-		clients:    make(map[int]map[int]*Client),
-		broadcast:  make(chan Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		clients:      make(map[int]map[*Client]bool),
+		users:        make(map[int]map[*Client]bool),
+		sessions:     make(map[int]map[*Client]bool),
+		broadcast:    make(chan Event),
+		direct:       make(chan Event),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		interactions: newInteractionRegistry(),
 	}
 }
 
 func (h *WebsocketHandler) RegisterRoutes(router *mux.Router) {
+	h.frameLimiter = ratelimit.New(frameBurst, framePeriod)
+	h.userLimiter = ratelimit.New(userMessageBurst, userMessagePeriod)
+	h.channelLimiter = ratelimit.New(channelMessageBurst, channelMessagePeriod)
+	h.slowMode = ratelimit.NewCooldown()
+
 	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handleWebSocket(h.MongoDB, h.Hub, w, r)
+		handleWebSocket(h, w, r)
 	}).Methods("GET")
+	router.HandleFunc("/interactions/{interaction_id}/callback", h.handleInteractionCallback).Methods("POST")
+}
+
+func addClient(index map[int]map[*Client]bool, key int, client *Client) {
+	if index[key] == nil {
+		index[key] = make(map[*Client]bool)
+	}
+	index[key][client] = true
+}
+
+func removeClient(index map[int]map[*Client]bool, key int, client *Client) {
+	if conns, ok := index[key]; ok {
+		delete(conns, client)
+		if len(conns) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// drop removes the client from every index and closes its send channel so
+// its write loop exits. The caller must hold the mutex.
+func (h *Hub) drop(client *Client) {
+	for _, serverID := range client.serverIDs() {
+		removeClient(h.clients, serverID, client)
+	}
+	removeClient(h.users, client.userID, client)
+	if !client.isBot {
+		removeClient(h.sessions, client.sessionID, client)
+	}
+	if !client.closed {
+		client.closed = true
+		close(client.send)
+	}
+}
+
+// deliver queues an event without blocking; clients that can't keep up are dropped.
+func (h *Hub) deliver(client *Client, event Event) {
+	if client.closed {
+		return
+	}
+	select {
+	case client.send <- event:
+	default:
+		h.drop(client)
+	}
 }
 
 func (h *Hub) Run(db *sqlx.DB) {
@@ -86,55 +333,58 @@ func (h *Hub) Run(db *sqlx.DB) {
 				continue
 			}
 
-			client.servers = serverIDs
-
-			var channelIDs []int
-			err = db.Select(&channelIDs, `
-				SELECT c.id
+			var rows []struct {
+				ID       int `db:"id"`
+				ServerID int `db:"server_id"`
+			}
+			err = db.Select(&rows, `
+				SELECT c.id, c.server_id
 				FROM   channels c
 				JOIN   user_servers us ON c.server_id = us.server_id
 				WHERE  us.user_id = $1
 			`, client.userID)
 			if err != nil {
 				log.Println("Database error (channels):", err)
-				return
+				continue
 			}
-			client.channels = channelIDs
+			channels := make(map[int]int, len(rows))
+			for _, row := range rows {
+				channels[row.ID] = row.ServerID
+			}
+			client.setAccess(serverIDs, channels)
 
 			h.mutex.Lock()
 			for _, serverID := range serverIDs {
-				if h.clients[serverID] == nil {
-					h.clients[serverID] = make(map[int]*Client)
-				}
-				h.clients[serverID][client.userID] = client
+				addClient(h.clients, serverID, client)
+			}
+			addClient(h.users, client.userID, client)
+			if !client.isBot {
+				addClient(h.sessions, client.sessionID, client)
 			}
 			h.mutex.Unlock()
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
-			for _, serverID := range client.servers {
-				if userMap, ok := h.clients[serverID]; ok {
-					delete(userMap, client.userID)
-					if len(userMap) == 0 {
-						delete(h.clients, serverID)
-					}
-				}
+			h.drop(client)
+			h.mutex.Unlock()
+
+		case event := <-h.broadcast:
+			h.mutex.Lock()
+			for client := range h.clients[event.serverID] {
+				h.deliver(client, event)
+			}
+			if event.Type == EventServerDelete {
+				h.evict(event.serverID, event.evictChannels)
 			}
 			h.mutex.Unlock()
 
-		case message := <-h.broadcast:
+		case event := <-h.direct:
 			h.mutex.Lock()
-			if userMap, ok := h.clients[message.ServerId]; ok {
-				for userID, client := range userMap {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(userMap, userID)
-					}
-				}
-				if len(userMap) == 0 {
-					delete(h.clients, message.ServerId)
+			if event.client != nil {
+				h.deliver(event.client, event)
+			} else {
+				for client := range h.users[event.userID] {
+					h.deliver(client, event)
 				}
 			}
 			h.mutex.Unlock()
@@ -142,9 +392,125 @@ func (h *Hub) Run(db *sqlx.DB) {
 	}
 }
 
-func handleWebSocket(mongDB *mongo.Client, hub *Hub, w http.ResponseWriter, r *http.Request) {
-	tokenStr := r.URL.Query().Get("token")
-	userID, err := auth.ValidateToken(tokenStr)
+// Listen registers a listener for server events.
+func (h *Hub) Listen(listener Listener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners = append(h.listeners, listener)
+}
+
+// Broadcast sends an event to everyone connected to the server.
+func (h *Hub) Broadcast(serverID int, eventType string, data interface{}) {
+	h.emit(Event{Type: eventType, Data: data, serverID: serverID})
+}
+
+// DeleteServer tells everyone connected to a deleted server and then removes
+// the server and its channels from their connections.
+func (h *Hub) DeleteServer(serverID int, channelIDs []int) {
+	h.emit(Event{
+		Type:          EventServerDelete,
+		Data:          map[string]int{"id": serverID},
+		serverID:      serverID,
+		evictChannels: channelIDs,
+	})
+}
+
+func (h *Hub) emit(event Event) {
+	h.mutex.Lock()
+	listeners := h.listeners
+	h.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(event.serverID, event.Type, event.Data)
+	}
+	h.broadcast <- event
+}
+
+// evict removes a deleted server from the clients connected to it. The caller
+// must hold the mutex.
+func (h *Hub) evict(serverID int, channelIDs []int) {
+	for client := range h.clients[serverID] {
+		client.removeServer(serverID, channelIDs)
+	}
+	delete(h.clients, serverID)
+}
+
+// AddMember adds a server the user joined, and its channels, to the user's
+// open connections so they get its events without reconnecting.
+func (h *Hub) AddMember(userID, serverID int, channelIDs []int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.users[userID] {
+		if client.addServer(serverID, channelIDs) {
+			addClient(h.clients, serverID, client)
+		}
+	}
+}
+
+// SendToUser sends an event to every connection of the user.
+func (h *Hub) SendToUser(userID int, eventType string, data interface{}) {
+	h.direct <- Event{Type: eventType, Data: data, userID: userID}
+}
+
+func (h *Hub) sendToClient(client *Client, eventType string, data interface{}) {
+	h.direct <- Event{Type: eventType, Data: data, client: client}
+}
+
+// IsUserConnected reports whether the user has an open gateway connection.
+func (h *Hub) IsUserConnected(userID int) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.users[userID]) > 0
+}
+
+// IsSessionConnected reports whether the session has an open gateway connection.
+func (h *Hub) IsSessionConnected(sessionID int) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.sessions[sessionID]) > 0
+}
+
+// DisconnectSession closes every connection of the session with CloseSessionRevoked.
+// The read loops of those connections then unregister them from the hub.
+func (h *Hub) DisconnectSession(sessionID int) {
+	h.mutex.Lock()
+	conns := make([]*Client, 0, len(h.sessions[sessionID]))
+	for client := range h.sessions[sessionID] {
+		conns = append(conns, client)
+	}
+	h.mutex.Unlock()
+
+	closeConnections(conns, CloseSessionRevoked, "session revoked")
+}
+
+// DisconnectUser closes every connection of the user, bots included, with
+// CloseAccountDeleted.
+func (h *Hub) DisconnectUser(userID int) {
+	h.mutex.Lock()
+	conns := make([]*Client, 0, len(h.users[userID]))
+	for client := range h.users[userID] {
+		conns = append(conns, client)
+	}
+	h.mutex.Unlock()
+
+	closeConnections(conns, CloseAccountDeleted, "account deleted")
+}
+
+func closeConnections(conns []*Client, code int, text string) {
+	closeMsg := websocket.FormatCloseMessage(code, text)
+	for _, client := range conns {
+		client.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		client.conn.Close()
+	}
+}
+
+func handleWebSocket(h *WebsocketHandler, w http.ResponseWriter, r *http.Request) {
+	// Browsers can't set headers on websocket requests, so the token may come
+	// from the query string. Bots usually send "Authorization: Bot <token>".
+	tokenStr := r.Header.Get("Authorization")
+	if tokenStr == "" {
+		tokenStr = r.URL.Query().Get("token")
+	}
+	claims, err := auth.Authenticate(tokenStr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -155,14 +521,16 @@ func handleWebSocket(mongDB *mongo.Client, hub *Hub, w http.ResponseWriter, r *h
 		return
 	}
 	client := &Client{
-		conn:    conn,
-		userID:  int(userID),
-		send:    make(chan Message),
-		servers: []int{},
+		conn:      conn,
+		userID:    claims.UserID,
+		sessionID: claims.SessionID,
+		isBot:     claims.IsBot,
+		send:      make(chan Event, 64),
+		servers:   []int{},
 	}
-	hub.register <- client
-	go client.writeMessages(hub)
-	client.readMessages(mongDB, hub)
+	h.Hub.register <- client
+	go client.writeMessages(h.Hub)
+	client.readMessages(h)
 }
 
 // writeMessages sends messages to the client
@@ -172,8 +540,8 @@ func (c *Client) writeMessages(hub *Hub) {
 		hub.unregister <- c
 	}()
 
-	for message := range c.send {
-		err := c.conn.WriteJSON(message)
+	for event := range c.send {
+		err := c.conn.WriteJSON(event)
 		if err != nil {
 			log.Println("Write error:", err)
 			return
@@ -181,51 +549,164 @@ func (c *Client) writeMessages(hub *Hub) {
 	}
 }
 
-// readMessages receives messages from the client
-func (c *Client) readMessages(mongoDB *mongo.Client, hub *Hub) {
+// readMessages receives frames from the client and dispatches them by op
+func (c *Client) readMessages(h *WebsocketHandler) {
 	defer func() {
-		hub.unregister <- c
+		h.Hub.unregister <- c
 		c.conn.Close()
 	}()
 
-	collection := mongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
-
 	for {
-		var msg struct {
-			Content   string `json:"content"`
-			ChannelID int    `json:"channel_id"`
-			ServerID  int    `json:"server_id"`
-		}
-		err := c.conn.ReadJSON(&msg)
+		var frame inboundFrame
+		err := c.conn.ReadJSON(&frame)
 		if err != nil {
 			log.Println("Read error:", err)
 			return
 		}
 
-		message := Message{
-			ChannelID: msg.ChannelID,
-			UserID:    c.userID,
-			Content:   msg.Content,
-			Type:      "text",
-			ServerId:  msg.ServerID,
-			CreatedAt: time.Now(),
-		}
-
-		authorized := slices.Contains(c.channels, message.ChannelID)
-		if !authorized {
-			log.Println("User not authorized to send message to channel")
+		if res := h.frameLimiter.Take(strconv.Itoa(c.userID)); !res.Allowed {
+			c.sendRateLimited(h.Hub, frame.Op, "gateway", res.RetryAfter)
 			continue
 		}
 
-		res, err := collection.InsertOne(context.Background(), message)
-		if err != nil {
-			log.Println("MongoDB insert error:", err)
-			continue
-		}
-		if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
-			message.ID = oid.Hex()
+		switch frame.Op {
+		case OpSendMessage:
+			c.handleSendMessage(h, frame.Data)
+		case OpInvokeCommand:
+			c.handleInvokeCommand(h, frame.Data)
+		case OpInteractionResponse:
+			c.handleInteractionResponse(h, frame.Data)
+		case OpRequestMembers:
+			c.handleRequestMembers(h, frame.Data)
+		default:
+			c.sendError(h.Hub, frame.Op, "unknown op")
 		}
+	}
+}
+
+func (c *Client) sendError(hub *Hub, op, message string) {
+	hub.sendToClient(c, EventError, map[string]string{"op": op, "message": message})
+}
+
+// sendRateLimited tells the client an op was dropped and when to retry.
+func (c *Client) sendRateLimited(hub *Hub, op, scope string, retryAfter time.Duration) {
+	hub.sendToClient(c, EventRateLimited, map[string]interface{}{
+		"op":          op,
+		"scope":       scope,
+		"retry_after": math.Ceil(retryAfter.Seconds()*1000) / 1000,
+	})
+}
+
+func messagesCollection(mongoDB *mongo.Client) *mongo.Collection {
+	return mongoDB.Database(os.Getenv("MONGO_DB")).Collection("messages")
+}
 
-		hub.broadcast <- message
+// errEmptyMessage is returned for messages with neither content nor embeds.
+var errEmptyMessage = &markdown.ValidationError{Reason: "message is empty"}
+
+// prepareContent sanitizes the message content and fills in its plain text.
+func prepareContent(message *Message) error {
+	parsed, err := markdown.Parse(message.Content)
+	if err != nil {
+		return err
+	}
+	if parsed.Text == "" && len(message.Embeds) == 0 {
+		return errEmptyMessage
+	}
+	message.Content = parsed.Text
+	message.PlainText = parsed.PlainText
+	return nil
+}
+
+// Publish sanitizes and stores the message and broadcasts it to the server.
+// The message's ID is set to the stored document's. Invalid content is
+// reported as a *markdown.ValidationError.
+func Publish(mongoDB *mongo.Client, hub *Hub, message *Message) error {
+	if err := prepareContent(message); err != nil {
+		return err
+	}
+	res, err := messagesCollection(mongoDB).InsertOne(context.Background(), message)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		message.ID = oid.Hex()
+	}
+
+	hub.Broadcast(message.ServerId, EventMessageCreate, *message)
+	return nil
+}
+
+func (h *WebsocketHandler) publish(message Message) error {
+	return Publish(h.MongoDB, h.Hub, &message)
+}
+
+func (c *Client) handleSendMessage(h *WebsocketHandler, data json.RawMessage) {
+	var msg struct {
+		Content   string `json:"content"`
+		ChannelID int    `json:"channel_id"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		c.sendError(h.Hub, OpSendMessage, "invalid payload")
+		return
+	}
+
+	// The client's server_id is ignored; the channel decides which
+	// server's rules apply.
+	serverID, ok := c.channelServer(msg.ChannelID)
+	if !ok {
+		log.Println("User not authorized to send message to channel")
+		return
+	}
+	message := Message{
+		ChannelID: msg.ChannelID,
+		UserID:    c.userID,
+		Content:   msg.Content,
+		Type:      "text",
+		ServerId:  serverID,
+		CreatedAt: time.Now(),
+		Bot:       c.isBot,
+	}
+
+	if res := h.userLimiter.Take(strconv.Itoa(c.userID)); !res.Allowed {
+		c.sendRateLimited(h.Hub, OpSendMessage, "user", res.RetryAfter)
+		return
+	}
+	if res := h.channelLimiter.Take(strconv.Itoa(message.ChannelID)); !res.Allowed {
+		c.sendRateLimited(h.Hub, OpSendMessage, "channel", res.RetryAfter)
+		return
+	}
+	interval, wait, err := h.SlowModeWait(c.userID, message.ChannelID, message.ServerId)
+	if err != nil {
+		log.Println("Database error (slow mode):", err)
+		c.sendError(h.Hub, OpSendMessage, "server error")
+		return
+	}
+	if wait > 0 {
+		c.sendRateLimited(h.Hub, OpSendMessage, "slowmode", wait)
+		return
+	}
+	allowed, err := c.moderate(h, &message)
+	if err != nil {
+		log.Println("Database error (automod):", err)
+		c.sendError(h.Hub, OpSendMessage, "server error")
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	if err := h.publish(message); err != nil {
+		var invalid *markdown.ValidationError
+		if errors.As(err, &invalid) {
+			c.sendError(h.Hub, OpSendMessage, invalid.Error())
+			return
+		}
+		log.Println("MongoDB insert error:", err)
+		return
+	}
+	// Only messages that went out count towards slow mode.
+	if interval > 0 {
+		h.RecordSlowMode(c.userID, message.ChannelID)
 	}
 }
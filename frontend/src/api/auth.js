@@ -16,5 +16,10 @@ export const getUser = async () => {
 };
 
 export const logout = async () => {
-  localStorage.removeItem('token');
+  try {
+    await api.post('/logout');
+  } finally {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+  }
 };
@@ -12,4 +12,40 @@ API.interceptors.request.use((config) => {
   return config;
 });
 
+let refreshing = null;
+
+const refreshTokens = async () => {
+  const refreshToken = localStorage.getItem('refresh_token');
+  if (!refreshToken) throw new Error('no refresh token');
+  const res = await axios.post(`${API.defaults.baseURL}token/refresh`, {
+    refresh_token: refreshToken,
+  });
+  localStorage.setItem('token', res.data.token);
+  localStorage.setItem('refresh_token', res.data.refresh_token);
+  return res.data.token;
+};
+
+API.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const original = error.config;
+    if (error.response?.status !== 401 || original._retried) {
+      return Promise.reject(error);
+    }
+    original._retried = true;
+    try {
+      refreshing = refreshing || refreshTokens();
+      const token = await refreshing;
+      original.headers.Authorization = token;
+      return API(original);
+    } catch (refreshError) {
+      localStorage.removeItem('token');
+      localStorage.removeItem('refresh_token');
+      return Promise.reject(error);
+    } finally {
+      refreshing = null;
+    }
+  }
+);
+
 export const api = API;
\ No newline at end of file
@@ -53,9 +53,11 @@ const Chat = ({ channel }) => {
 
     const handleMessage = (event) => {
       try {
-        const msg = JSON.parse(event.data);
-        if (msg.channel_id === channel.id) {
-          setMessages((prev) => [...prev, msg]);
+        const { t, d } = JSON.parse(event.data);
+        if (t === 'MESSAGE_CREATE' && d.channel_id === channel.id) {
+          setMessages((prev) => [...prev, d]);
+        } else if (t === 'MESSAGE_UPDATE' && d.channel_id === channel.id) {
+          setMessages((prev) => prev.map((m) => (m.id === d.id ? { ...m, ...d } : m)));
         }
       } catch (err) {
         console.error('Invalid message format', event.data);
@@ -69,7 +71,7 @@ const Chat = ({ channel }) => {
   const sendMessage = () => {
     if (!input.trim() || !wsRef?.current) return;
     const msg = { content: input, channel_id: channel.id, server_id: channel.server_id };
-    wsRef.current.send(JSON.stringify(msg));
+    wsRef.current.send(JSON.stringify({ op: 'SEND_MESSAGE', d: msg }));
     setInput('');
   };
 
@@ -1,7 +1,7 @@
 import { forwardRef } from 'react';
 
 const Message = forwardRef (({ message }, ref) => {
-  const { user_name, content, created_at } = message;
+  const { user_name, content, created_at, embeds } = message;
 
   const initial = user_name?.charAt(0)?.toUpperCase() || '?';
 
@@ -32,6 +32,18 @@ const Message = forwardRef (({ message }, ref) => {
         <span className="text-xs text-gray-500">{displayTime}</span>
       </div>
       <div className="text-gray-800">{content}</div>
+      {embeds?.map((embed, i) => (
+        <div key={i} className="mt-2 border-l-4 border-blue-400 bg-white p-2 rounded max-w-md">
+          {embed.site_name && <div className="text-xs text-gray-500">{embed.site_name}</div>}
+          {embed.title && (
+            <a href={embed.url} target="_blank" rel="noopener noreferrer" className="font-semibold text-blue-600">
+              {embed.title}
+            </a>
+          )}
+          {embed.description && <div className="text-sm text-gray-700">{embed.description}</div>}
+          {embed.image_url && <img src={embed.image_url} alt="" className="mt-1 max-h-48 rounded" />}
+        </div>
+      ))}
     </div>
   );
 });
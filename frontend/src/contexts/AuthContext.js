@@ -24,15 +24,16 @@ export const AuthProvider = ({ children }) => {
     fetchUser();
   }, []);
 
-  const login = async (token) => {
+  const login = async (token, refreshToken) => {
     setLoading(true);
     localStorage.setItem('token', token);
+    localStorage.setItem('refresh_token', refreshToken);
     await fetchUser();
     setLoading(false);
   };
 
-  const logout = () => {
-    apiLogout();
+  const logout = async () => {
+    await apiLogout();
     setUser(null);
   };
 
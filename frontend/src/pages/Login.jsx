@@ -16,8 +16,8 @@ const Login = () => {
     if (err) return setError(err);
 
     try {
-      const { token } = await loginAPI(form);
-      login(token);
+      const { token, refresh_token } = await loginAPI(form);
+      login(token, refresh_token);
       navigate('/dashboard');
     } catch (e) {
       setError(e.response?.data?.message || 'Login failed');
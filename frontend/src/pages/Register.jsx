@@ -16,8 +16,8 @@ const Register = () => {
     if (err) return setError(err);
 
     try {
-      const { token } = await register(form);
-      await login(token);
+      const { token, refresh_token } = await register(form);
+      await login(token, refresh_token);
       navigate('/dashboard');
     } catch (e) {
       setError(e.response?.data?.message || 'Registration failed');